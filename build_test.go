@@ -0,0 +1,112 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTreeAndCommit(t *testing.T) {
+	dir := t.TempDir()
+	gitCmd(t, dir, "", "init", "-q", "--bare")
+	g, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := g.Put(ObjBlob, []byte("data\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := g.WriteTree([]*Node{{Name: "inner", Perm: ModeFile, Ref: blob}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "a.txt" < "a/" < "a0" in git's order, although "a" < "a.txt"
+	root, err := g.WriteTree([]*Node{
+		{Name: "a0", Perm: ModeFile, Ref: blob},
+		{Name: "a", Perm: ModeDir, Ref: sub.name},
+		{Name: "a.txt", Perm: ModeExecutable, Ref: blob},
+		{Name: "link", Perm: ModeSymLink, Ref: blob},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mktree := fmt.Sprintf("100644 blob %s\ta0\n040000 tree %s\ta\n100755 blob %s\ta.txt\n120000 blob %s\tlink\n",
+		&blob, &sub.name, &blob, &blob)
+	want := strings.TrimSpace(gitCmd(t, dir, mktree, "mktree"))
+	if root.name.String() != want {
+		t.Fatalf("tree is %s, git says %s", &root.name, want)
+	}
+	if got := strings.Join(root.Listing(), " "); got != "a.txt a a0 link" {
+		t.Fatalf("bad order %q", got)
+	}
+
+	when := time.Unix(1500000000, 0).In(time.FixedZone("", -5*3600))
+	c, err := g.WriteCommit(&Commit{
+		Tree:      root.name,
+		Author:    &Stamp{"A U Thor", "author@example.com", when},
+		Committer: &Stamp{"C O Mitter", "committer@example.com", when},
+		Message:   "first\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = strings.TrimSpace(gitCmd(t, dir, "first\n", "commit-tree", root.name.String()))
+	if c.name.String() != want {
+		t.Fatalf("commit is %s, git says %s", &c.name, want)
+	}
+	gitCmd(t, dir, "", "fsck", "--strict", c.name.String())
+}
+
+func TestCommitRoundTrip(t *testing.T) {
+	g := New()
+	m := newMemStore(g)
+
+	tree := m.add(ObjTree, "")
+	stamp := "A U Thor <author@example.com> 1500000000 -0000"
+	raw := fmt.Sprintf("tree %s\n"+
+		"author %s\n"+
+		"committer %s\n"+
+		"encoding ISO-8859-1\n"+
+		"gpgsig -----BEGIN PGP SIGNATURE-----\n"+
+		" \n"+
+		" iQEzBAABCAAdFiEE\n"+
+		" -----END PGP SIGNATURE-----\n"+
+		"\n"+
+		"caf\xe9\n", &tree, stamp, stamp)
+	p := m.add(ObjCommit, raw)
+
+	o, err := g.Get(&p).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := o.(*Commit).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, []byte(raw)) {
+		t.Fatalf("round trip produced\n%q\nexpected\n%q", buf, raw)
+	}
+}
+
+func TestEncodeTreeRejects(t *testing.T) {
+	var blob Ptr
+	for _, nodes := range [][]*Node{
+		// a.b sorts between the file a and the directory a
+		{{Name: "a", Perm: ModeFile, Ref: blob},
+			{Name: "a.b", Perm: ModeFile, Ref: blob},
+			{Name: "a", Perm: ModeDir, Ref: blob}},
+		{{Name: "a", Perm: ModeFile, Ref: blob},
+			{Name: "a", Perm: ModeFile, Ref: blob}},
+		{{Name: "a", Perm: 0100664, Ref: blob}},
+		{{Name: "a/b", Perm: ModeFile, Ref: blob}},
+		{{Name: "..", Perm: ModeDir, Ref: blob}},
+	} {
+		if _, err := EncodeTree(nodes); err != ErrBadTreeEntry {
+			t.Errorf("%s %o: got %v", nodes[len(nodes)-1].Name, nodes[len(nodes)-1].Perm, err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package git
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CheckoutOptions controls Checkout
+type CheckoutOptions struct {
+	// Filter selects the files to write, by path; the rest are
+	// recorded in the index as skip-worktree, as in a sparse
+	// checkout.  See SparsePatterns
+	Filter func(path string) bool
+	// UpdateIndex replaces the repository's index with the result
+	UpdateIndex bool
+}
+
+// SparsePatterns returns a Filter from patterns in the syntax of
+// .git/info/sparse-checkout, which is that of .gitignore, except
+// that matching paths are selected rather than ignored.  A path is
+// selected by the last pattern that matches it or, failing that,
+// one of its parent directories
+func SparsePatterns(patterns []string) func(string) bool {
+	m := NewIgnoreMatcher()
+	m.AddPatterns("", []byte(strings.Join(patterns, "\n")))
+	return func(p string) bool {
+		isDir := false
+		for p != "." {
+			if selected, ok := m.lookup(p, isDir); ok {
+				return selected
+			}
+			p = path.Dir(p)
+			isDir = true
+		}
+		return false
+	}
+}
+
+// Checkout writes the files of a tree (or the tree of a commit) into
+// dir, which is created if need be, and returns an index describing
+// them.  Existing files are replaced, and anything else in dir is
+// left alone.  Submodules become empty directories, as in git
+func (g *Git) Checkout(rev *Ptr, dir string, opts *CheckoutOptions) (*Index, error) {
+	if opts == nil {
+		opts = &CheckoutOptions{}
+	}
+	t, err := g.peelToTree(rev)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]*Node)
+	if err := g.checkoutFiles(t, "", files); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	idx := NewIndex()
+	for p, n := range files {
+		e := &IndexEntry{Path: p, Mode: n.Perm, Ptr: n.Ref}
+		if opts.Filter != nil && !opts.Filter(p) {
+			e.SkipWorktree = true
+			idx.Entries = append(idx.Entries, e)
+			continue
+		}
+		full := filepath.Join(dir, filepath.FromSlash(p))
+		if err := leadingDirs(dir, p); err != nil {
+			return nil, err
+		}
+		if err := g.checkoutFile(n, full); err != nil {
+			return nil, err
+		}
+		fi, err := os.Lstat(full)
+		if err != nil {
+			return nil, err
+		}
+		e.StatData = statData(fi)
+		idx.Entries = append(idx.Entries, e)
+	}
+	sort.Slice(idx.Entries, func(i, j int) bool {
+		return indexLess(idx.Entries[i], idx.Entries[j])
+	})
+
+	if opts.UpdateIndex {
+		if err := g.WriteIndex(idx); err != nil {
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+// checkoutFiles is like flattenTree, but refuses any names that
+// could write outside the directory, or into a repository
+func (g *Git) checkoutFiles(t *Tree, dir string, out map[string]*Node) error {
+	for _, n := range t.Nodes() {
+		if n.Name == "" || n.Name == "." || n.Name == ".." ||
+			strings.EqualFold(n.Name, ".git") ||
+			strings.ContainsAny(n.Name, "/\\\x00") {
+			return ErrBadTreeEntry
+		}
+		p := path.Join(dir, n.Name)
+		if !n.IsDir() {
+			out[p] = n
+			continue
+		}
+		sub, err := g.peelToTree(&n.Ref)
+		if err != nil {
+			return err
+		}
+		if err := g.checkoutFiles(sub, p, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leadingDirs makes the directories leading to a path in dir,
+// replacing any symlinks or files in the way, so that nothing is
+// written through a link to somewhere else (as git's
+// has_symlink_leading_path check makes sure of)
+func leadingDirs(dir, p string) error {
+	cur := dir
+	parts := strings.Split(p, "/")
+	for _, part := range parts[:len(parts)-1] {
+		cur = filepath.Join(cur, part)
+		fi, err := os.Lstat(cur)
+		if err == nil && fi.IsDir() {
+			continue
+		}
+		if err == nil {
+			if err := os.Remove(cur); err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Mkdir(cur, 0777); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkoutFile writes one file, replacing whatever was there.  The
+// directories leading to it have to be there already
+func (g *Git) checkoutFile(n *Node, full string) error {
+	if n.IsSubmodule() {
+		if fi, err := os.Lstat(full); err == nil && !fi.IsDir() {
+			if err := os.Remove(full); err != nil {
+				return err
+			}
+		}
+		return os.MkdirAll(full, 0777)
+	}
+
+	o, err := g.load(&n.Ref)
+	if err != nil {
+		return err
+	}
+	b, ok := o.(*Blob)
+	if !ok {
+		return ErrNotBlob
+	}
+	// remove the old file first, so as not to write through a
+	// symlink or keep its permissions
+	if err := os.Remove(full); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if n.IsSymLink() {
+		return os.Symlink(filepath.FromSlash(string(b.data)), full)
+	}
+
+	perm := os.FileMode(0666)
+	if n.Perm&0111 != 0 {
+		perm = 0777
+	}
+	f, err := os.OpenFile(full, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b.data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
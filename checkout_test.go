@@ -0,0 +1,127 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckout(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	os.Mkdir(src, 0755)
+	initRepo(t, src)
+	writeFile(t, src, "README", "hello\n")
+	writeFile(t, src, "a.b", "sorts before a/\n")
+	writeFile(t, src, "a/inner.txt", "inner\n")
+	writeFile(t, src, "docs/guide/index.md", "# guide\n")
+	writeFile(t, src, "tools/run.sh", "#!/bin/sh\n")
+	os.Chmod(filepath.Join(src, "tools/run.sh"), 0755)
+	os.Symlink("../README", filepath.Join(src, "a/link"))
+	gitCmd(t, src, "", "add", ".")
+	gitCmd(t, src, "", "commit", "-q", "-m", "one")
+
+	// a clone with no work tree files yet
+	out := filepath.Join(dir, "out")
+	gitCmd(t, dir, "", "clone", "-q", "--no-checkout", src, out)
+	g, err := Open(filepath.Join(out, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := mustRev(t, g, "HEAD")
+
+	idx, err := g.Checkout(head, out, &CheckoutOptions{UpdateIndex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gitCmd(t, out, "", "status", "--porcelain"); got != "" {
+		t.Errorf("expected a clean checkout, got:\n%s", got)
+	}
+	if got, expect := lsFiles(idx), gitCmd(t, src, "", "ls-files", "-s"); got != expect {
+		t.Errorf("index is:\n%s\nexpected:\n%s", got, expect)
+	}
+	fi, err := os.Stat(filepath.Join(out, "tools/run.sh"))
+	if err != nil || fi.Mode()&0100 == 0 {
+		t.Errorf("expected run.sh to be executable")
+	}
+	if target, err := os.Readlink(filepath.Join(out, "a/link")); err != nil || target != "../README" {
+		t.Errorf("bad symlink %q (%v)", target, err)
+	}
+
+	// the stat data is good enough that status needn't hash the
+	// file, which we check by giving the entry the wrong name
+	e := idx.Entry("README")
+	e.Ptr = HashObject(ObjBlob, []byte("something else"))
+	idx.mtime = e.MTime.Add(time.Second)
+	s := &statusScan{repo: g, dir: out, idx: idx}
+	if c, err := s.checkFile(e); err != nil || c != nil {
+		t.Errorf("expected stat data to match, got %v %v", c, err)
+	}
+
+	// sparse
+	sparse := filepath.Join(dir, "sparse")
+	idx, err = g.Checkout(head, sparse, &CheckoutOptions{
+		Filter: SparsePatterns([]string{"/*", "!/*/", "docs/"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	filepath.Walk(sparse, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			rel, _ := filepath.Rel(sparse, p)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if strings.Join(got, " ") != "README a.b docs/guide/index.md" {
+		t.Errorf("sparse checkout wrote %q", got)
+	}
+	if e := idx.Entry("tools/run.sh"); e == nil || !e.SkipWorktree {
+		t.Errorf("expected a skip-worktree entry for tools/run.sh")
+	}
+}
+
+func TestCheckoutThroughSymlink(t *testing.T) {
+	g, err := Init(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	link, _ := g.Put(ObjBlob, []byte(outside))
+	inner, _ := g.Put(ObjBlob, []byte("inner\n"))
+	sub, err := g.WriteTree([]*Node{{Name: "inner.txt", Perm: ModeFile, Ref: inner}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first leaves a as a symlink, then the second has a
+	// directory there
+	a, err := g.WriteTree([]*Node{{Name: "a", Perm: ModeSymLink, Ref: link}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := g.WriteTree([]*Node{{Name: "a", Perm: ModeDir, Ref: sub.name}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if _, err := g.Checkout(&a.name, dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Checkout(&b.name, dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "inner.txt")); err == nil {
+		t.Errorf("checkout wrote through the symlink")
+	}
+	fi, err := os.Lstat(filepath.Join(dir, "a"))
+	if err != nil || !fi.IsDir() {
+		t.Errorf("a is not a directory: %v", err)
+	}
+	if buf, err := os.ReadFile(filepath.Join(dir, "a", "inner.txt")); string(buf) != "inner\n" {
+		t.Errorf("a/inner.txt is %q, %v", buf, err)
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 type Stamp struct {
@@ -25,14 +28,16 @@ func (s *Stamp) String() string {
 }
 
 type Commit struct {
-	name      Ptr
-	raw       []byte
-	repo      *Git
-	Tree      Ptr
-	Parent    Ptr
-	Author    *Stamp
-	Committer *Stamp
-	Message   string
+	name       Ptr
+	raw        []byte
+	repo       *Git
+	Tree       Ptr
+	Parents    []Ptr // in order; more than one for a merge commit
+	Author     *Stamp
+	Committer  *Stamp
+	Message    string
+	headers    []Header
+	rawMessage []byte
 }
 
 func (c *Commit) Type() ObjType {
@@ -51,66 +56,290 @@ func (c *Commit) Name() *Ptr {
 	return &c.name
 }
 
+// FirstParent returns the first parent of the commit, or nil if
+// this is a root commit
+func (c *Commit) FirstParent() *Ptr {
+	if len(c.Parents) == 0 {
+		return nil
+	}
+	return &c.Parents[0]
+}
+
+// IsMerge returns true if the commit has more than one parent
+func (c *Commit) IsMerge() bool {
+	return len(c.Parents) > 1
+}
+
 func (g *Git) loadCommit(name *Ptr, buf []byte) (*Commit, error) {
 	c := &Commit{
 		name: *name,
 		repo: g,
 		raw:  buf,
 	}
-	r := bytes.NewBuffer(buf)
+	hdrs, msg, err := parseHeaders(buf)
+	if err != nil {
+		return nil, err
+	}
+	c.headers = hdrs
+	c.rawMessage = msg
 
-	for {
-		line, err := r.ReadBytes('\n')
-		if err != nil {
-			break
-		}
-		k := bytes.IndexByte(line, ' ')
-		//fmt.Printf("%q %d\n", line, k)
-		if k < 0 {
-			break
-		}
-		rest := line[k+1 : len(line)-1]
-		fmt.Printf("[%s] %q\n", string(line[:k]), rest)
-		switch string(line[:k]) {
+	for _, h := range hdrs {
+		switch h.Key {
 		case "tree":
-			ref, err := g.ExpandRef(string(rest))
-			if err != nil {
-				panic(err)
+			ref, ok := ParsePtr(h.Value)
+			if !ok {
+				return nil, ErrBadCommit
 			}
-			c.Tree = *ref
+			c.Tree = ref
 		case "parent":
-			ref, err := g.ExpandRef(string(rest))
-			if err != nil {
-				panic(err)
+			ref, ok := ParsePtr(h.Value)
+			if !ok {
+				return nil, ErrBadCommit
 			}
-			c.Parent = *ref
+			c.Parents = append(c.Parents, ref)
 		case "author":
-			s, err := parseStamp(rest)
+			s, err := parseStamp([]byte(h.Value))
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
 			c.Author = s
-			//fmt.Printf("author %s\n", s)
 		case "committer":
-			s, err := parseStamp(rest)
+			s, err := parseStamp([]byte(h.Value))
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
 			c.Committer = s
-			//fmt.Printf("commiter %s\n", s)
 		}
 	}
-	c.Message = r.String()
-	//fmt.Printf("message %q\n", c.Message)
-	//fmt.Printf("***\n%#v\n", c)
+	c.Message = decodeMessage(c.Encoding(), msg)
 	return c, nil
 }
 
+var ErrBadCommit = errors.New("malformed commit object")
+
+// A Header is one of the "key value" lines at the start of a commit
+// or tag object.  Multi-line values (such as gpgsig) are stored in
+// the object as continuation lines starting with a space; in Value,
+// the leading space is removed and the lines are joined with '\n'
+type Header struct {
+	Key   string
+	Value string
+}
+
+// parseHeaders splits an object into its headers and the message
+// following the blank line
+func parseHeaders(buf []byte) ([]Header, []byte, error) {
+	var hdrs []Header
+
+	for len(buf) > 0 {
+		eol := bytes.IndexByte(buf, '\n')
+		if eol < 0 {
+			// headers with no message and no terminating newline
+			eol = len(buf)
+		}
+		line := buf[:eol]
+		if eol < len(buf) {
+			buf = buf[eol+1:]
+		} else {
+			buf = nil
+		}
+		if len(line) == 0 {
+			// a blank line separates the headers from the message
+			return hdrs, buf, nil
+		}
+		if line[0] == ' ' {
+			if len(hdrs) == 0 {
+				return nil, nil, ErrBadHeader
+			}
+			last := &hdrs[len(hdrs)-1]
+			last.Value = last.Value + "\n" + string(line[1:])
+			continue
+		}
+		k := bytes.IndexByte(line, ' ')
+		if k < 0 {
+			return nil, nil, ErrBadHeader
+		}
+		hdrs = append(hdrs, Header{
+			Key:   string(line[:k]),
+			Value: string(line[k+1:]),
+		})
+	}
+	return hdrs, nil, nil
+}
+
+var ErrBadHeader = errors.New("malformed object header")
+
+// decodeMessage converts a commit message in the given encoding to
+// UTF-8.  If the encoding is not known, the message is returned
+// unchanged
+func decodeMessage(enc string, msg []byte) string {
+	if enc == "" || strings.EqualFold(enc, "utf-8") || strings.EqualFold(enc, "utf8") {
+		return string(msg)
+	}
+	e, err := htmlindex.Get(enc)
+	if err != nil {
+		log.Warning("unknown commit encoding %q", enc)
+		return string(msg)
+	}
+	s, err := e.NewDecoder().Bytes(msg)
+	if err != nil {
+		log.Warning("could not decode %q message: %s", enc, err)
+		return string(msg)
+	}
+	return string(s)
+}
+
+// Headers returns all of the commit's headers, in the order they
+// appear in the object
+func (c *Commit) Headers() []Header {
+	return c.headers
+}
+
+// Header returns the value of the first header with the given key,
+// or "" if there is none
+func (c *Commit) Header(key string) string {
+	for _, h := range c.headers {
+		if h.Key == key {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// HeaderValues returns the values of all headers with the given key
+func (c *Commit) HeaderValues(key string) []string {
+	var lst []string
+	for _, h := range c.headers {
+		if h.Key == key {
+			lst = append(lst, h.Value)
+		}
+	}
+	return lst
+}
+
+// Encoding returns the value of the encoding header, which is ""
+// for (the usual case of) UTF-8 messages
+func (c *Commit) Encoding() string {
+	return c.Header("encoding")
+}
+
+// GPGSignature returns the armored signature from the gpgsig header,
+// or "" if the commit is not signed
+func (c *Commit) GPGSignature() string {
+	return c.Header("gpgsig")
+}
+
+// MergeTags returns the text of the tag objects embedded by
+// "git merge" when merging a signed tag
+func (c *Commit) MergeTags() []string {
+	return c.HeaderValues("mergetag")
+}
+
+// RawMessage returns the commit message as stored, before conversion
+// from its encoding
+func (c *Commit) RawMessage() []byte {
+	return c.rawMessage
+}
+
+// Encode produces the payload of a commit object.  The tree,
+// parents, author, committer and message come from the exported
+// fields, followed by any other headers the commit was loaded with,
+// so encoding a loaded commit reproduces it exactly.  Once anything
+// has changed, though, a signature (or a merged tag) would no longer
+// be right, so those are left out, as is the encoding of a message
+// that is no longer the one stored in it
+func (c *Commit) Encode() ([]byte, error) {
+	if c.Author == nil || c.Committer == nil {
+		return nil, ErrBadCommit
+	}
+	buf := c.encode(true)
+	if c.raw != nil && bytes.Equal(buf, c.raw) {
+		return buf, nil
+	}
+	return c.encode(false), nil
+}
+
+// encode formats the commit, with or without its signatures
+func (c *Commit) encode(signed bool) []byte {
+	// the stored message is kept as it was, encoding and all, if
+	// it is still the message
+	keepMessage := c.rawMessage != nil &&
+		decodeMessage(c.Encoding(), c.rawMessage) == c.Message
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "tree %s\n", &c.Tree)
+	for i := range c.Parents {
+		fmt.Fprintf(&buf, "parent %s\n", &c.Parents[i])
+	}
+	fmt.Fprintf(&buf, "author %s\n", c.Author.encode())
+	fmt.Fprintf(&buf, "committer %s\n", c.Committer.encode())
+	for _, h := range c.headers {
+		switch h.Key {
+		case "tree", "parent", "author", "committer":
+			continue
+		case "gpgsig", "mergetag":
+			if !signed {
+				continue
+			}
+		case "encoding":
+			if !keepMessage {
+				continue
+			}
+		}
+		buf.WriteString(h.Key)
+		buf.WriteByte(' ')
+		buf.WriteString(strings.Replace(h.Value, "\n", "\n ", -1))
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	if keepMessage {
+		buf.Write(c.rawMessage)
+	} else {
+		buf.WriteString(c.Message)
+	}
+	return buf.Bytes()
+}
+
+// WriteCommit stores a new commit object built from the Tree,
+// Parents, Author, Committer and Message of the given commit (along
+// with its other headers, as Encode describes), and returns the
+// stored commit
+func (g *Git) WriteCommit(c *Commit) (*Commit, error) {
+	buf, err := c.Encode()
+	if err != nil {
+		return nil, err
+	}
+	p, err := g.Put(ObjCommit, buf)
+	if err != nil {
+		return nil, err
+	}
+	return g.loadCommit(&p, buf)
+}
+
+// encode formats the stamp the way it appears in a commit or tag
+func (s *Stamp) encode() string {
+	zone, offset := s.Timestamp.Zone()
+	if !tzPat.MatchString(zone) {
+		sign := '+'
+		if offset < 0 {
+			sign = '-'
+			offset = -offset
+		}
+		zone = fmt.Sprintf("%c%02d%02d", sign, offset/3600, (offset/60)%60)
+	}
+	return fmt.Sprintf("%s <%s> %d %s", s.UserName, s.Email, s.Timestamp.Unix(), zone)
+}
+
+var tzPat = regexp.MustCompile(`^[+-][0-9]{4}$`)
+
 var stampPat = regexp.MustCompile(`(.*)\s+<([^>]+)> (\d+) ([+-]?[0-9]+)`)
 
 func parseStamp(buf []byte) (*Stamp, error) {
 	sub := stampPat.FindStringSubmatch(string(buf))
 	//fmt.Printf("%q --> %#v\n", buf, sub)
+	if sub == nil {
+		return nil, ErrBadStamp
+	}
 
 	timeSec, err := strconv.ParseInt(sub[3], 10, 63)
 	if err != nil {
@@ -172,3 +401,4 @@ func parseOffset(tz string) (*time.Location, error) {
 }
 
 var ErrInvalidTimeZone = errors.New("invalid time zone")
+var ErrBadStamp = errors.New("malformed identity stamp")
@@ -0,0 +1,143 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMergeCommitParents(t *testing.T) {
+	g := New()
+	m := newMemStore(g)
+
+	tree := m.add(ObjTree, "")
+	stamp := "A U Thor <author@example.com> 1500000000 -0500"
+	root := m.add(ObjCommit, fmt.Sprintf("tree %s\nauthor %s\ncommitter %s\n\nroot\n",
+		&tree, stamp, stamp))
+	side := m.add(ObjCommit, fmt.Sprintf("tree %s\nparent %s\nauthor %s\ncommitter %s\n\nside\n",
+		&tree, &root, stamp, stamp))
+	main := m.add(ObjCommit, fmt.Sprintf("tree %s\nparent %s\nauthor %s\ncommitter %s\n\nmain\n",
+		&tree, &root, stamp, stamp))
+	merge := m.add(ObjCommit, fmt.Sprintf("tree %s\nparent %s\nparent %s\nauthor %s\ncommitter %s\n\nmerge\n",
+		&tree, &main, &side, stamp, stamp))
+
+	o, err := g.Get(&merge).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := o.(*Commit)
+	if len(c.Parents) != 2 || !c.IsMerge() {
+		t.Fatalf("expected 2 parents, got %d", len(c.Parents))
+	}
+	if !c.FirstParent().Equals(&main) || !c.Parents[1].Equals(&side) {
+		t.Fatalf("parents out of order: %v", c.Parents)
+	}
+	if c.Message != "merge\n" {
+		t.Fatalf("bad message %q", c.Message)
+	}
+
+	o, err = g.Get(&root).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := o.(*Commit).FirstParent(); p != nil {
+		t.Fatalf("root commit has parent %s", p)
+	}
+}
+
+func TestCommitHeaders(t *testing.T) {
+	g := New()
+	m := newMemStore(g)
+
+	tree := m.add(ObjTree, "")
+	stamp := "A U Thor <author@example.com> 1500000000 -0500"
+	signed := m.add(ObjCommit, fmt.Sprintf("tree %s\n"+
+		"author %s\n"+
+		"committer %s\n"+
+		"encoding ISO-8859-1\n"+
+		"gpgsig -----BEGIN PGP SIGNATURE-----\n"+
+		" \n"+
+		" iQEzBAABCAAdFiEE\n"+
+		" -----END PGP SIGNATURE-----\n"+
+		"x-custom hello\n"+
+		"\n"+
+		"caf\xe9\n", &tree, stamp, stamp))
+
+	o, err := g.Get(&signed).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := o.(*Commit)
+	if len(c.Headers()) != 6 {
+		t.Fatalf("expected 6 headers, got %d", len(c.Headers()))
+	}
+	sig := "-----BEGIN PGP SIGNATURE-----\n\niQEzBAABCAAdFiEE\n-----END PGP SIGNATURE-----"
+	if c.GPGSignature() != sig {
+		t.Fatalf("bad signature %q", c.GPGSignature())
+	}
+	if c.Header("x-custom") != "hello" {
+		t.Fatalf("bad extra header %q", c.Header("x-custom"))
+	}
+	if c.Message != "café\n" {
+		t.Fatalf("bad message %q", c.Message)
+	}
+	if string(c.RawMessage()) != "caf\xe9\n" {
+		t.Fatalf("bad raw message %q", c.RawMessage())
+	}
+	if c.Committer == nil || c.Committer.Email != "author@example.com" {
+		t.Fatalf("bad committer %v", c.Committer)
+	}
+}
+
+func TestEncodeChangedCommit(t *testing.T) {
+	g := New()
+	m := newMemStore(g)
+
+	tree := m.add(ObjTree, "")
+	stamp := "A U Thor <author@example.com> 1500000000 -0500"
+	payload := fmt.Sprintf("tree %s\n"+
+		"author %s\n"+
+		"committer %s\n"+
+		"encoding ISO-8859-1\n"+
+		"gpgsig -----BEGIN PGP SIGNATURE-----\n"+
+		" iQEzBAABCAAdFiEE\n"+
+		" -----END PGP SIGNATURE-----\n"+
+		"x-custom hello\n"+
+		"\n"+
+		"caf\xe9\n", &tree, stamp, stamp)
+	signed := m.add(ObjCommit, payload)
+	load := func() *Commit {
+		o, err := g.Get(&signed).Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o.(*Commit)
+	}
+
+	buf, err := load().Encode()
+	if err != nil || string(buf) != payload {
+		t.Fatalf("unchanged commit encoded as %q, %v", buf, err)
+	}
+
+	// another parent: the signature goes, but the message is as
+	// it was, encoding and all
+	c := load()
+	c.Parents = append(c.Parents, signed)
+	buf, _ = c.Encode()
+	if strings.Contains(string(buf), "gpgsig") ||
+		!strings.Contains(string(buf), "encoding ISO-8859-1\n") ||
+		!strings.HasSuffix(string(buf), "\ncaf\xe9\n") {
+		t.Errorf("new parent encoded as %q", buf)
+	}
+
+	// a new message is written as UTF-8, so without the encoding
+	c = load()
+	c.Message = "café au lait\n"
+	buf, _ = c.Encode()
+	if strings.Contains(string(buf), "gpgsig") ||
+		strings.Contains(string(buf), "encoding") ||
+		!strings.Contains(string(buf), "x-custom hello\n") ||
+		!strings.HasSuffix(string(buf), "\ncafé au lait\n") {
+		t.Errorf("new message encoded as %q", buf)
+	}
+}
@@ -0,0 +1,152 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// A Config holds the variables from a git config file.  Names are
+// the usual dotted form, "section.subsection.key", with the section
+// and key folded to lower case (subsections are case sensitive)
+type Config struct {
+	vars map[string][]string
+}
+
+var ErrBadConfig = errors.New("malformed config file")
+
+// Get returns the last value of the given variable, which is the
+// one that takes effect, or "" if it is not set
+func (c *Config) Get(name string) string {
+	lst := c.vars[normalizeConfigName(name)]
+	if len(lst) == 0 {
+		return ""
+	}
+	return lst[len(lst)-1]
+}
+
+// GetAll returns all the values of a multi-valued variable, such as
+// remote.origin.fetch
+func (c *Config) GetAll(name string) []string {
+	return c.vars[normalizeConfigName(name)]
+}
+
+func normalizeConfigName(name string) string {
+	first := strings.IndexByte(name, '.')
+	last := strings.LastIndexByte(name, '.')
+	if first < 0 {
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(name[:first]) + name[first:last] + strings.ToLower(name[last:])
+}
+
+// ParseConfig parses the contents of a git config file.  Includes
+// are not followed
+func ParseConfig(buf []byte) (*Config, error) {
+	c := &Config{vars: make(map[string][]string)}
+	section := ""
+
+	scan := bufio.NewScanner(bytes.NewReader(buf))
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.LastIndexByte(line, ']')
+			if end < 0 {
+				return nil, ErrBadConfig
+			}
+			hdr := line[1:end]
+			if k := strings.IndexByte(hdr, ' '); k >= 0 {
+				// [section "subsection"]
+				sub := strings.TrimSpace(hdr[k+1:])
+				if len(sub) < 2 || sub[0] != '"' || sub[len(sub)-1] != '"' {
+					return nil, ErrBadConfig
+				}
+				sub = strings.Replace(sub[1:len(sub)-1], `\"`, `"`, -1)
+				sub = strings.Replace(sub, `\\`, `\`, -1)
+				section = strings.ToLower(hdr[:k]) + "." + sub
+			} else {
+				// [section] or the deprecated [section.subsection]
+				section = strings.ToLower(hdr)
+			}
+			continue
+		}
+		if section == "" {
+			return nil, ErrBadConfig
+		}
+		key, value := line, "true"
+		if k := strings.IndexByte(line, '='); k >= 0 {
+			key = strings.TrimSpace(line[:k])
+			value = parseConfigValue(line[k+1:])
+		}
+		name := section + "." + strings.ToLower(key)
+		c.vars[name] = append(c.vars[name], value)
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseConfigValue handles quoting, escapes and trailing comments
+func parseConfigValue(s string) string {
+	var out strings.Builder
+	quoted := false
+	s = strings.TrimSpace(s)
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == '"':
+			quoted = !quoted
+		case ch == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				out.WriteByte('\n')
+			case 't':
+				out.WriteByte('\t')
+			default:
+				out.WriteByte(s[i])
+			}
+		case (ch == '#' || ch == ';') && !quoted:
+			return strings.TrimSpace(out.String())
+		default:
+			out.WriteByte(ch)
+		}
+	}
+	return out.String()
+}
+
+// optional interface, for stores that have a config file
+type ConfigReader interface {
+	Config() (*Config, error)
+}
+
+// Config reads the repository's config file.  A missing file is
+// treated as empty
+func (g *GitDir) Config() (*Config, error) {
+	buf, err := ioutil.ReadFile(path.Join(g.Dir, "config"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ParseConfig(nil)
+		}
+		return nil, err
+	}
+	return ParseConfig(buf)
+}
+
+// Config returns the config of the first store that has one
+func (g *Git) Config() (*Config, error) {
+	for _, store := range g.storeList() {
+		if cr, ok := store.(ConfigReader); ok {
+			return cr.Config()
+		}
+	}
+	return ParseConfig(nil)
+}
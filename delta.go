@@ -134,3 +134,168 @@ func patchDelta(mode ObjType, base, delta []byte) ([]byte, *Ptr, error) {
 }
 
 var ErrUnexpectedDeltaOpcode = errors.New("unexpected delta opcode 0")
+
+// deltaBlock is the size of the chunks of a base that makeDelta
+// looks for in the target
+const deltaBlock = 16
+
+// maxDeltaCopy is the most a single copy instruction can copy
+const maxDeltaCopy = 0xffffff
+
+// deltaIndex finds where blocks of a delta base are, so that deltas
+// from it to many targets can be made without indexing it each time
+type deltaIndex struct {
+	base    []byte
+	buckets [][]int32
+	mask    uint32
+}
+
+// deltaHash hashes a block, in a way that can be rolled along a byte
+// at a time with deltaRoll
+func deltaHash(b []byte) uint32 {
+	var h uint32
+	for _, c := range b[:deltaBlock] {
+		h = h*31 + uint32(c)
+	}
+	return h
+}
+
+// deltaPow is 31 to the power of deltaBlock-1, to take the first
+// byte of a block out of its hash
+var deltaPow = func() uint32 {
+	p := uint32(1)
+	for i := 1; i < deltaBlock; i++ {
+		p *= 31
+	}
+	return p
+}()
+
+func deltaRoll(h uint32, out, in byte) uint32 {
+	return (h-uint32(out)*deltaPow)*31 + uint32(in)
+}
+
+func newDeltaIndex(base []byte) *deltaIndex {
+	n := uint32(16)
+	for int(n) < len(base)/deltaBlock {
+		n <<= 1
+	}
+	di := &deltaIndex{
+		base:    base,
+		buckets: make([][]int32, n),
+		mask:    n - 1,
+	}
+	for i := 0; i+deltaBlock <= len(base); i += deltaBlock {
+		b := &di.buckets[deltaHash(base[i:])&di.mask]
+		// very repetitive data would make for long, useless chains
+		if len(*b) < 64 {
+			*b = append(*b, int32(i))
+		}
+	}
+	return di
+}
+
+// makeDelta computes a delta that patchDelta can turn from the base
+// into the target.  If max is positive and the delta would be bigger
+// than that, it gives up and returns nil
+func (di *deltaIndex) makeDelta(target []byte, max int) []byte {
+	base := di.base
+	out := appendDeltaSize(nil, len(base))
+	out = appendDeltaSize(out, len(target))
+
+	insert := func(data []byte) {
+		for len(data) > 0 {
+			n := len(data)
+			if n > 127 {
+				n = 127
+			}
+			out = append(out, byte(n))
+			out = append(out, data[:n]...)
+			data = data[n:]
+		}
+	}
+
+	pending := 0 // start of the bytes not yet in the delta
+	i := 0
+	var h uint32
+	if len(target) >= deltaBlock {
+		h = deltaHash(target)
+	}
+	for i+deltaBlock <= len(target) {
+		bestAt, bestLen := 0, 0
+		for _, at := range di.buckets[h&di.mask] {
+			n := matchLen(base[at:], target[i:])
+			if n > bestLen {
+				bestAt, bestLen = int(at), n
+			}
+		}
+		if bestLen < deltaBlock {
+			if i+deltaBlock < len(target) {
+				h = deltaRoll(h, target[i], target[i+deltaBlock])
+			}
+			i++
+			continue
+		}
+		// the match may start before the block did
+		for i > pending && bestAt > 0 && bestLen < maxDeltaCopy &&
+			base[bestAt-1] == target[i-1] {
+			i--
+			bestAt--
+			bestLen++
+		}
+		insert(target[pending:i])
+		out = appendDeltaCopy(out, bestAt, bestLen)
+		i += bestLen
+		pending = i
+		if max > 0 && len(out) > max {
+			return nil
+		}
+		if i+deltaBlock <= len(target) {
+			h = deltaHash(target[i:])
+		}
+	}
+	insert(target[pending:])
+	if max > 0 && len(out) > max {
+		return nil
+	}
+	return out
+}
+
+func matchLen(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && n < maxDeltaCopy && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// appendDeltaSize appends a size as found in a delta's header, the
+// inverse of deltaHdrSize
+func appendDeltaSize(buf []byte, size int) []byte {
+	for size >= 0x80 {
+		buf = append(buf, byte(size)|0x80)
+		size >>= 7
+	}
+	return append(buf, byte(size))
+}
+
+// appendDeltaCopy appends an instruction to copy from the base,
+// leaving out the bytes of the offset and size that are zero
+func appendDeltaCopy(buf []byte, offset, size int) []byte {
+	at := len(buf)
+	cmd := byte(0x80)
+	buf = append(buf, 0)
+	for i := uint(0); i < 4; i++ {
+		if b := byte(offset >> (8 * i)); b != 0 {
+			cmd |= 1 << i
+			buf = append(buf, b)
+		}
+	}
+	for i := uint(0); i < 3; i++ {
+		if b := byte(size >> (8 * i)); b != 0 {
+			cmd |= 0x10 << i
+			buf = append(buf, b)
+		}
+	}
+	buf[at] = cmd
+	return buf
+}
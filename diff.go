@@ -0,0 +1,469 @@
+package git
+
+import (
+	"hash/fnv"
+	"path"
+	"sort"
+)
+
+type ChangeType int
+
+const (
+	Added = ChangeType(iota)
+	Deleted
+	Modified
+	TypeChanged // e.g., a file became a symlink
+	Renamed
+	Copied
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case Added:
+		return "A"
+	case Deleted:
+		return "D"
+	case Modified:
+		return "M"
+	case TypeChanged:
+		return "T"
+	case Renamed:
+		return "R"
+	case Copied:
+		return "C"
+	default:
+		return "?"
+	}
+}
+
+// A Change is one difference between two trees.  Old is nil for an
+// added entry, and New is nil for a deleted one.  Directories never
+// appear; their contents are compared instead
+type Change struct {
+	Type    ChangeType
+	OldPath string
+	NewPath string
+	Old     *Node
+	New     *Node
+	Score   int // similarity percentage, for renames and copies
+}
+
+// DiffOptions controls rename and copy detection in DiffTrees
+type DiffOptions struct {
+	DetectRenames bool
+	// DetectCopies also looks for added files that are copies of
+	// files that were modified or deleted in the same change
+	DetectCopies bool
+	// CopiesHarder considers every file in the old tree as a
+	// possible copy source, which is expensive
+	CopiesHarder bool
+	// Threshold is the minimum similarity percentage for a rename
+	// or copy; the default is 50, as in git
+	Threshold int
+	// RenameLimit caps the number of inexact rename candidates on
+	// either side; the default is 1000
+	RenameLimit int
+}
+
+const defaultRenameThreshold = 50
+const defaultRenameLimit = 1000
+
+// DiffTrees compares two trees, recursing only into subtrees that
+// differ.  Either tree may be nil, meaning an empty tree.  The
+// changes come out in tree order, with renames and copies (if
+// requested) in the position of the new file
+func DiffTrees(a, b *Tree, opts *DiffOptions) ([]*Change, error) {
+	var g *Git
+	if a != nil {
+		g = a.repo
+	} else if b != nil {
+		g = b.repo
+	} else {
+		return nil, nil
+	}
+
+	d := &treeDiffer{repo: g}
+	err := d.diff(a, b, "")
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil && (opts.DetectRenames || opts.DetectCopies) {
+		err = d.detectRenames(a, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d.changes, nil
+}
+
+type treeDiffer struct {
+	repo    *Git
+	changes []*Change
+}
+
+// subtree is like Tree.subtree, but reports errors instead of
+// panicking
+func (d *treeDiffer) subtree(n *Node) (*Tree, error) {
+	o, err := d.repo.load(&n.Ref)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := o.(*Tree)
+	if !ok {
+		return nil, ErrNotTree
+	}
+	return t, nil
+}
+
+func sortedNodes(t *Tree) []*Node {
+	if t == nil {
+		return nil
+	}
+	lst := t.Nodes()
+	sort.Slice(lst, func(i, j int) bool {
+		return treeLess(lst[i], lst[j])
+	})
+	return lst
+}
+
+func (d *treeDiffer) diff(a, b *Tree, dir string) error {
+	as, bs := sortedNodes(a), sortedNodes(b)
+	i, j := 0, 0
+	for i < len(as) || j < len(bs) {
+		var err error
+		switch {
+		case j >= len(bs):
+			err = d.removed(as[i], dir)
+			i++
+		case i >= len(as):
+			err = d.added(bs[j], dir)
+			j++
+		case as[i].Name == bs[j].Name:
+			err = d.both(as[i], bs[j], dir)
+			i++
+			j++
+		case treeLess(as[i], bs[j]):
+			err = d.removed(as[i], dir)
+			i++
+		default:
+			err = d.added(bs[j], dir)
+			j++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removed records the deletion of an entry, or everything in it
+func (d *treeDiffer) removed(n *Node, dir string) error {
+	p := path.Join(dir, n.Name)
+	if n.IsDir() {
+		t, err := d.subtree(n)
+		if err != nil {
+			return err
+		}
+		return d.diff(t, nil, p)
+	}
+	d.changes = append(d.changes, &Change{Type: Deleted, OldPath: p, Old: n})
+	return nil
+}
+
+// added records the addition of an entry, or everything in it
+func (d *treeDiffer) added(n *Node, dir string) error {
+	p := path.Join(dir, n.Name)
+	if n.IsDir() {
+		t, err := d.subtree(n)
+		if err != nil {
+			return err
+		}
+		return d.diff(nil, t, p)
+	}
+	d.changes = append(d.changes, &Change{Type: Added, NewPath: p, New: n})
+	return nil
+}
+
+// both compares two entries with the same name
+func (d *treeDiffer) both(x, y *Node, dir string) error {
+	p := path.Join(dir, x.Name)
+	switch {
+	case x.IsDir() && y.IsDir():
+		if x.Ref == y.Ref {
+			return nil
+		}
+		tx, err := d.subtree(x)
+		if err != nil {
+			return err
+		}
+		ty, err := d.subtree(y)
+		if err != nil {
+			return err
+		}
+		return d.diff(tx, ty, p)
+	case x.IsDir() || y.IsDir():
+		if err := d.removed(x, dir); err != nil {
+			return err
+		}
+		return d.added(y, dir)
+	}
+
+	if x.Ref == y.Ref && x.Perm == y.Perm {
+		return nil
+	}
+	t := Modified
+	if x.Perm&modeTypeMask != y.Perm&modeTypeMask {
+		t = TypeChanged
+	}
+	d.changes = append(d.changes, &Change{
+		Type:    t,
+		OldPath: p,
+		NewPath: p,
+		Old:     x,
+		New:     y,
+	})
+	return nil
+}
+
+// a candidate pairing of a source and destination for a rename or
+// copy
+type renamePair struct {
+	src   *Change
+	dst   *Change
+	score int
+}
+
+func (d *treeDiffer) detectRenames(a *Tree, opts *DiffOptions) error {
+	threshold := opts.Threshold
+	if threshold <= 0 {
+		threshold = defaultRenameThreshold
+	}
+	limit := opts.RenameLimit
+	if limit <= 0 {
+		limit = defaultRenameLimit
+	}
+
+	// deleted files can be renamed; with copy detection, modified
+	// (and perhaps unchanged) files can be copied
+	var srcs, dsts []*Change
+	for _, c := range d.changes {
+		switch c.Type {
+		case Deleted:
+			srcs = append(srcs, c)
+		case Modified:
+			if opts.DetectCopies {
+				srcs = append(srcs, c)
+			}
+		case Added:
+			dsts = append(dsts, c)
+		}
+	}
+	if opts.DetectCopies && opts.CopiesHarder && a != nil {
+		more, err := d.unchanged(a)
+		if err != nil {
+			return err
+		}
+		srcs = append(srcs, more...)
+	}
+
+	pairs, err := d.scorePairs(srcs, dsts, threshold, limit)
+	if err != nil {
+		return err
+	}
+	used := make(map[*Change]bool)
+	matched := make(map[*Change]*renamePair)
+	for _, rp := range pairs {
+		if matched[rp.dst] != nil {
+			continue
+		}
+		if used[rp.src] && !opts.DetectCopies {
+			// without copies, each file can only go one place
+			continue
+		}
+		used[rp.src] = true
+		matched[rp.dst] = rp
+	}
+
+	// rewrite the list, putting renames and copies where the new
+	// file was.  The first destination of a deleted file is a
+	// rename, and any others are copies
+	renamed := make(map[*Change]bool)
+	var out []*Change
+	for _, c := range d.changes {
+		if c.Type == Deleted && used[c] {
+			continue
+		}
+		rp := matched[c]
+		if rp == nil {
+			out = append(out, c)
+			continue
+		}
+		t := Copied
+		if rp.src.Type == Deleted && !renamed[rp.src] {
+			t = Renamed
+			renamed[rp.src] = true
+		}
+		out = append(out, &Change{
+			Type:    t,
+			OldPath: rp.src.OldPath,
+			NewPath: c.NewPath,
+			Old:     rp.src.Old,
+			New:     c.New,
+			Score:   rp.score,
+		})
+	}
+	d.changes = out
+	return nil
+}
+
+// unchanged lists all the files in the old tree that are not
+// already part of a change, as pseudo-changes that can be used as
+// copy sources
+func (d *treeDiffer) unchanged(a *Tree) ([]*Change, error) {
+	changed := make(map[string]bool)
+	for _, c := range d.changes {
+		if c.OldPath != "" {
+			changed[c.OldPath] = true
+		}
+	}
+	var lst []*Change
+	var walk func(t *Tree, dir string) error
+	walk = func(t *Tree, dir string) error {
+		for _, n := range sortedNodes(t) {
+			p := path.Join(dir, n.Name)
+			if n.IsDir() {
+				sub, err := d.subtree(n)
+				if err != nil {
+					return err
+				}
+				if err := walk(sub, p); err != nil {
+					return err
+				}
+			} else if !changed[p] {
+				lst = append(lst, &Change{Type: Modified, OldPath: p, Old: n})
+			}
+		}
+		return nil
+	}
+	return lst, walk(a, "")
+}
+
+// scorePairs finds all source/destination pairs at least as similar
+// as the threshold, best first.  Exact matches always count
+func (d *treeDiffer) scorePairs(srcs, dsts []*Change, threshold, limit int) ([]*renamePair, error) {
+	var pairs []*renamePair
+
+	inexact := len(srcs) <= limit && len(dsts) <= limit
+	sigs := make(map[Ptr]*similaritySig)
+	sig := func(n *Node) (*similaritySig, error) {
+		if s, ok := sigs[n.Ref]; ok {
+			return s, nil
+		}
+		o, err := d.repo.load(&n.Ref)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := o.(*Blob)
+		if !ok {
+			return nil, ErrNotBlob
+		}
+		s := newSimilaritySig(b.data)
+		sigs[n.Ref] = s
+		return s, nil
+	}
+
+	for _, dst := range dsts {
+		if dst.New.IsSubmodule() {
+			continue
+		}
+		for _, src := range srcs {
+			if src.Old.IsSubmodule() ||
+				src.Old.Perm&modeTypeMask != dst.New.Perm&modeTypeMask {
+				continue
+			}
+			if src.Old.Ref == dst.New.Ref {
+				pairs = append(pairs, &renamePair{src, dst, 100})
+				continue
+			}
+			if !inexact {
+				continue
+			}
+			ss, err := sig(src.Old)
+			if err != nil {
+				return nil, err
+			}
+			ds, err := sig(dst.New)
+			if err != nil {
+				return nil, err
+			}
+			score := ss.similarity(ds)
+			if score >= threshold {
+				pairs = append(pairs, &renamePair{src, dst, score})
+			}
+		}
+	}
+
+	sort.SliceStable(pairs, func(i, j int) bool {
+		if pairs[i].score != pairs[j].score {
+			return pairs[i].score > pairs[j].score
+		}
+		// prefer a source with the same basename
+		bi := path.Base(pairs[i].src.OldPath) == path.Base(pairs[i].dst.NewPath)
+		bj := path.Base(pairs[j].src.OldPath) == path.Base(pairs[j].dst.NewPath)
+		return bi && !bj
+	})
+	return pairs, nil
+}
+
+// similaritySig summarizes a blob for similarity scoring, in the
+// same spirit as git's: the content is cut into chunks at newlines
+// (or every 64 bytes), and we count how many bytes are in chunks
+// with each hash
+type similaritySig struct {
+	size   int
+	chunks map[uint32]int
+}
+
+func newSimilaritySig(data []byte) *similaritySig {
+	s := &similaritySig{
+		size:   len(data),
+		chunks: make(map[uint32]int),
+	}
+	start := 0
+	for i, ch := range data {
+		if ch == '\n' || i-start+1 == 64 {
+			h := fnv.New32a()
+			h.Write(data[start : i+1])
+			s.chunks[h.Sum32()] += i + 1 - start
+			start = i + 1
+		}
+	}
+	if start < len(data) {
+		h := fnv.New32a()
+		h.Write(data[start:])
+		s.chunks[h.Sum32()] += len(data) - start
+	}
+	return s
+}
+
+// similarity returns the percentage of the larger blob's bytes that
+// are in chunks common to both
+func (s *similaritySig) similarity(o *similaritySig) int {
+	max := s.size
+	if o.size > max {
+		max = o.size
+	}
+	if max == 0 {
+		return 100
+	}
+	common := 0
+	for h, n := range s.chunks {
+		if m, ok := o.chunks[h]; ok {
+			if m < n {
+				n = m
+			}
+			common += n
+		}
+	}
+	return common * 100 / max
+}
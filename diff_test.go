@@ -0,0 +1,114 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDiffTrees(t *testing.T) {
+	dir := t.TempDir()
+	initRepo(t, dir)
+	var long []string
+	for i := 0; i < 40; i++ {
+		long = append(long, fmt.Sprintf("this is line %d of a longer file", i))
+	}
+	body := strings.Join(long, "\n") + "\n"
+
+	writeFile(t, dir, "keep.txt", "unchanged\n")
+	writeFile(t, dir, "mod.txt", "before\n")
+	writeFile(t, dir, "gone.txt", "deleted\n")
+	writeFile(t, dir, "dir/a.txt", "a\n")
+	writeFile(t, dir, "dir/sub/b.txt", "b\n")
+	writeFile(t, dir, "exact.txt", "exactly the same\n")
+	writeFile(t, dir, "similar.txt", body)
+	writeFile(t, dir, "link", "target")
+	writeFile(t, dir, "becomes-dir", "file\n")
+	writeFile(t, dir, "src.txt", body+"tail\n")
+	gitCmd(t, dir, "", "add", ".")
+	gitCmd(t, dir, "", "commit", "-q", "-m", "one")
+
+	writeFile(t, dir, "mod.txt", "after\n")
+	os.Remove(filepath.Join(dir, "gone.txt"))
+	writeFile(t, dir, "dir/sub/b.txt", "b2\n")
+	writeFile(t, dir, "dir/new.txt", "new\n")
+	os.MkdirAll(filepath.Join(dir, "moved"), 0755)
+	os.Rename(filepath.Join(dir, "exact.txt"), filepath.Join(dir, "moved/exact.txt"))
+	os.Remove(filepath.Join(dir, "similar.txt"))
+	writeFile(t, dir, "renamed.txt", strings.Replace(body, "line 3 ", "LINE 3 ", 1))
+	os.Remove(filepath.Join(dir, "link"))
+	os.Symlink("target", filepath.Join(dir, "link"))
+	os.Remove(filepath.Join(dir, "becomes-dir"))
+	writeFile(t, dir, "becomes-dir/inside", "file\n")
+	writeFile(t, dir, "src.txt", body+"changed tail\n")
+	writeFile(t, dir, "copy.txt", body+"tail\n")
+	os.Chmod(filepath.Join(dir, "keep.txt"), 0755)
+	gitCmd(t, dir, "", "add", "-A")
+	gitCmd(t, dir, "", "commit", "-q", "-m", "two")
+
+	g, err := Open(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := g.peelToTree(mustRev(t, g, "HEAD~1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := g.peelToTree(mustRev(t, g, "HEAD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		flags []string
+		opts  *DiffOptions
+	}{
+		{nil, nil},
+		{[]string{"-M"}, &DiffOptions{DetectRenames: true}},
+		{[]string{"-M", "-C"}, &DiffOptions{DetectRenames: true, DetectCopies: true}},
+	}
+	for _, c := range cases {
+		changes, err := DiffTrees(a, b, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, ch := range changes {
+			switch ch.Type {
+			case Renamed, Copied:
+				got = append(got, fmt.Sprintf("%s %s %s", ch.Type, ch.OldPath, ch.NewPath))
+			case Added:
+				got = append(got, fmt.Sprintf("%s %s", ch.Type, ch.NewPath))
+			default:
+				got = append(got, fmt.Sprintf("%s %s", ch.Type, ch.OldPath))
+			}
+		}
+		sort.Strings(got)
+
+		args := append([]string{"diff-tree", "-r", "--name-status"}, c.flags...)
+		out := gitCmd(t, dir, "", append(args, "HEAD~1", "HEAD")...)
+		var want []string
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			f := strings.Split(line, "\t")
+			f[0] = f[0][:1] // drop the score
+			want = append(want, strings.Join(f, " "))
+		}
+		sort.Strings(want)
+
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%v: got\n%s\nexpected\n%s", c.flags,
+				strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+func mustRev(t *testing.T, g *Git, rev string) *Ptr {
+	p, err := g.ResolveRevision(rev)
+	if err != nil {
+		t.Fatalf("%s: %s", rev, err)
+	}
+	return p
+}
@@ -0,0 +1,719 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var ErrRemote = errors.New("remote error")
+var ErrNotSmartHTTP = errors.New("not a smart HTTP git server")
+var ErrRemoteExists = errors.New("remote origin already exists")
+
+// how many haves to send since the last one the server had in
+// common with us, before giving up and taking what it sends (the
+// same as git)
+const maxInVain = 256
+
+// A RemoteRef is a ref of a remote repository
+type RemoteRef struct {
+	Name   string
+	Ptr    Ptr
+	Peeled *Ptr   // what an annotated tag is of, if known
+	Target string // the ref a symbolic ref (such as HEAD) points to
+	Unborn bool   // Target has no commits yet
+}
+
+// FetchOptions controls Fetch and Clone
+type FetchOptions struct {
+	// Want selects the refs to fetch, by full name.  By default,
+	// that is every branch and tag
+	Want func(name string) bool
+	// Progress, if not nil, is sent the server's progress messages
+	Progress io.Writer
+	// ProtocolV0 keeps to protocol v0, rather than using v2 when
+	// the server can
+	ProtocolV0 bool
+	// Client makes the requests; by default, http.DefaultClient
+	Client *http.Client
+}
+
+func defaultWant(name string) bool {
+	return strings.HasPrefix(name, "refs/heads/") || strings.HasPrefix(name, "refs/tags/")
+}
+
+// Fetch gets what the repository needs for the refs of a remote
+// repository, over git's smart HTTP protocol, and stores it.  It
+// returns all of the remote's refs, leaving it to the caller to
+// update its own
+func (g *Git) Fetch(url string, opts *FetchOptions) ([]RemoteRef, error) {
+	if opts == nil {
+		opts = &FetchOptions{}
+	}
+	want := opts.Want
+	if want == nil {
+		want = defaultWant
+	}
+	rem := &httpRemote{
+		url:      strings.TrimSuffix(url, "/"),
+		client:   opts.Client,
+		progress: opts.Progress,
+	}
+	if rem.client == nil {
+		rem.client = http.DefaultClient
+	}
+	if err := rem.discover(!opts.ProtocolV0); err != nil {
+		return nil, err
+	}
+
+	var wants []Ptr
+	seen := make(map[Ptr]bool)
+	for _, ref := range rem.refs {
+		if ref.Unborn || !want(ref.Name) || seen[ref.Ptr] {
+			continue
+		}
+		seen[ref.Ptr] = true
+		if g.Get(&ref.Ptr) == nil {
+			wants = append(wants, ref.Ptr)
+		}
+	}
+	if len(wants) == 0 {
+		return rem.refs, nil
+	}
+	if err := rem.fetch(g, wants); err != nil {
+		return nil, err
+	}
+	return rem.refs, nil
+}
+
+// Clone creates a bare repository in dir (see Init), and fetches the
+// remote's refs into it, with the same names, as "git clone --mirror"
+// does.  HEAD is made to point at the same branch as the remote's,
+// and the remote is recorded as origin.  A repository that already
+// has an origin is refused
+func Clone(url, dir string, opts *FetchOptions) (*Git, error) {
+	var o FetchOptions
+	if opts != nil {
+		o = *opts
+	}
+	want := o.Want
+	if want == nil {
+		want = defaultWant
+	}
+	// a detached HEAD needs its commit
+	o.Want = func(name string) bool {
+		return name == "HEAD" || want(name)
+	}
+
+	g, err := Init(dir)
+	if err != nil {
+		return nil, err
+	}
+	gd := g.gitDir()
+	cfg, err := gd.Config()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Get("remote.origin.url") != "" {
+		return nil, ErrRemoteExists
+	}
+	refs, err := g.Fetch(url, &o)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		if ref.Name == "HEAD" {
+			if ref.Target != "" {
+				err = gd.WriteSymRef("HEAD", ref.Target)
+			} else {
+				err = gd.WriteRef("HEAD", ref.Ptr)
+			}
+		} else if want(ref.Name) {
+			err = gd.WriteRef(ref.Name, ref.Ptr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.OpenFile(path.Join(dir, "config"), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	// the refs are where a mirror's fetch would put them
+	_, err = fmt.Fprintf(f, "[remote \"origin\"]\n\turl = %s\n"+
+		"\tfetch = +refs/*:refs/*\n\tmirror = true\n", url)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// gitDir returns the first store that is a git directory, if any
+func (g *Git) gitDir() *GitDir {
+	for _, store := range g.storeList() {
+		if gd, ok := store.(*GitDir); ok {
+			return gd
+		}
+	}
+	return nil
+}
+
+// httpRemote is a conversation with a smart HTTP server
+type httpRemote struct {
+	url      string
+	client   *http.Client
+	progress io.Writer
+	version  int
+	caps     map[string]string // the server's capabilities, and any values
+	refs     []RemoteRef
+}
+
+// discover finds out the server's protocol version, capabilities
+// and refs
+func (rem *httpRemote) discover(v2 bool) error {
+	req, err := http.NewRequest("GET", rem.url+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		return err
+	}
+	if v2 {
+		req.Header.Set("Git-Protocol", "version=2")
+	}
+	resp, err := rem.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", ErrRemote, resp.Status)
+	}
+	if resp.Header.Get("Content-Type") != "application/x-git-upload-pack-advertisement" {
+		return ErrNotSmartHTTP
+	}
+
+	pr := newPktReader(resp.Body)
+	line, kind, err := pr.line()
+	if err != nil {
+		return err
+	}
+	if kind == pktData && line == "# service=git-upload-pack" {
+		if _, kind, err = pr.line(); err != nil {
+			return err
+		}
+		if kind != pktFlush {
+			return ErrProtocol
+		}
+		if line, kind, err = pr.line(); err != nil {
+			return err
+		}
+	}
+	if kind != pktData {
+		return ErrProtocol
+	}
+	rem.caps = make(map[string]string)
+	if line == "version 2" {
+		rem.version = 2
+		for {
+			line, kind, err := pr.line()
+			if err != nil {
+				return err
+			}
+			if kind == pktFlush {
+				break
+			}
+			rem.addCap(line)
+		}
+		return rem.lsRefs()
+	}
+	if line == "version 1" {
+		if line, kind, err = pr.line(); err != nil {
+			return err
+		}
+	}
+	for ; kind == pktData; line, kind, err = pr.line() {
+		if err != nil {
+			return err
+		}
+		if i := strings.IndexByte(line, 0); i >= 0 {
+			for _, c := range strings.Fields(line[i+1:]) {
+				rem.addCap(c)
+			}
+			line = line[:i]
+		}
+		p, ok := parseObjectLine(line, "")
+		if !ok || len(line) < 42 || line[40] != ' ' {
+			return fmt.Errorf("%w: bad ref line %q", ErrProtocol, line)
+		}
+		name := line[41:]
+		if name == "capabilities^{}" {
+			continue
+		}
+		if n := len(rem.refs); n > 0 && name == rem.refs[n-1].Name+"^{}" {
+			rem.refs[n-1].Peeled = &p
+			continue
+		}
+		rem.refs = append(rem.refs, RemoteRef{Name: name, Ptr: p})
+	}
+	if target, ok := rem.caps["symref"]; ok && strings.HasPrefix(target, "HEAD:") {
+		for i := range rem.refs {
+			if rem.refs[i].Name == "HEAD" {
+				rem.refs[i].Target = target[len("HEAD:"):]
+			}
+		}
+	}
+	return nil
+}
+
+// addCap records a capability, which may be "name" or "name=value";
+// only the first value of something like "symref" is kept
+func (rem *httpRemote) addCap(c string) {
+	name, value := c, ""
+	if i := strings.IndexByte(c, '='); i >= 0 {
+		name, value = c[:i], c[i+1:]
+	}
+	if _, ok := rem.caps[name]; !ok {
+		rem.caps[name] = value
+	}
+}
+
+func (rem *httpRemote) hasCap(name string) bool {
+	_, ok := rem.caps[name]
+	return ok
+}
+
+// post sends a request to upload-pack
+func (rem *httpRemote) post(body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", rem.url+"/git-upload-pack", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Accept", "application/x-git-upload-pack-result")
+	if rem.version == 2 {
+		req.Header.Set("Git-Protocol", "version=2")
+	}
+	resp, err := rem.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrRemote, resp.Status)
+	}
+	return resp, nil
+}
+
+// command starts a protocol v2 request
+func (rem *httpRemote) command(pw *pktWriter, name string) {
+	pw.printf("command=%s\n", name)
+	pw.printf("agent=%s\n", agentName)
+	if rem.hasCap("object-format") {
+		pw.printf("object-format=sha1\n")
+	}
+	pw.delim()
+}
+
+func (rem *httpRemote) lsRefs() error {
+	var buf bytes.Buffer
+	pw := &pktWriter{w: &buf}
+	rem.command(pw, "ls-refs")
+	pw.printf("symrefs\n")
+	pw.printf("peel\n")
+	if strings.Contains(" "+rem.caps["ls-refs"]+" ", " unborn ") {
+		pw.printf("unborn\n")
+	}
+	pw.flush()
+
+	resp, err := rem.post(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	pr := newPktReader(resp.Body)
+	for {
+		line, kind, err := pr.line()
+		if err != nil {
+			return err
+		}
+		if kind == pktFlush {
+			return nil
+		}
+		if strings.HasPrefix(line, "ERR ") {
+			return fmt.Errorf("%w: %s", ErrRemote, line[4:])
+		}
+		fields := strings.Split(line, " ")
+		if len(fields) < 2 {
+			return fmt.Errorf("%w: bad ref line %q", ErrProtocol, line)
+		}
+		ref := RemoteRef{Name: fields[1]}
+		if fields[0] == "unborn" {
+			ref.Unborn = true
+		} else if p, ok := ParsePtr(fields[0]); ok {
+			ref.Ptr = p
+		} else {
+			return fmt.Errorf("%w: bad ref line %q", ErrProtocol, line)
+		}
+		for _, attr := range fields[2:] {
+			switch {
+			case strings.HasPrefix(attr, "symref-target:"):
+				ref.Target = attr[len("symref-target:"):]
+			case strings.HasPrefix(attr, "peeled:"):
+				if p, ok := ParsePtr(attr[len("peeled:"):]); ok {
+					ref.Peeled = &p
+				}
+			}
+		}
+		rem.refs = append(rem.refs, ref)
+	}
+}
+
+// fetch negotiates with the server, a round at a time, then stores
+// the pack it sends
+func (rem *httpRemote) fetch(g *Git, wants []Ptr) error {
+	neg := newNegotiator(g)
+	batch := 16
+	inVain := 0
+	for {
+		haves := neg.next(batch)
+		done := len(haves) == 0 || inVain >= maxInVain
+		if batch < 1024 {
+			batch *= 2
+		}
+
+		var resp *http.Response
+		var pr *pktReader
+		var err error
+		var ready bool
+		if rem.version == 2 {
+			resp, pr, ready, err = rem.roundV2(neg, wants, haves, done)
+		} else {
+			resp, pr, ready, err = rem.roundV0(neg, wants, haves, done)
+		}
+		if err != nil {
+			return err
+		}
+		if done || ready {
+			err = rem.receivePack(g, pr)
+			resp.Body.Close()
+			return err
+		}
+		resp.Body.Close()
+		if neg.acked {
+			inVain = 0
+			neg.acked = false
+		} else {
+			inVain += len(haves)
+		}
+	}
+}
+
+// roundV0 sends one round of protocol v0 negotiation.  Over HTTP,
+// each request repeats the wants, and what we know we have in
+// common so far
+func (rem *httpRemote) roundV0(neg *negotiator, wants, haves []Ptr, done bool) (*http.Response, *pktReader, bool, error) {
+	caps := []string{"agent=" + agentName}
+	for _, c := range [][]string{
+		{"multi_ack_detailed", "multi_ack"},
+		{"side-band-64k", "side-band"},
+		{"ofs-delta"}, {"thin-pack"}, {"include-tag"},
+	} {
+		for _, alt := range c {
+			if rem.hasCap(alt) {
+				caps = append(caps, alt)
+				break
+			}
+		}
+	}
+	if rem.progress == nil && rem.hasCap("no-progress") {
+		caps = append(caps, "no-progress")
+	}
+
+	var buf bytes.Buffer
+	pw := &pktWriter{w: &buf}
+	for i := range wants {
+		if i == 0 {
+			pw.printf("want %s %s\n", &wants[i], strings.Join(caps, " "))
+		} else {
+			pw.printf("want %s\n", &wants[i])
+		}
+	}
+	pw.flush()
+	for _, p := range neg.commonList {
+		pw.printf("have %s\n", &p)
+	}
+	for i := range haves {
+		pw.printf("have %s\n", &haves[i])
+	}
+	if done {
+		pw.printf("done\n")
+	} else {
+		pw.flush()
+	}
+
+	resp, err := rem.post(buf.Bytes())
+	if err != nil {
+		return nil, nil, false, err
+	}
+	pr := newPktReader(resp.Body)
+	ready := false
+	for {
+		line, kind, err := pr.line()
+		if err == io.EOF && !done {
+			// after a common commit, there is no NAK without
+			// multi_ack
+			break
+		}
+		if err != nil {
+			resp.Body.Close()
+			return nil, nil, false, err
+		}
+		if kind != pktData {
+			continue
+		}
+		if line == "NAK" {
+			break
+		}
+		if strings.HasPrefix(line, "ERR ") {
+			resp.Body.Close()
+			return nil, nil, false, fmt.Errorf("%w: %s", ErrRemote, line[4:])
+		}
+		p, ok := parseObjectLine(line, "ACK ")
+		if !ok {
+			resp.Body.Close()
+			return nil, nil, false, fmt.Errorf("%w: unexpected %q", ErrProtocol, line)
+		}
+		neg.ack(p)
+		status := strings.TrimSpace(line[len("ACK ")+40:])
+		if status == "" {
+			// the last ACK, after which comes the pack
+			break
+		}
+		if status == "ready" {
+			ready = true
+		}
+	}
+	if ready && !done {
+		// the server is ready to send the pack, but only
+		// does so once we say we're done
+		resp.Body.Close()
+		resp, pr, _, err := rem.roundV0(neg, wants, nil, true)
+		return resp, pr, true, err
+	}
+	return resp, pr, false, nil
+}
+
+// roundV2 sends one round of protocol v2 negotiation; the result is
+// ready if the rest of the response is the pack
+func (rem *httpRemote) roundV2(neg *negotiator, wants, haves []Ptr, done bool) (*http.Response, *pktReader, bool, error) {
+	var buf bytes.Buffer
+	pw := &pktWriter{w: &buf}
+	rem.command(pw, "fetch")
+	pw.printf("thin-pack\n")
+	pw.printf("ofs-delta\n")
+	pw.printf("include-tag\n")
+	if rem.progress == nil {
+		pw.printf("no-progress\n")
+	}
+	for i := range wants {
+		pw.printf("want %s\n", &wants[i])
+	}
+	for _, p := range neg.commonList {
+		pw.printf("have %s\n", &p)
+	}
+	for i := range haves {
+		pw.printf("have %s\n", &haves[i])
+	}
+	if done {
+		pw.printf("done\n")
+	}
+	pw.flush()
+
+	resp, err := rem.post(buf.Bytes())
+	if err != nil {
+		return nil, nil, false, err
+	}
+	fail := func(err error) (*http.Response, *pktReader, bool, error) {
+		resp.Body.Close()
+		return nil, nil, false, err
+	}
+	pr := newPktReader(resp.Body)
+	// each section starts with its name, and ends with a delim,
+	// or a flush at the end of the response
+	for {
+		section, kind, err := pr.line()
+		if err != nil {
+			return fail(err)
+		}
+		if kind != pktData {
+			return fail(fmt.Errorf("%w: expected a section", ErrProtocol))
+		}
+		if strings.HasPrefix(section, "ERR ") {
+			return fail(fmt.Errorf("%w: %s", ErrRemote, section[4:]))
+		}
+		if section == "packfile" {
+			return resp, pr, true, nil
+		}
+		for {
+			line, kind, err := pr.line()
+			if err != nil {
+				return fail(err)
+			}
+			if kind == pktFlush {
+				// the end of a round of negotiation
+				return resp, pr, false, nil
+			}
+			if kind == pktDelim {
+				break
+			}
+			if section != "acknowledgments" {
+				continue
+			}
+			if p, ok := parseObjectLine(line, "ACK "); ok {
+				neg.ack(p)
+			}
+		}
+	}
+}
+
+// receivePack stores the pack at the end of a response, keeping it
+// as a pack if the repository is in a directory
+func (rem *httpRemote) receivePack(g *Git, pr *pktReader) error {
+	var r io.Reader = pr.r
+	if rem.version == 2 || rem.hasCap("side-band-64k") || rem.hasCap("side-band") {
+		r = &sidebandReader{pr: pr, progress: rem.progress}
+	}
+	if gd := g.gitDir(); gd != nil {
+		_, err := IndexPack(g, filepath.Join(gd.Dir, "objects", "pack"), r)
+		return err
+	}
+	_, err := g.UnpackObjects(r)
+	return err
+}
+
+// sidebandReader reads the data channel of a side-band stream,
+// passing on the progress messages
+type sidebandReader struct {
+	pr       *pktReader
+	progress io.Writer
+	buf      []byte
+}
+
+func (sr *sidebandReader) Read(buf []byte) (int, error) {
+	for len(sr.buf) == 0 {
+		data, kind, err := sr.pr.next()
+		if err != nil {
+			return 0, err
+		}
+		if kind != pktData {
+			return 0, io.EOF
+		}
+		if len(data) == 0 {
+			continue
+		}
+		switch data[0] {
+		case bandData:
+			sr.buf = data[1:]
+		case bandProgress:
+			if sr.progress != nil {
+				sr.progress.Write(data[1:])
+			}
+		case bandError:
+			return 0, fmt.Errorf("%w: %s", ErrRemote, strings.TrimSpace(string(data[1:])))
+		default:
+			return 0, fmt.Errorf("%w: bad side-band %d", ErrProtocol, data[0])
+		}
+	}
+	n := copy(buf, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
+
+// negotiator picks which of our commits to offer the server as
+// haves: newest first, from the tips of all our refs, leaving out
+// the history of anything the server says it has
+type negotiator struct {
+	repo       *Git
+	queue      commitQueue
+	seen       map[Ptr]bool
+	common     map[Ptr]bool
+	commonList []Ptr
+	acked      bool // something new was acknowledged
+}
+
+func newNegotiator(g *Git) *negotiator {
+	neg := &negotiator{
+		repo:   g,
+		seen:   make(map[Ptr]bool),
+		common: make(map[Ptr]bool),
+	}
+	var tips []Ptr
+	if head, err := g.Head(); err == nil && !head.Unborn {
+		tips = append(tips, head.Ptr)
+	}
+	for _, t := range []RefType{Head, Tag, Remote} {
+		lst, _ := g.enumNamed(t)
+		for _, nr := range lst {
+			tips = append(tips, nr.Ptr)
+		}
+	}
+	for i := range tips {
+		if c, err := g.peelToCommit(&tips[i]); err == nil {
+			neg.push(c)
+		}
+	}
+	return neg
+}
+
+func (neg *negotiator) push(c *Commit) {
+	if !neg.seen[c.name] {
+		neg.seen[c.name] = true
+		neg.queue.put(c)
+	}
+}
+
+// next returns up to n more haves
+func (neg *negotiator) next(n int) []Ptr {
+	var haves []Ptr
+	for len(haves) < n && neg.queue.Len() > 0 {
+		c := neg.queue.get()
+		if neg.common[c.name] {
+			// so are its parents, which need not be offered
+			for _, p := range c.Parents {
+				neg.common[p] = true
+			}
+			continue
+		}
+		haves = append(haves, c.name)
+		for i := range c.Parents {
+			// a missing parent means a shallow repository
+			if pc, err := neg.repo.loadCommitPtr(&c.Parents[i]); err == nil {
+				neg.push(pc)
+			}
+		}
+	}
+	return haves
+}
+
+func (neg *negotiator) ack(p Ptr) {
+	if neg.common[p] {
+		return
+	}
+	neg.acked = true
+	neg.commonList = append(neg.commonList, p)
+	neg.common[p] = true
+	// its parents are already queued, but need not be offered
+	if c, err := neg.repo.loadCommitPtr(&p); err == nil {
+		for _, parent := range c.Parents {
+			neg.common[parent] = true
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package git
+
+import (
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFetch(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	os.Mkdir(src, 0755)
+	initRepo(t, src)
+	var big []string
+	for i := 0; i < 200; i++ {
+		big = append(big, "line "+strconv.Itoa(i))
+	}
+	commit := func(msg string) {
+		gitCmd(t, src, "", "add", ".")
+		gitCmd(t, src, "", "commit", "-q", "-m", msg)
+	}
+	writeFile(t, src, "big", strings.Join(big, "\n"))
+	writeFile(t, src, "dir/a", "a\n")
+	commit("base")
+	gitCmd(t, src, "", "tag", "-a", "-m", "version one", "v1")
+	gitCmd(t, src, "", "branch", "other")
+	for i := 0; i < 3; i++ {
+		big[i*50] = "changed"
+		writeFile(t, src, "big", strings.Join(big, "\n"))
+		commit("change " + strconv.Itoa(i))
+	}
+	gitCmd(t, src, "", "gc", "-q")
+
+	backend := filepath.Join(strings.TrimSpace(gitCmd(t, dir, "", "--exec-path")), "git-http-backend")
+	servers := map[string]http.Handler{
+		"http-backend": &cgi.Handler{
+			Path: backend,
+			Env: []string{
+				"GIT_PROJECT_ROOT=" + dir,
+				"GIT_HTTP_EXPORT_ALL=1",
+				"GIT_CONFIG_NOSYSTEM=1",
+				"HOME=" + dir,
+			},
+		},
+	}
+	srcGit, err := Open(filepath.Join(src, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers["HTTPServer"] = NewHTTPServer(srcGit)
+
+	refs := func(repo string) string {
+		return gitCmd(t, repo, "", "for-each-ref", "--format=%(objectname) %(refname)",
+			"refs/heads", "refs/tags")
+	}
+	for name, h := range servers {
+		srv := httptest.NewServer(h)
+		url := srv.URL + "/src/.git"
+		for _, v0 := range []bool{false, true} {
+			what := name + " v2"
+			if v0 {
+				what = name + " v0"
+			}
+			clone := filepath.Join(dir, strings.Replace(what, " ", "-", -1))
+			g, err := Clone(url, clone, &FetchOptions{ProtocolV0: v0})
+			if err != nil {
+				t.Fatalf("%s: %s", what, err)
+			}
+			if got, want := refs(clone), refs(src); got != want {
+				t.Errorf("%s: got refs\n%s\nexpected\n%s", what, got, want)
+			}
+			gitCmd(t, clone, "", "fsck", "--strict")
+			head, err := g.Head()
+			if err != nil || head.Target != "refs/heads/main" {
+				t.Errorf("%s: HEAD is %v, %v", what, head, err)
+			}
+
+			// git can fetch from the remote Clone set up, which
+			// it only did once
+			gitCmd(t, clone, "", "fetch", "-q", "origin")
+			if got, want := refs(clone), refs(src); got != want {
+				t.Errorf("%s: git fetch changed refs to\n%s", what, got)
+			}
+			if _, err := Clone(url, clone, nil); err != ErrRemoteExists {
+				t.Errorf("%s: cloning again: %v", what, err)
+			}
+			remote := gitCmd(t, clone, "", "config", "--get-regexp", "^remote\\.")
+			if want := "remote.origin.url " + url + "\n" +
+				"remote.origin.fetch +refs/*:refs/*\n" +
+				"remote.origin.mirror true\n"; remote != want {
+				t.Errorf("%s: remote config is\n%s", what, remote)
+			}
+
+			// the other side has the base commit in common
+			other := mustRev(t, g, "other")
+			partial, err := Init(filepath.Join(clone + "-partial"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = partial.Fetch(url, &FetchOptions{
+				ProtocolV0: v0,
+				Want:       func(name string) bool { return name == "refs/heads/other" },
+			})
+			if err != nil {
+				t.Fatalf("%s: %s", what, err)
+			}
+			partial.gitDir().WriteRef("refs/heads/other", *other)
+			before := countObjects(t, clone+"-partial")
+			_, err = partial.Fetch(url, &FetchOptions{ProtocolV0: v0})
+			if err != nil {
+				t.Fatalf("%s: %s", what, err)
+			}
+			// three commits, with their trees and blobs; the tag
+			// came along with the base commit
+			if n := countObjects(t, clone+"-partial") - before; n != 9 {
+				t.Errorf("%s: fetched %d objects, expected 9", what, n)
+			}
+			if partial.Get(mustRev(t, g, "main")) == nil {
+				t.Errorf("%s: main was not fetched", what)
+			}
+		}
+		srv.Close()
+	}
+}
+
+// countObjects counts the objects in a git directory, whether
+// loose or packed (and however many packs they are in)
+func countObjects(t *testing.T, dir string) int {
+	out := gitCmd(t, dir, "", "cat-file", "--batch-all-objects", "--batch-check")
+	return strings.Count(out, "\n")
+}
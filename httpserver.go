@@ -0,0 +1,595 @@
+package git
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// what we call ourselves, in the "agent" capability
+const agentName = "dkolbly-git"
+
+// the capabilities advertised by upload-pack in protocol v0 and v1
+// (see checkWants for what can be asked for)
+const uploadPackCaps = "multi_ack multi_ack_detailed side-band side-band-64k " +
+	"ofs-delta include-tag no-progress allow-reachable-sha1-in-want " +
+	"object-format=sha1 agent=" + agentName
+
+var ErrProtocol = errors.New("git protocol error")
+
+// An HTTPServer serves a repository to git clients over the "smart"
+// HTTP protocol, for fetching (and so cloning) only.  It answers
+// ".../info/refs?service=git-upload-pack" and ".../git-upload-pack"
+// wherever it is mounted, in protocol v0, v1 or v2 as the client
+// asks
+type HTTPServer struct {
+	repo *Git
+}
+
+func NewHTTPServer(g *Git) *HTTPServer {
+	return &HTTPServer{repo: g}
+}
+
+func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/info/refs"):
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Query().Get("service") != "git-upload-pack" {
+			// the "dumb" protocol, or pushing
+			http.Error(w, "service not supported", http.StatusForbidden)
+			return
+		}
+		s.infoRefs(w, r)
+	case strings.HasSuffix(r.URL.Path, "/git-upload-pack"):
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/x-git-upload-pack-request" {
+			http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		s.uploadPack(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// protocolVersion returns the protocol version the client asked for
+// in the Git-Protocol header
+func protocolVersion(r *http.Request) int {
+	for _, param := range strings.Split(r.Header.Get("Git-Protocol"), ":") {
+		if param == "version=2" {
+			return 2
+		}
+	}
+	return 0
+}
+
+func noCache(w http.ResponseWriter) {
+	w.Header().Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+}
+
+func (s *HTTPServer) infoRefs(w http.ResponseWriter, r *http.Request) {
+	noCache(w)
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+	pw := &pktWriter{w: w}
+	if protocolVersion(r) == 2 {
+		pw.printf("version 2\n")
+		pw.printf("agent=%s\n", agentName)
+		pw.printf("ls-refs=unborn\n")
+		pw.printf("fetch\n")
+		pw.printf("server-option\n")
+		pw.printf("object-format=sha1\n")
+		pw.flush()
+		return
+	}
+
+	head, refs, err := s.refs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pw.printf("# service=git-upload-pack\n")
+	pw.flush()
+	caps := uploadPackCaps
+	if head != nil && !head.Detached() && !head.Unborn {
+		caps += " symref=HEAD:" + head.Target
+	}
+	if head != nil && !head.Unborn {
+		refs = append([]advertisedRef{{name: "HEAD", ptr: head.Ptr}}, refs...)
+	}
+	if len(refs) == 0 {
+		pw.printf("%s capabilities^{}\x00%s\n", &Ptr{}, caps)
+	}
+	for i, ref := range refs {
+		if i == 0 {
+			pw.printf("%s %s\x00%s\n", &ref.ptr, ref.name, caps)
+		} else {
+			pw.printf("%s %s\n", &ref.ptr, ref.name)
+		}
+		if ref.peeled != nil {
+			pw.printf("%s %s^{}\n", ref.peeled, ref.name)
+		}
+	}
+	pw.flush()
+}
+
+type advertisedRef struct {
+	name   string
+	ptr    Ptr
+	peeled *Ptr // what an annotated tag is of
+}
+
+// refs lists HEAD (nil if there isn't one), and the branches, tags
+// and remote-tracking branches in order of name
+func (s *HTTPServer) refs() (*ResolvedRef, []advertisedRef, error) {
+	g := s.repo
+	head, err := g.Head()
+	if err == ErrNoRef {
+		head = nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	seen := make(map[string]bool)
+	var refs []advertisedRef
+	for _, t := range []RefType{Head, Tag, Remote} {
+		lst, err := g.enumNamed(t)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, nr := range lst {
+			name := "refs/" + t.String() + "/" + nr.Name
+			if seen[name] {
+				// an earlier store has it
+				continue
+			}
+			seen[name] = true
+			ref := advertisedRef{name: name, ptr: nr.Ptr, peeled: nr.Peeled}
+			if t == Tag && ref.peeled == nil {
+				o, err := g.load(&nr.Ptr)
+				if err != nil {
+					return nil, nil, err
+				}
+				if o.Type() == ObjTag {
+					o, err = g.Peel(&nr.Ptr)
+					if err != nil {
+						return nil, nil, err
+					}
+					ref.peeled = o.Name()
+				}
+			}
+			refs = append(refs, ref)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].name < refs[j].name
+	})
+	return head, refs, nil
+}
+
+func (s *HTTPServer) uploadPack(w http.ResponseWriter, r *http.Request) {
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		z, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer z.Close()
+		body = z
+	}
+	noCache(w)
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	pr := newPktReader(body)
+	pw := &pktWriter{w: w}
+	var err error
+	if protocolVersion(r) == 2 {
+		err = s.serveV2(pr, pw)
+	} else {
+		err = s.serveV0(pr, pw)
+	}
+	if err != nil {
+		// by now the status has been sent, so all we can do is
+		// tell the client in the protocol
+		pw.err = nil
+		pw.printf("ERR %s\n", err)
+		log.Error("upload-pack: %s", err)
+	}
+}
+
+// fetchRequest is what the client asked for, in either protocol
+type fetchRequest struct {
+	wants      []Ptr
+	haves      []Ptr
+	done       bool
+	sideband   int // the largest side-band payload, or 0 for none
+	noProgress bool
+	includeTag bool
+	ofsDelta   bool
+}
+
+// parseObjectLine parses "want <hex>" or "have <hex>"
+func parseObjectLine(line, prefix string) (Ptr, bool) {
+	if !strings.HasPrefix(line, prefix) || len(line) < len(prefix)+40 {
+		return Ptr{}, false
+	}
+	return ParsePtr(line[len(prefix) : len(prefix)+40])
+}
+
+// serveV0 answers one request of a protocol v0 or v1 fetch which,
+// over HTTP, includes the wants and all of the haves so far
+func (s *HTTPServer) serveV0(pr *pktReader, pw *pktWriter) error {
+	req := &fetchRequest{}
+	multiAck := 0 // 1 for multi_ack, 2 for multi_ack_detailed
+	for first := true; ; first = false {
+		line, kind, err := pr.line()
+		if err != nil {
+			return err
+		}
+		if kind == pktFlush {
+			break
+		}
+		p, ok := parseObjectLine(line, "want ")
+		if !ok {
+			return fmt.Errorf("%w: expected want, got %q", ErrProtocol, line)
+		}
+		req.wants = append(req.wants, p)
+		if !first {
+			continue
+		}
+		for _, c := range strings.Fields(line[len("want ")+40:]) {
+			switch c {
+			case "multi_ack":
+				if multiAck == 0 {
+					multiAck = 1
+				}
+			case "multi_ack_detailed":
+				multiAck = 2
+			case "side-band":
+				if req.sideband == 0 {
+					req.sideband = 1000 - 5
+				}
+			case "side-band-64k":
+				req.sideband = maxPktLen - 5
+			case "no-progress":
+				req.noProgress = true
+			case "include-tag":
+				req.includeTag = true
+			case "ofs-delta":
+				req.ofsDelta = true
+			}
+		}
+	}
+	if err := s.checkWants(req.wants); err != nil {
+		return err
+	}
+
+	var last *Ptr
+	for {
+		line, kind, err := pr.line()
+		if err == io.EOF || kind == pktFlush {
+			// the end of a round of negotiation
+			if len(req.haves) == 0 || multiAck > 0 {
+				pw.printf("NAK\n")
+			}
+			return pw.err
+		}
+		if err != nil {
+			return err
+		}
+		if line == "done" {
+			break
+		}
+		p, ok := parseObjectLine(line, "have ")
+		if !ok {
+			return fmt.Errorf("%w: expected have, got %q", ErrProtocol, line)
+		}
+		if !s.isCommit(&p) {
+			continue
+		}
+		req.haves = append(req.haves, p)
+		last = &req.haves[len(req.haves)-1]
+		switch {
+		case multiAck == 2:
+			pw.printf("ACK %s common\n", last)
+		case multiAck == 1:
+			pw.printf("ACK %s continue\n", last)
+		case len(req.haves) == 1:
+			pw.printf("ACK %s\n", last)
+		}
+	}
+
+	if last == nil {
+		pw.printf("NAK\n")
+	} else if multiAck > 0 {
+		pw.printf("ACK %s\n", last)
+	}
+	if pw.err != nil {
+		return pw.err
+	}
+	return s.sendPack(pw, req, false)
+}
+
+// serveV2 answers one protocol v2 command
+func (s *HTTPServer) serveV2(pr *pktReader, pw *pktWriter) error {
+	line, kind, err := pr.line()
+	if err != nil {
+		return err
+	}
+	if kind != pktData || !strings.HasPrefix(line, "command=") {
+		return fmt.Errorf("%w: expected a command, got %q", ErrProtocol, line)
+	}
+	command := line[len("command="):]
+
+	// capabilities, which we have nothing to do with, then the
+	// arguments
+	var args []string
+	for inArgs := false; ; {
+		line, kind, err := pr.line()
+		if err != nil {
+			return err
+		}
+		if kind == pktFlush {
+			break
+		}
+		if kind == pktDelim {
+			inArgs = true
+			continue
+		}
+		if inArgs {
+			args = append(args, line)
+		}
+	}
+
+	switch command {
+	case "ls-refs":
+		return s.lsRefs(pw, args)
+	case "fetch":
+		return s.fetchV2(pw, args)
+	default:
+		return fmt.Errorf("%w: unknown command %q", ErrProtocol, command)
+	}
+}
+
+func (s *HTTPServer) lsRefs(pw *pktWriter, args []string) error {
+	var peel, symrefs, unborn bool
+	var prefixes []string
+	for _, arg := range args {
+		switch {
+		case arg == "peel":
+			peel = true
+		case arg == "symrefs":
+			symrefs = true
+		case arg == "unborn":
+			unborn = true
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, arg[len("ref-prefix "):])
+		default:
+			return fmt.Errorf("%w: unexpected ls-refs argument %q", ErrProtocol, arg)
+		}
+	}
+	wanted := func(name string) bool {
+		if len(prefixes) == 0 {
+			return true
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	head, refs, err := s.refs()
+	if err != nil {
+		return err
+	}
+	if head != nil && wanted("HEAD") {
+		var line string
+		if head.Unborn {
+			line = "unborn HEAD"
+		} else {
+			line = head.Ptr.String() + " HEAD"
+		}
+		if (symrefs || head.Unborn) && !head.Detached() {
+			line += " symref-target:" + head.Target
+		}
+		if !head.Unborn || unborn {
+			pw.printf("%s\n", line)
+		}
+	}
+	for _, ref := range refs {
+		if !wanted(ref.name) {
+			continue
+		}
+		line := ref.ptr.String() + " " + ref.name
+		if peel && ref.peeled != nil {
+			line += " peeled:" + ref.peeled.String()
+		}
+		pw.printf("%s\n", line)
+	}
+	return pw.flush()
+}
+
+func (s *HTTPServer) fetchV2(pw *pktWriter, args []string) error {
+	req := &fetchRequest{sideband: maxPktLen - 5}
+	for _, arg := range args {
+		if p, ok := parseObjectLine(arg, "want "); ok {
+			req.wants = append(req.wants, p)
+			continue
+		}
+		if p, ok := parseObjectLine(arg, "have "); ok {
+			if s.isCommit(&p) {
+				req.haves = append(req.haves, p)
+			}
+			continue
+		}
+		switch arg {
+		case "done":
+			req.done = true
+		case "no-progress":
+			req.noProgress = true
+		case "include-tag":
+			req.includeTag = true
+		case "ofs-delta":
+			req.ofsDelta = true
+		case "thin-pack":
+			// we never send thin packs anyway
+		default:
+			return fmt.Errorf("%w: unexpected fetch argument %q", ErrProtocol, arg)
+		}
+	}
+	if err := s.checkWants(req.wants); err != nil {
+		return err
+	}
+
+	if !req.done {
+		// we never say "ready", so the client carries on until
+		// it runs out of haves and says "done"
+		pw.printf("acknowledgments\n")
+		if len(req.haves) == 0 {
+			pw.printf("NAK\n")
+		}
+		for i := range req.haves {
+			pw.printf("ACK %s\n", &req.haves[i])
+		}
+		return pw.flush()
+	}
+	pw.printf("packfile\n")
+	if pw.err != nil {
+		return pw.err
+	}
+	return s.sendPack(pw, req, true)
+}
+
+// checkWants makes sure the client only asks for what we advertised,
+// or commits that can be reached from it, as git's upload-pack does
+// by default (without uploadpack.allowAnySHA1InWant)
+func (s *HTTPServer) checkWants(wants []Ptr) error {
+	if len(wants) == 0 {
+		return fmt.Errorf("%w: no wants", ErrProtocol)
+	}
+	head, refs, err := s.refs()
+	if err != nil {
+		return err
+	}
+	tips := make(map[Ptr]bool)
+	if head != nil && !head.Unborn {
+		tips[head.Ptr] = true
+	}
+	for _, ref := range refs {
+		tips[ref.ptr] = true
+		if ref.peeled != nil {
+			tips[*ref.peeled] = true
+		}
+	}
+
+	var others []Ptr
+	for i := range wants {
+		if tips[wants[i]] {
+			continue
+		}
+		if !s.isCommit(&wants[i]) {
+			return fmt.Errorf("upload-pack: not our ref %s", &wants[i])
+		}
+		others = append(others, wants[i])
+	}
+	if len(others) == 0 {
+		return nil
+	}
+
+	// anything other than the tips has to be in their history
+	var exclude []Ptr
+	for p := range tips {
+		p := p
+		if s.isCommit(&p) {
+			exclude = append(exclude, p)
+		}
+	}
+	walk := s.repo.RevList(&RevListOptions{Include: others, Exclude: exclude})
+	c, err := walk.Next()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return fmt.Errorf("upload-pack: not our ref %s", &c.name)
+}
+
+func (s *HTTPServer) isCommit(p *Ptr) bool {
+	_, err := s.repo.loadCommitPtr(p)
+	return err == nil
+}
+
+// sendPack sends the pack, on side-band channel 1 if there is one
+// (which there always is in protocol v2), followed by a flush
+func (s *HTTPServer) sendPack(pw *pktWriter, req *fetchRequest, v2 bool) error {
+	pack := NewPackWriter(s.repo)
+	pack.RefDeltas = !req.ofsDelta
+	if err := s.repo.objectsToPack(pack, req.wants, req.haves); err != nil {
+		return err
+	}
+	if req.includeTag {
+		if err := s.includeTags(pack); err != nil {
+			return err
+		}
+	}
+
+	if req.sideband == 0 {
+		_, err := pack.WritePack(pw.w)
+		return err
+	}
+	if !req.noProgress {
+		progress := &sidebandWriter{pw: pw, band: bandProgress, max: req.sideband}
+		fmt.Fprintf(progress, "Enumerating objects: %d, done.\n", pack.Len())
+	}
+	data := &sidebandWriter{pw: pw, band: bandData, max: req.sideband}
+	if _, err := pack.WritePack(data); err != nil {
+		if pw.err == nil {
+			errs := &sidebandWriter{pw: pw, band: bandError, max: req.sideband}
+			fmt.Fprintf(errs, "upload-pack: %s\n", err)
+			pw.flush()
+		}
+		return nil
+	}
+	return pw.flush()
+}
+
+// includeTags adds the annotated tags of anything being sent
+func (s *HTTPServer) includeTags(pack *PackWriter) error {
+	_, refs, err := s.refs()
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if ref.peeled == nil || pack.Has(ref.ptr) || !pack.Has(*ref.peeled) {
+			continue
+		}
+		// the tag, and any tags between it and what it's of
+		p := ref.ptr
+		for !pack.Has(p) {
+			o, err := s.repo.load(&p)
+			if err != nil {
+				return err
+			}
+			tag, ok := o.(*AnnotatedTag)
+			if !ok {
+				break
+			}
+			pack.Add(p, "")
+			p = tag.Object
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package git
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHTTPServer(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	os.Mkdir(src, 0755)
+	initRepo(t, src)
+	writeFile(t, src, "README", "hello\n")
+	writeFile(t, src, "dir/a", "a\n")
+	gitCmd(t, src, "", "add", ".")
+	gitCmd(t, src, "", "commit", "-q", "-m", "base")
+	gitCmd(t, src, "", "tag", "-a", "-m", "version one", "v1")
+	gitCmd(t, src, "", "tag", "light")
+	gitCmd(t, src, "", "branch", "other")
+	writeFile(t, src, "dir/b", "b\n")
+	gitCmd(t, src, "", "add", ".")
+	gitCmd(t, src, "", "commit", "-q", "-m", "second")
+	// packed objects and refs too
+	gitCmd(t, src, "", "gc", "-q")
+	writeFile(t, src, "dir/c", "c\n")
+	gitCmd(t, src, "", "add", ".")
+	gitCmd(t, src, "", "commit", "-q", "-m", "third")
+
+	// the handler is swapped out when the repository is reopened,
+	// which has to be safe from the server's goroutines
+	var lock sync.Mutex
+	var handler http.Handler
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		h := handler
+		lock.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	reopen := func() {
+		g, err := Open(filepath.Join(src, ".git"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lock.Lock()
+		handler = NewHTTPServer(g)
+		lock.Unlock()
+	}
+	reopen()
+
+	refs := func(repo string) string {
+		return gitCmd(t, repo, "", "for-each-ref", "--format=%(objectname) %(refname)")
+	}
+	for _, version := range []string{"0", "1", "2"} {
+		clone := filepath.Join(dir, "clone"+version)
+		gitCmd(t, dir, "", "-c", "protocol.version="+version,
+			"clone", "-q", "--mirror", srv.URL+"/src.git", clone)
+		if got, want := refs(clone), refs(src); got != want {
+			t.Errorf("v%s clone: got refs\n%s\nexpected\n%s", version, got, want)
+		}
+		gitCmd(t, clone, "", "fsck", "--strict")
+		head := gitCmd(t, clone, "", "symbolic-ref", "HEAD")
+		if head != "refs/heads/main\n" {
+			t.Errorf("v%s clone: HEAD is %q", version, head)
+		}
+	}
+
+	// fetching only sends what's new; small fetches are unpacked
+	// into loose objects, so those can be counted
+	loose := func(repo string) int {
+		out := gitCmd(t, repo, "", "count-objects")
+		n, _ := strconv.Atoi(strings.Fields(out)[0])
+		return n
+	}
+	writeFile(t, src, "dir/d", "d\n")
+	gitCmd(t, src, "", "add", ".")
+	gitCmd(t, src, "", "commit", "-q", "-m", "fourth")
+	gitCmd(t, src, "", "tag", "-a", "-m", "version two", "v2")
+	reopen()
+	for _, version := range []string{"0", "2"} {
+		clone := filepath.Join(dir, "clone"+version)
+		before := loose(clone)
+		gitCmd(t, clone, "", "-c", "protocol.version="+version, "fetch", "-q", "origin")
+		if got, want := refs(clone), refs(src); got != want {
+			t.Errorf("v%s fetch: got refs\n%s\nexpected\n%s", version, got, want)
+		}
+		gitCmd(t, clone, "", "fsck", "--strict")
+		// a commit, two trees, a blob and a tag
+		if n := loose(clone) - before; n != 5 {
+			t.Errorf("v%s fetch: got %d objects, expected 5", version, n)
+		}
+	}
+
+	// commits in the history of a ref can be fetched by name, but
+	// not ones that aren't
+	old := strings.TrimSpace(gitCmd(t, src, "", "rev-parse", "HEAD~2"))
+	dangling := strings.TrimSpace(gitCmd(t, src, "", "commit-tree", "-m", "dangling", "HEAD^{tree}"))
+	for _, version := range []string{"0", "2"} {
+		fetcher := filepath.Join(dir, "fetcher"+version)
+		os.Mkdir(fetcher, 0755)
+		gitCmd(t, fetcher, "", "init", "-q")
+		gitCmd(t, fetcher, "", "-c", "protocol.version="+version,
+			"fetch", "-q", srv.URL+"/src.git", old)
+		cmd := exec.Command("git", "-c", "protocol.version="+version,
+			"fetch", "-q", srv.URL+"/src.git", dangling)
+		cmd.Dir = fetcher
+		if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "not our ref") {
+			t.Errorf("v%s: fetched an unreachable commit: %v\n%s", version, err, out)
+		}
+	}
+
+	sorted := func(s string) string {
+		lines := strings.Split(strings.Replace(s, "\t", " ", -1), "\n")
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+	}
+	got := sorted(gitCmd(t, dir, "", "ls-remote", srv.URL+"/src.git"))
+	want := sorted(gitCmd(t, src, "", "show-ref", "--head", "-d"))
+	if got != want {
+		t.Errorf("ls-remote: got\n%s\nexpected\n%s", got, want)
+	}
+}
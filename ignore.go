@@ -0,0 +1,187 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// An IgnoreMatcher decides which paths are ignored, following the
+// rules of .gitignore files.  Paths are relative to the top of the
+// work tree, and separated by '/'
+type IgnoreMatcher struct {
+	patterns []*ignorePattern // in increasing order of precedence
+}
+
+type ignorePattern struct {
+	base     string   // the directory the pattern came from
+	segs     []string // the pattern, split at '/'
+	negate   bool
+	dirOnly  bool
+	anchored bool // matches the whole path, not just the last part
+}
+
+func NewIgnoreMatcher() *IgnoreMatcher {
+	return &IgnoreMatcher{}
+}
+
+// AddPatterns adds the patterns from a .gitignore file in the given
+// directory ("" for the top).  Patterns added later take precedence,
+// so files should be added from the least specific (info/exclude)
+// to the most (the deepest .gitignore)
+func (m *IgnoreMatcher) AddPatterns(dir string, data []byte) {
+	for _, line := range strings.Split(string(data), "\n") {
+		if p := parseIgnoreLine(dir, line); p != nil {
+			m.patterns = append(m.patterns, p)
+		}
+	}
+}
+
+// AddFile adds the patterns from a file, if it exists
+func (m *IgnoreMatcher) AddFile(dir, file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	m.AddPatterns(dir, data)
+	return nil
+}
+
+func parseIgnoreLine(dir, line string) *ignorePattern {
+	line = strings.TrimSuffix(line, "\r")
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+	// trailing spaces are ignored, unless quoted with a backslash
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	p := &ignorePattern{base: dir}
+	if line[0] == '!' {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return nil
+	}
+	// path.Match spells a negated character class "[^...]"
+	line = strings.Replace(line, "[!", "[^", -1)
+	p.segs = strings.Split(line, "/")
+	return p
+}
+
+// Match returns true if the path is ignored.  Note that this only
+// looks at the path itself: anything in an ignored directory is also
+// ignored, which is up to the caller to notice
+func (m *IgnoreMatcher) Match(p string, isDir bool) bool {
+	ignored, _ := m.lookup(p, isDir)
+	return ignored
+}
+
+// lookup is like Match, but also says whether any pattern matched
+func (m *IgnoreMatcher) lookup(p string, isDir bool) (bool, bool) {
+	for i := len(m.patterns) - 1; i >= 0; i-- {
+		pat := m.patterns[i]
+		if pat.matches(p, isDir) {
+			return !pat.negate, true
+		}
+	}
+	return false, false
+}
+
+func (pat *ignorePattern) matches(p string, isDir bool) bool {
+	if pat.dirOnly && !isDir {
+		return false
+	}
+	rel := p
+	if pat.base != "" {
+		if !strings.HasPrefix(p, pat.base+"/") {
+			return false
+		}
+		rel = p[len(pat.base)+1:]
+	}
+	if !pat.anchored {
+		ok, _ := path.Match(pat.segs[0], path.Base(rel))
+		return ok
+	}
+	return matchSegments(pat.segs, strings.Split(rel, "/"))
+}
+
+// matchSegments matches a path against a pattern a segment at a
+// time, so that "**" can match any number of directories
+func matchSegments(segs, parts []string) bool {
+	if len(segs) == 0 {
+		return len(parts) == 0
+	}
+	if segs[0] == "**" {
+		if len(segs) == 1 {
+			// a trailing "/**" matches everything inside
+			return len(parts) > 0
+		}
+		for i := 0; i <= len(parts); i++ {
+			if matchSegments(segs[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	ok, _ := path.Match(segs[0], parts[0])
+	return ok && matchSegments(segs[1:], parts[1:])
+}
+
+// ignoreMatcher returns a matcher with the repository-wide exclude
+// files: core.excludesFile (or the default ~/.config/git/ignore),
+// then info/exclude.  The .gitignore files in the work tree are up
+// to the caller to add, as it goes
+func (g *Git) ignoreMatcher() (*IgnoreMatcher, error) {
+	m := NewIgnoreMatcher()
+	cfg, err := g.Config()
+	if err != nil {
+		return nil, err
+	}
+	global := cfg.Get("core.excludesfile")
+	if strings.HasPrefix(global, "~/") {
+		home, _ := os.UserHomeDir()
+		global = filepath.Join(home, global[2:])
+	}
+	if global == "" {
+		if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+			global = filepath.Join(xdg, "git", "ignore")
+		} else if home, err := os.UserHomeDir(); err == nil {
+			global = filepath.Join(home, ".config", "git", "ignore")
+		}
+	}
+	if global != "" {
+		if err := m.AddFile("", global); err != nil {
+			return nil, err
+		}
+	}
+	for _, store := range g.storeList() {
+		if gd, ok := store.(*GitDir); ok {
+			err := m.AddFile("", filepath.Join(gd.Dir, "info", "exclude"))
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return m, nil
+}
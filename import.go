@@ -0,0 +1,125 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// ImportOptions controls ImportDir
+type ImportOptions struct {
+	// Gitignore leaves out anything ignored by the .gitignore files
+	// in the directory being imported
+	Gitignore bool
+	// Ignore, if not nil, supplies other patterns to leave out, such
+	// as a repository's info/exclude; it is not modified
+	Ignore *IgnoreMatcher
+}
+
+// ImportDir stores the contents of a directory as blobs and trees,
+// like "git add -A && git write-tree" would, and returns the root
+// tree.  Executable bits and symlinks are kept; ".git" and anything
+// that isn't a regular file, symlink or directory are left out, as
+// are directories with nothing in them.  Objects that the repository
+// already has are not written again
+func (g *Git) ImportDir(dir string, opts *ImportOptions) (Ptr, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	im := &importer{repo: g, top: dir, gitignore: opts.Gitignore}
+	if opts.Gitignore || opts.Ignore != nil {
+		im.ignore = NewIgnoreMatcher()
+		if opts.Ignore != nil {
+			im.ignore.patterns = append(im.ignore.patterns, opts.Ignore.patterns...)
+		}
+	}
+	p, _, err := im.importDir("")
+	if err != nil {
+		return Ptr{}, err
+	}
+	return p, nil
+}
+
+type importer struct {
+	repo      *Git
+	top       string
+	gitignore bool
+	ignore    *IgnoreMatcher
+}
+
+// put stores an object unless we already have it
+func (im *importer) put(t ObjType, data []byte) (Ptr, error) {
+	p := HashObject(t, data)
+	if im.repo.Get(&p) != nil {
+		return p, nil
+	}
+	return im.repo.Put(t, data)
+}
+
+// importDir stores the tree for a directory, returning false if
+// there was nothing in it.  The root tree is stored even if it's
+// empty
+func (im *importer) importDir(rel string) (Ptr, bool, error) {
+	full := filepath.Join(im.top, filepath.FromSlash(rel))
+	if im.gitignore {
+		err := im.ignore.AddFile(rel, filepath.Join(full, ".gitignore"))
+		if err != nil {
+			return Ptr{}, false, err
+		}
+	}
+	lst, err := ioutil.ReadDir(full)
+	if err != nil {
+		return Ptr{}, false, err
+	}
+
+	var nodes []*Node
+	for _, fi := range lst {
+		if fi.Name() == ".git" {
+			continue
+		}
+		p := path.Join(rel, fi.Name())
+		if im.ignore != nil && im.ignore.Match(p, fi.IsDir()) {
+			continue
+		}
+		mode := worktreeMode(fi)
+		var ref Ptr
+		switch {
+		case fi.IsDir():
+			sub, ok, err := im.importDir(p)
+			if err != nil {
+				return Ptr{}, false, err
+			}
+			if !ok {
+				continue
+			}
+			ref = sub
+		case fi.Mode().IsRegular() || fi.Mode()&os.ModeSymlink != 0:
+			data, err := readWorktreeFile(filepath.Join(full, fi.Name()), fi)
+			if err != nil {
+				return Ptr{}, false, err
+			}
+			ref, err = im.put(ObjBlob, data)
+			if err != nil {
+				return Ptr{}, false, err
+			}
+		default:
+			// devices, sockets and the like
+			continue
+		}
+		nodes = append(nodes, &Node{Name: fi.Name(), Perm: mode, Ref: ref})
+	}
+
+	if len(nodes) == 0 && rel != "" {
+		return Ptr{}, false, nil
+	}
+	buf, err := EncodeTree(nodes)
+	if err != nil {
+		return Ptr{}, false, err
+	}
+	p, err := im.put(ObjTree, buf)
+	if err != nil {
+		return Ptr{}, false, err
+	}
+	return p, true, nil
+}
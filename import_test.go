@@ -0,0 +1,67 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportDir(t *testing.T) {
+	dir := t.TempDir()
+	initRepo(t, dir)
+	writeFile(t, dir, ".gitignore", "*.tmp\ncache/\n")
+	writeFile(t, dir, "README", "hello\n")
+	writeFile(t, dir, "bin/tool", "#!/bin/sh\n")
+	os.Chmod(filepath.Join(dir, "bin/tool"), 0755)
+	os.Symlink("bin/tool", filepath.Join(dir, "tool"))
+	writeFile(t, dir, "out/a.o", "object\n")
+	writeFile(t, dir, "out/scratch.tmp", "ignored\n")
+	writeFile(t, dir, "out/.gitignore", "!keep.tmp\n")
+	writeFile(t, dir, "out/keep.tmp", "kept\n")
+	writeFile(t, dir, "cache/data", "ignored\n")
+	os.MkdirAll(filepath.Join(dir, "empty/nested"), 0755)
+
+	g, err := Open(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := g.ImportDir(dir, &ImportOptions{Gitignore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitCmd(t, dir, "", "add", "-A")
+	expect := strings.TrimSpace(gitCmd(t, dir, "", "write-tree"))
+	if p.String() != expect {
+		t.Errorf("with .gitignore: expected %s, got %s", expect, p.String())
+	}
+
+	p, err = g.ImportDir(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitCmd(t, dir, "", "add", "-A", "-f")
+	expect = strings.TrimSpace(gitCmd(t, dir, "", "write-tree"))
+	if p.String() != expect {
+		t.Errorf("without .gitignore: expected %s, got %s", expect, p.String())
+	}
+
+	// extra patterns
+	extra := NewIgnoreMatcher()
+	extra.AddPatterns("", []byte("out/\n"))
+	p, err = g.ImportDir(dir, &ImportOptions{Gitignore: true, Ignore: extra})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := g.peelToTree(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Walk("out") != nil || tree.Walk("README") == nil || tree.Walk("empty") != nil {
+		t.Errorf("unexpected tree contents %q", tree.Listing())
+	}
+	if len(extra.patterns) != 1 {
+		t.Errorf("the extra patterns were modified")
+	}
+}
@@ -0,0 +1,1032 @@
+package git
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrBadIndex = errors.New("invalid index file")
+var ErrIndexVersion = errors.New("unsupported index version")
+var ErrIndexChecksum = errors.New("index checksum mismatch")
+var ErrIndexExtension = errors.New("unsupported required index extension")
+var ErrUnmerged = errors.New("index has unmerged entries")
+
+// StatData is the file system information the index keeps about a
+// file, so that it can tell whether the file might have changed
+// without reading it
+type StatData struct {
+	CTime time.Time
+	MTime time.Time
+	Dev   uint32
+	Ino   uint32
+	UID   uint32
+	GID   uint32
+	Size  uint32 // truncated to 32 bits
+}
+
+// An IndexEntry is a file in the index
+type IndexEntry struct {
+	StatData
+	Path  string
+	Mode  uint // as in a tree entry, e.g. ModeFile
+	Ptr   Ptr
+	Stage int // 0, or 1-3 (base, ours, theirs) for an unmerged path
+	// AssumeValid means the file is not to be checked for changes
+	AssumeValid bool
+	// SkipWorktree and IntentToAdd require index version 3 or later
+	SkipWorktree bool
+	IntentToAdd  bool
+}
+
+func (e *IndexEntry) extended() bool {
+	return e.SkipWorktree || e.IntentToAdd
+}
+
+// A CacheTree records the tree objects for directories in the index
+// (the TREE extension).  EntryCount is the number of index entries
+// covered, or -1 if the directory has changed since its tree was
+// written
+type CacheTree struct {
+	Name       string // path component; "" for the root
+	EntryCount int
+	Ptr        Ptr
+	Subtrees   []*CacheTree
+}
+
+// ResolveUndo records the unmerged stages of a path that has since
+// been resolved (the REUC extension), so the conflict can be
+// recreated.  A zero mode means the stage was missing
+type ResolveUndo struct {
+	Path  string
+	Modes [3]uint
+	Ptrs  [3]Ptr
+}
+
+// UntrackedCache is the untracked cache (the UNTR extension), which
+// remembers the untracked files in each directory along with enough
+// information to tell when that might have changed
+type UntrackedCache struct {
+	// Ident describes the environment the cache is valid in, as a
+	// sequence of NUL-terminated strings
+	Ident         string
+	InfoExclude   UntrackedStat // $GIT_DIR/info/exclude
+	ExcludesFile  UntrackedStat // core.excludesFile
+	DirFlags      uint32
+	ExcludePerDir string // usually ".gitignore"
+	Root          *UntrackedDir
+}
+
+// UntrackedStat is the stat data and content hash of an exclude file.
+// A zero Ptr means the file does not exist
+type UntrackedStat struct {
+	StatData
+	Ptr Ptr
+}
+
+type UntrackedDir struct {
+	Name      string
+	Untracked []string
+	Dirs      []*UntrackedDir
+	Valid     bool
+	CheckOnly bool
+	// Exclude is the state of the directory's per-directory exclude
+	// file, if known
+	Exclude *UntrackedStat
+}
+
+// Index is the contents of the index (or "staging area") file
+type Index struct {
+	Version   int // 2, 3 or 4
+	Entries   []*IndexEntry
+	Cache     *CacheTree
+	Resolve   []*ResolveUndo
+	Untracked *UntrackedCache
+
+	// when the index file was last written, if it was read from
+	// one; files modified since then can't be trusted to be
+	// unchanged just because their stat data matches
+	mtime time.Time
+}
+
+// NewIndex returns an empty index
+func NewIndex() *Index {
+	return &Index{Version: 2}
+}
+
+func indexLess(a, b *IndexEntry) bool {
+	if a.Path != b.Path {
+		return a.Path < b.Path
+	}
+	return a.Stage < b.Stage
+}
+
+// find returns the position of the entry with the given path and
+// stage, or where it would go
+func (idx *Index) find(p string, stage int) (int, bool) {
+	key := &IndexEntry{Path: p, Stage: stage}
+	k := sort.Search(len(idx.Entries), func(i int) bool {
+		return !indexLess(idx.Entries[i], key)
+	})
+	found := k < len(idx.Entries) &&
+		idx.Entries[k].Path == p && idx.Entries[k].Stage == stage
+	return k, found
+}
+
+// Entry returns the (stage 0) entry for a path, or nil
+func (idx *Index) Entry(p string) *IndexEntry {
+	k, ok := idx.find(p, 0)
+	if !ok {
+		return nil
+	}
+	return idx.Entries[k]
+}
+
+// Stages returns all the entries for a path, which is more than one
+// if it is unmerged
+func (idx *Index) Stages(p string) []*IndexEntry {
+	k, _ := idx.find(p, 0)
+	var lst []*IndexEntry
+	for ; k < len(idx.Entries) && idx.Entries[k].Path == p; k++ {
+		lst = append(lst, idx.Entries[k])
+	}
+	return lst
+}
+
+// Unmerged returns true if any path has entries in stages 1-3
+func (idx *Index) Unmerged() bool {
+	for _, e := range idx.Entries {
+		if e.Stage != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Add puts an entry in the index, replacing any entry with the same
+// path and stage
+func (idx *Index) Add(e *IndexEntry) {
+	k, found := idx.find(e.Path, e.Stage)
+	if found {
+		idx.Entries[k] = e
+	} else {
+		idx.Entries = append(idx.Entries, nil)
+		copy(idx.Entries[k+1:], idx.Entries[k:])
+		idx.Entries[k] = e
+	}
+	idx.invalidate(e.Path)
+}
+
+// Remove removes all the entries for a path, returning true if there
+// were any
+func (idx *Index) Remove(p string) bool {
+	k, _ := idx.find(p, 0)
+	n := k
+	for n < len(idx.Entries) && idx.Entries[n].Path == p {
+		n++
+	}
+	if n == k {
+		return false
+	}
+	idx.Entries = append(idx.Entries[:k], idx.Entries[n:]...)
+	idx.invalidate(p)
+	return true
+}
+
+// invalidate marks the cached trees containing a path as out of date
+func (idx *Index) invalidate(p string) {
+	ct := idx.Cache
+	if ct == nil {
+		return
+	}
+	ct.EntryCount = -1
+	dirs := strings.Split(p, "/")
+	for _, dir := range dirs[:len(dirs)-1] {
+		var next *CacheTree
+		for _, sub := range ct.Subtrees {
+			if sub.Name == dir {
+				next = sub
+				break
+			}
+		}
+		if next == nil {
+			return
+		}
+		next.EntryCount = -1
+		ct = next
+	}
+}
+
+// ReadIndex reads the index file of the repository; a missing index
+// is the same as an empty one
+func (g *GitDir) ReadIndex() (*Index, error) {
+	file := path.Join(g.Dir, "index")
+	fi, err := os.Stat(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NewIndex(), nil
+		}
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := ParseIndex(buf)
+	if err != nil {
+		return nil, err
+	}
+	idx.mtime = fi.ModTime()
+	return idx, nil
+}
+
+// WriteIndex replaces the repository's index file, using the same
+// lock file as git
+func (g *GitDir) WriteIndex(idx *Index) error {
+	buf, err := idx.Encode()
+	if err != nil {
+		return err
+	}
+	return writeLocked(path.Join(g.Dir, "index"), buf)
+}
+
+// optional interface, for stores that have an index
+type IndexStore interface {
+	ReadIndex() (*Index, error)
+	WriteIndex(*Index) error
+}
+
+func (g *Git) indexStore() IndexStore {
+	for _, store := range g.storeList() {
+		if is, ok := store.(IndexStore); ok {
+			return is
+		}
+	}
+	return nil
+}
+
+// ReadIndex reads the index from the first store that has one
+func (g *Git) ReadIndex() (*Index, error) {
+	is := g.indexStore()
+	if is == nil {
+		return NewIndex(), nil
+	}
+	return is.ReadIndex()
+}
+
+// WriteIndex writes the index to the first store that has one
+func (g *Git) WriteIndex(idx *Index) error {
+	is := g.indexStore()
+	if is == nil {
+		return ErrReadOnly
+	}
+	return is.WriteIndex(idx)
+}
+
+// indexReader keeps track of our place in an index file, and
+// remembers the first error
+type indexReader struct {
+	buf []byte
+	err error
+}
+
+func (r *indexReader) fail() {
+	if r.err == nil {
+		r.err = ErrBadIndex
+	}
+	r.buf = nil
+}
+
+func (r *indexReader) bytes(n int) []byte {
+	if n < 0 || n > len(r.buf) {
+		r.fail()
+		// enough for callers reading fixed size fields
+		return make([]byte, 20)
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *indexReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.bytes(4))
+}
+
+func (r *indexReader) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.bytes(2))
+}
+
+func (r *indexReader) ptr() (p Ptr) {
+	copy(p.hash[:], r.bytes(20))
+	return
+}
+
+// cstring reads a NUL-terminated string
+func (r *indexReader) cstring() string {
+	k := bytes.IndexByte(r.buf, 0)
+	if k < 0 {
+		r.fail()
+		return ""
+	}
+	s := string(r.buf[:k])
+	r.buf = r.buf[k+1:]
+	return s
+}
+
+// varint reads git's variable length integers, in which each
+// continuation adds one so that there is only one encoding of each
+// number
+func (r *indexReader) varint() int {
+	var val uint64
+	for i := 0; ; i++ {
+		if len(r.buf) == 0 || i > 9 {
+			r.fail()
+			return 0
+		}
+		c := r.buf[0]
+		r.buf = r.buf[1:]
+		val += uint64(c & 0x7f)
+		if c&0x80 == 0 {
+			break
+		}
+		val = (val + 1) << 7
+	}
+	return int(val)
+}
+
+func (r *indexReader) stat() (s StatData) {
+	s.CTime = indexTime(r.uint32(), r.uint32())
+	s.MTime = indexTime(r.uint32(), r.uint32())
+	s.Dev = r.uint32()
+	s.Ino = r.uint32()
+	s.UID = r.uint32()
+	s.GID = r.uint32()
+	s.Size = r.uint32()
+	return
+}
+
+func indexTime(sec, nsec uint32) time.Time {
+	if sec == 0 && nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+// index entry flags
+const (
+	indexAssumeValid  = 0x8000
+	indexExtended     = 0x4000
+	indexStageShift   = 12
+	indexNameMask     = 0x0fff
+	indexSkipWorktree = 0x4000 // in the extended flags
+	indexIntentToAdd  = 0x2000
+)
+
+// ParseIndex interprets the contents of an index file
+func ParseIndex(buf []byte) (*Index, error) {
+	if len(buf) < 12+20 {
+		return nil, ErrBadIndex
+	}
+	body := buf[:len(buf)-20]
+	sum := sha1.Sum(body)
+	if !bytes.Equal(sum[:], buf[len(buf)-20:]) {
+		return nil, ErrIndexChecksum
+	}
+
+	r := &indexReader{buf: body}
+	if string(r.bytes(4)) != "DIRC" {
+		return nil, ErrBadIndex
+	}
+	idx := &Index{Version: int(r.uint32())}
+	if idx.Version < 2 || idx.Version > 4 {
+		return nil, ErrIndexVersion
+	}
+	count := int(r.uint32())
+
+	prev := ""
+	for i := 0; i < count && r.err == nil; i++ {
+		start := len(r.buf)
+		e := &IndexEntry{}
+		e.CTime = indexTime(r.uint32(), r.uint32())
+		e.MTime = indexTime(r.uint32(), r.uint32())
+		e.Dev = r.uint32()
+		e.Ino = r.uint32()
+		e.Mode = uint(r.uint32())
+		e.UID = r.uint32()
+		e.GID = r.uint32()
+		e.Size = r.uint32()
+		e.Ptr = r.ptr()
+		flags := r.uint16()
+		e.AssumeValid = flags&indexAssumeValid != 0
+		e.Stage = int(flags>>indexStageShift) & 3
+		if flags&indexExtended != 0 {
+			if idx.Version < 3 {
+				return nil, ErrBadIndex
+			}
+			ext := r.uint16()
+			e.SkipWorktree = ext&indexSkipWorktree != 0
+			e.IntentToAdd = ext&indexIntentToAdd != 0
+		}
+
+		if idx.Version == 4 {
+			// the path is the previous one, less some bytes at
+			// the end, plus a suffix
+			strip := r.varint()
+			if strip > len(prev) {
+				return nil, ErrBadIndex
+			}
+			e.Path = prev[:len(prev)-strip] + r.cstring()
+		} else {
+			e.Path = r.cstring()
+			// the entry is padded with NULs to a multiple of 8
+			used := start - len(r.buf)
+			if pad := (used+7)&^7 - used; pad > 0 {
+				r.bytes(pad)
+			}
+		}
+		prev = e.Path
+		idx.Entries = append(idx.Entries, e)
+	}
+
+	for r.err == nil && len(r.buf) > 0 {
+		sig := string(r.bytes(4))
+		size := int(r.uint32())
+		data := r.bytes(size)
+		if r.err != nil {
+			break
+		}
+		var err error
+		switch sig {
+		case "TREE":
+			idx.Cache, err = parseCacheTree(data)
+		case "REUC":
+			idx.Resolve, err = parseResolveUndo(data)
+		case "UNTR":
+			idx.Untracked, err = parseUntracked(data)
+		default:
+			// extensions starting with a capital letter are
+			// optional, and can be ignored
+			if sig[0] < 'A' || sig[0] > 'Z' {
+				return nil, ErrIndexExtension
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return idx, nil
+}
+
+func parseCacheTree(data []byte) (*CacheTree, error) {
+	r := &indexReader{buf: data}
+	var read func() *CacheTree
+	read = func() *CacheTree {
+		ct := &CacheTree{Name: r.cstring()}
+		line := r.bytes(bytes.IndexByte(r.buf, '\n') + 1)
+		fields := strings.Fields(string(line))
+		if len(fields) != 2 {
+			r.fail()
+			return ct
+		}
+		n, err1 := strconv.Atoi(fields[0])
+		subs, err2 := strconv.Atoi(fields[1])
+		if err1 != nil || err2 != nil || subs < 0 {
+			r.fail()
+			return ct
+		}
+		ct.EntryCount = n
+		if n >= 0 {
+			ct.Ptr = r.ptr()
+		}
+		for i := 0; i < subs && r.err == nil; i++ {
+			ct.Subtrees = append(ct.Subtrees, read())
+		}
+		return ct
+	}
+	ct := read()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return ct, nil
+}
+
+func parseResolveUndo(data []byte) ([]*ResolveUndo, error) {
+	r := &indexReader{buf: data}
+	var lst []*ResolveUndo
+	for len(r.buf) > 0 && r.err == nil {
+		ru := &ResolveUndo{Path: r.cstring()}
+		for i := range ru.Modes {
+			m, err := strconv.ParseUint(r.cstring(), 8, 32)
+			if err != nil {
+				return nil, ErrBadIndex
+			}
+			ru.Modes[i] = uint(m)
+		}
+		for i := range ru.Ptrs {
+			if ru.Modes[i] != 0 {
+				ru.Ptrs[i] = r.ptr()
+			}
+		}
+		lst = append(lst, ru)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return lst, nil
+}
+
+func parseUntracked(data []byte) (*UntrackedCache, error) {
+	r := &indexReader{buf: data}
+	uc := &UntrackedCache{}
+	uc.Ident = string(r.bytes(r.varint()))
+	uc.InfoExclude.StatData = r.stat()
+	uc.ExcludesFile.StatData = r.stat()
+	uc.DirFlags = r.uint32()
+	uc.InfoExclude.Ptr = r.ptr()
+	uc.ExcludesFile.Ptr = r.ptr()
+	uc.ExcludePerDir = r.cstring()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.buf) == 0 {
+		return uc, nil
+	}
+	count := r.varint()
+	if count == 0 {
+		return uc, r.err
+	}
+
+	// the directories are in depth-first order
+	var dirs []*UntrackedDir
+	var read func() *UntrackedDir
+	read = func() *UntrackedDir {
+		ud := &UntrackedDir{}
+		dirs = append(dirs, ud)
+		nu := r.varint()
+		nd := r.varint()
+		ud.Name = r.cstring()
+		for i := 0; i < nu && r.err == nil; i++ {
+			ud.Untracked = append(ud.Untracked, r.cstring())
+		}
+		for i := 0; i < nd && r.err == nil; i++ {
+			ud.Dirs = append(ud.Dirs, read())
+		}
+		return ud
+	}
+	uc.Root = read()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(dirs) != count {
+		return nil, ErrBadIndex
+	}
+
+	valid := r.ewah(count)
+	checkOnly := r.ewah(count)
+	hashValid := r.ewah(count)
+	for i, ud := range dirs {
+		ud.Valid = bitSet(valid, i)
+		ud.CheckOnly = bitSet(checkOnly, i)
+		if bitSet(hashValid, i) {
+			ud.Exclude = &UntrackedStat{StatData: r.stat()}
+		}
+	}
+	for _, ud := range dirs {
+		if ud.Exclude != nil {
+			ud.Exclude.Ptr = r.ptr()
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return uc, nil
+}
+
+func bitSet(bits []bool, i int) bool {
+	return i < len(bits) && bits[i]
+}
+
+// ewah reads an EWAH compressed bitmap, as used by git, of no more
+// than max bits
+func (r *indexReader) ewah(max int) []bool {
+	nbits := int(r.uint32())
+	nwords := int(r.uint32())
+	if r.err != nil || nwords > len(r.buf)/8 || nbits > max {
+		r.fail()
+		return nil
+	}
+	words := make([]uint64, nwords)
+	for i := range words {
+		words[i] = binary.BigEndian.Uint64(r.bytes(8))
+	}
+	r.uint32() // position of the last marker word
+
+	bits := make([]bool, 0, nbits)
+	for i := 0; i < len(words) && len(bits) < nbits; {
+		// a marker word: a run of identical words, followed by
+		// some literal words
+		rlw := words[i]
+		i++
+		run := rlw&1 != 0
+		runLen := int(rlw >> 1 & 0xffffffff)
+		literals := int(rlw >> 33)
+		for k := 0; k < runLen*64 && len(bits) < nbits; k++ {
+			bits = append(bits, run)
+		}
+		for k := 0; k < literals && i < len(words); k++ {
+			w := words[i]
+			i++
+			for b := 0; b < 64 && len(bits) < nbits; b++ {
+				bits = append(bits, w&(1<<uint(b)) != 0)
+			}
+		}
+	}
+	return bits
+}
+
+// indexWriter builds up an index file
+type indexWriter struct {
+	bytes.Buffer
+}
+
+func (w *indexWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *indexWriter) uint16(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *indexWriter) cstring(s string) {
+	w.WriteString(s)
+	w.WriteByte(0)
+}
+
+func (w *indexWriter) varint(v int) {
+	var b [16]byte
+	pos := len(b) - 1
+	b[pos] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		v--
+		pos--
+		b[pos] = 0x80 | byte(v&0x7f)
+	}
+	w.Write(b[pos:])
+}
+
+func (w *indexWriter) time(t time.Time) {
+	if t.IsZero() {
+		w.uint32(0)
+		w.uint32(0)
+		return
+	}
+	w.uint32(uint32(t.Unix()))
+	w.uint32(uint32(t.Nanosecond()))
+}
+
+func (w *indexWriter) stat(s *StatData) {
+	w.time(s.CTime)
+	w.time(s.MTime)
+	w.uint32(s.Dev)
+	w.uint32(s.Ino)
+	w.uint32(s.UID)
+	w.uint32(s.GID)
+	w.uint32(s.Size)
+}
+
+// ewah writes a bitmap in EWAH format, without bothering to compress
+// it: one marker word followed by all the bits as literal words
+func (w *indexWriter) ewah(bits []bool) {
+	nwords := (len(bits) + 63) / 64
+	w.uint32(uint32(len(bits)))
+	w.uint32(uint32(nwords + 1))
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(nwords)<<33)
+	w.Write(b[:])
+	for i := 0; i < nwords; i++ {
+		var word uint64
+		for k := 0; k < 64 && i*64+k < len(bits); k++ {
+			if bits[i*64+k] {
+				word |= 1 << uint(k)
+			}
+		}
+		binary.BigEndian.PutUint64(b[:], word)
+		w.Write(b[:])
+	}
+	w.uint32(0)
+}
+
+// Encode produces the contents of an index file.  The entries are
+// sorted first, and the version is raised to 3 if an entry needs
+// extended flags
+func (idx *Index) Encode() ([]byte, error) {
+	sort.SliceStable(idx.Entries, func(i, j int) bool {
+		return indexLess(idx.Entries[i], idx.Entries[j])
+	})
+	version := idx.Version
+	if version == 0 {
+		version = 2
+	}
+	if version < 2 || version > 4 {
+		return nil, ErrIndexVersion
+	}
+	if version == 2 {
+		for _, e := range idx.Entries {
+			if e.extended() {
+				version = 3
+				break
+			}
+		}
+	}
+
+	w := &indexWriter{}
+	w.WriteString("DIRC")
+	w.uint32(uint32(version))
+	w.uint32(uint32(len(idx.Entries)))
+	prev := ""
+	for _, e := range idx.Entries {
+		if e.Path == "" || strings.IndexByte(e.Path, 0) >= 0 || e.Stage < 0 || e.Stage > 3 {
+			return nil, ErrBadIndex
+		}
+		start := w.Len()
+		w.time(e.CTime)
+		w.time(e.MTime)
+		w.uint32(e.Dev)
+		w.uint32(e.Ino)
+		w.uint32(uint32(e.Mode))
+		w.uint32(e.UID)
+		w.uint32(e.GID)
+		w.uint32(e.Size)
+		w.Write(e.Ptr.hash[:])
+
+		flags := uint16(e.Stage) << indexStageShift
+		if len(e.Path) < indexNameMask {
+			flags |= uint16(len(e.Path))
+		} else {
+			flags |= indexNameMask
+		}
+		if e.AssumeValid {
+			flags |= indexAssumeValid
+		}
+		if e.extended() {
+			flags |= indexExtended
+		}
+		w.uint16(flags)
+		if e.extended() {
+			var ext uint16
+			if e.SkipWorktree {
+				ext |= indexSkipWorktree
+			}
+			if e.IntentToAdd {
+				ext |= indexIntentToAdd
+			}
+			w.uint16(ext)
+		}
+
+		if version == 4 {
+			common := 0
+			for common < len(prev) && common < len(e.Path) && prev[common] == e.Path[common] {
+				common++
+			}
+			w.varint(len(prev) - common)
+			w.cstring(e.Path[common:])
+		} else {
+			w.cstring(e.Path)
+			used := w.Len() - start
+			for pad := (used+7)&^7 - used; pad > 0; pad-- {
+				w.WriteByte(0)
+			}
+		}
+		prev = e.Path
+	}
+
+	if idx.Cache != nil {
+		var ext indexWriter
+		ext.cacheTree(idx.Cache)
+		w.extension("TREE", &ext)
+	}
+	if len(idx.Resolve) > 0 {
+		var ext indexWriter
+		for _, ru := range idx.Resolve {
+			ext.cstring(ru.Path)
+			for _, m := range ru.Modes {
+				ext.cstring(strconv.FormatUint(uint64(m), 8))
+			}
+			for i, m := range ru.Modes {
+				if m != 0 {
+					ext.Write(ru.Ptrs[i].hash[:])
+				}
+			}
+		}
+		w.extension("REUC", &ext)
+	}
+	if idx.Untracked != nil {
+		var ext indexWriter
+		ext.untracked(idx.Untracked)
+		w.extension("UNTR", &ext)
+	}
+
+	sum := sha1.Sum(w.Bytes())
+	w.Write(sum[:])
+	return w.Bytes(), nil
+}
+
+func (w *indexWriter) extension(sig string, ext *indexWriter) {
+	w.WriteString(sig)
+	w.uint32(uint32(ext.Len()))
+	w.Write(ext.Bytes())
+}
+
+func (w *indexWriter) cacheTree(ct *CacheTree) {
+	w.cstring(ct.Name)
+	w.WriteString(strconv.Itoa(ct.EntryCount))
+	w.WriteByte(' ')
+	w.WriteString(strconv.Itoa(len(ct.Subtrees)))
+	w.WriteByte('\n')
+	if ct.EntryCount >= 0 {
+		w.Write(ct.Ptr.hash[:])
+	}
+	for _, sub := range ct.Subtrees {
+		w.cacheTree(sub)
+	}
+}
+
+func (w *indexWriter) untracked(uc *UntrackedCache) {
+	w.varint(len(uc.Ident))
+	w.WriteString(uc.Ident)
+	w.stat(&uc.InfoExclude.StatData)
+	w.stat(&uc.ExcludesFile.StatData)
+	w.uint32(uc.DirFlags)
+	w.Write(uc.InfoExclude.Ptr.hash[:])
+	w.Write(uc.ExcludesFile.Ptr.hash[:])
+	w.cstring(uc.ExcludePerDir)
+	if uc.Root == nil {
+		w.varint(0)
+		return
+	}
+
+	var dirs []*UntrackedDir
+	var blocks indexWriter
+	var write func(ud *UntrackedDir)
+	write = func(ud *UntrackedDir) {
+		dirs = append(dirs, ud)
+		blocks.varint(len(ud.Untracked))
+		blocks.varint(len(ud.Dirs))
+		blocks.cstring(ud.Name)
+		for _, name := range ud.Untracked {
+			blocks.cstring(name)
+		}
+		for _, sub := range ud.Dirs {
+			write(sub)
+		}
+	}
+	write(uc.Root)
+	w.varint(len(dirs))
+	w.Write(blocks.Bytes())
+
+	valid := make([]bool, len(dirs))
+	checkOnly := make([]bool, len(dirs))
+	hashValid := make([]bool, len(dirs))
+	for i, ud := range dirs {
+		valid[i] = ud.Valid
+		checkOnly[i] = ud.CheckOnly
+		hashValid[i] = ud.Exclude != nil
+	}
+	w.ewah(valid)
+	w.ewah(checkOnly)
+	w.ewah(hashValid)
+	for _, ud := range dirs {
+		if ud.Exclude != nil {
+			w.stat(&ud.Exclude.StatData)
+		}
+	}
+	for _, ud := range dirs {
+		if ud.Exclude != nil {
+			w.Write(ud.Exclude.Ptr.hash[:])
+		}
+	}
+	w.WriteByte(0)
+}
+
+// WriteTree writes tree objects for the (stage 0) contents of the
+// index, like "git write-tree", and returns the root.  Directories
+// whose trees are recorded in the cache tree are not rewritten, and
+// the cache tree is brought up to date.  Entries added with
+// IntentToAdd are left out
+func (idx *Index) WriteTree(g *Git) (*Tree, error) {
+	if idx.Unmerged() {
+		return nil, ErrUnmerged
+	}
+	sort.SliceStable(idx.Entries, func(i, j int) bool {
+		return indexLess(idx.Entries[i], idx.Entries[j])
+	})
+	ct, root, err := idx.writeDir(g, "", "", idx.Entries, idx.Cache)
+	if err != nil {
+		return nil, err
+	}
+	idx.Cache = ct
+	o, err := g.load(&root)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := o.(*Tree)
+	if !ok {
+		return nil, ErrNotTree
+	}
+	return t, nil
+}
+
+// writeDir writes the tree for a directory, whose entries (with the
+// directory prefix) are given.  Like git, a directory containing
+// intent-to-add entries gets a tree, but it is not recorded in the
+// cache tree, and one containing nothing else is left out
+func (idx *Index) writeDir(g *Git, name, prefix string, entries []*IndexEntry, cached *CacheTree) (*CacheTree, Ptr, error) {
+	if cached != nil && cached.EntryCount >= 0 {
+		return cached, cached.Ptr, nil
+	}
+	ct := &CacheTree{Name: name}
+	invalid := false
+	empty := HashObject(ObjTree, nil)
+	var nodes []*Node
+	for i := 0; i < len(entries); {
+		rel := entries[i].Path[len(prefix):]
+		k := strings.IndexByte(rel, '/')
+		if k < 0 {
+			if entries[i].IntentToAdd {
+				invalid = true
+			} else {
+				nodes = append(nodes, &Node{
+					Name: rel,
+					Perm: entries[i].Mode,
+					Ref:  entries[i].Ptr,
+				})
+			}
+			i++
+			continue
+		}
+		// everything in this subdirectory
+		dir := rel[:k]
+		sub := prefix + dir + "/"
+		j := i + 1
+		for j < len(entries) && strings.HasPrefix(entries[j].Path, sub) {
+			j++
+		}
+		var subCached *CacheTree
+		if cached != nil {
+			for _, x := range cached.Subtrees {
+				if x.Name == dir {
+					subCached = x
+				}
+			}
+		}
+		subTree, subPtr, err := idx.writeDir(g, dir, sub, entries[i:j], subCached)
+		if err != nil {
+			return nil, Ptr{}, err
+		}
+		if subTree.EntryCount < 0 {
+			invalid = true
+		}
+		ct.Subtrees = append(ct.Subtrees, subTree)
+		i = j
+		if subTree.EntryCount < 0 && subPtr.Equals(&empty) {
+			// nothing but intent-to-add entries
+			continue
+		}
+		nodes = append(nodes, &Node{Name: dir, Perm: ModeDir, Ref: subPtr})
+	}
+	ct.EntryCount = len(entries)
+	if invalid {
+		ct.EntryCount = -1
+	}
+	t, err := g.WriteTree(nodes)
+	if err != nil {
+		return nil, Ptr{}, err
+	}
+	if !invalid {
+		ct.Ptr = t.name
+	}
+	// git keeps subtrees ordered by name length, then name
+	sort.Slice(ct.Subtrees, func(i, j int) bool {
+		a, b := ct.Subtrees[i].Name, ct.Subtrees[j].Name
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+	return ct, t.name, nil
+}
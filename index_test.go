@@ -0,0 +1,267 @@
+package git
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// makeIndexRepo builds a work tree whose index has a resolved merge
+// conflict (for REUC), an intent-to-add entry, a skip-worktree entry
+// and a cache tree
+func makeIndexRepo(t *testing.T) string {
+	dir := t.TempDir()
+	initRepo(t, dir)
+	writeFile(t, dir, "README", "hello\n")
+	writeFile(t, dir, "src/main.go", "package main\n")
+	writeFile(t, dir, "src/util/util.go", "package util\n")
+	writeFile(t, dir, "src/util-x.go", "package src\n")
+	writeFile(t, dir, "conflict.txt", "base\n")
+	writeFile(t, dir, "bin/run", "#!/bin/sh\n")
+	os.Chmod(filepath.Join(dir, "bin/run"), 0755)
+	os.Symlink("README", filepath.Join(dir, "link"))
+	gitCmd(t, dir, "", "add", ".")
+	gitCmd(t, dir, "", "commit", "-q", "-m", "base")
+
+	// make conflict.txt unmerged, as a failed merge would
+	var stages []string
+	for i, body := range []string{"base\n", "main\n", "side\n"} {
+		p := strings.TrimSpace(gitCmd(t, dir, body, "hash-object", "-w", "--stdin"))
+		stages = append(stages, "100644 "+p+" "+strconv.Itoa(i+1)+"\tconflict.txt\n")
+	}
+	gitCmd(t, dir, "0 0000000000000000000000000000000000000000\tconflict.txt\n"+
+		strings.Join(stages, ""), "update-index", "--index-info")
+	writeFile(t, dir, "conflict.txt", "resolved\n")
+	gitCmd(t, dir, "", "add", "conflict.txt")
+
+	writeFile(t, dir, "later.txt", "not yet\n")
+	gitCmd(t, dir, "", "add", "-N", "later.txt")
+	gitCmd(t, dir, "", "update-index", "--skip-worktree", "README")
+	gitCmd(t, dir, "", "write-tree")
+	return dir
+}
+
+// lsFiles returns the same information as "git ls-files -s" for our
+// idea of the index
+func lsFiles(idx *Index) string {
+	var buf strings.Builder
+	for _, e := range idx.Entries {
+		buf.WriteString(strconv.FormatUint(uint64(e.Mode), 8) + " " +
+			e.Ptr.String() + " " + strconv.Itoa(e.Stage) + "\t" + e.Path + "\n")
+	}
+	return buf.String()
+}
+
+func TestIndexVersions(t *testing.T) {
+	dir := makeIndexRepo(t)
+	gd := &GitDir{Dir: filepath.Join(dir, ".git")}
+
+	for _, v := range []string{"3", "4"} {
+		gitCmd(t, dir, "", "update-index", "--index-version", v)
+		raw, err := os.ReadFile(filepath.Join(dir, ".git/index"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx, err := gd.ReadIndex()
+		if err != nil {
+			t.Fatalf("v%s: %s", v, err)
+		}
+		if strconv.Itoa(idx.Version) != v {
+			t.Errorf("expected version %s, got %d", v, idx.Version)
+		}
+		if got, expect := lsFiles(idx), gitCmd(t, dir, "", "ls-files", "-s"); got != expect {
+			t.Errorf("v%s entries:\n%s\nexpected:\n%s", v, got, expect)
+		}
+
+		e := idx.Entry("README")
+		if e == nil || !e.SkipWorktree || e.Size != 6 || e.MTime.IsZero() {
+			t.Errorf("v%s: bad README entry %#v", v, e)
+		}
+		if e := idx.Entry("later.txt"); e == nil || !e.IntentToAdd {
+			t.Errorf("v%s: expected an intent-to-add entry, got %#v", v, e)
+		}
+		if e := idx.Entry("bin/run"); e == nil || e.Mode != ModeExecutable {
+			t.Errorf("v%s: bad bin/run entry %#v", v, e)
+		}
+		if len(idx.Resolve) != 1 || idx.Resolve[0].Path != "conflict.txt" ||
+			idx.Resolve[0].Modes != [3]uint{ModeFile, ModeFile, ModeFile} {
+			t.Errorf("v%s: bad resolve-undo %#v", v, idx.Resolve)
+		}
+		if idx.Cache == nil {
+			t.Fatalf("v%s: no cache tree", v)
+		}
+
+		// everything git wrote is understood, so we should write
+		// exactly the same thing back
+		buf, err := idx.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, raw) {
+			t.Errorf("v%s: encoding differs from git's", v)
+		}
+	}
+
+	// upgraded to version 3 when an entry needs the extended flags
+	idx, err := gd.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Version = 2
+	buf, err := idx.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ParseIndex(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Version != 3 {
+		t.Errorf("expected version 3, got %d", again.Version)
+	}
+}
+
+func TestIndexUntrackedCache(t *testing.T) {
+	dir := makeIndexRepo(t)
+	writeFile(t, dir, "junk/deeper/file", "x")
+	writeFile(t, dir, "src/scratch", "x")
+	gitCmd(t, dir, "", "-c", "core.untrackedCache=true", "update-index", "--untracked-cache")
+	gitCmd(t, dir, "", "-c", "core.untrackedCache=true", "status", "--porcelain")
+	status := gitCmd(t, dir, "", "-c", "core.untrackedCache=true", "status", "--porcelain")
+
+	gd := &GitDir{Dir: filepath.Join(dir, ".git")}
+	idx, err := gd.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc := idx.Untracked
+	if uc == nil || uc.ExcludePerDir != ".gitignore" || uc.Root == nil {
+		t.Fatalf("bad untracked cache %#v", uc)
+	}
+	var names []string
+	var walk func(string, *UntrackedDir)
+	walk = func(prefix string, ud *UntrackedDir) {
+		for _, name := range ud.Untracked {
+			names = append(names, prefix+name)
+		}
+		for _, sub := range ud.Dirs {
+			walk(prefix+sub.Name+"/", sub)
+		}
+	}
+	walk("", uc.Root)
+	if !contains(names, "junk/") || !contains(names, "src/scratch") {
+		t.Errorf("untracked files are %q", names)
+	}
+
+	// the bitmaps are written differently, but the result means
+	// the same thing, to us and to git
+	if err := gd.WriteIndex(idx); err != nil {
+		t.Fatal(err)
+	}
+	again, err := gd.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again.mtime = idx.mtime
+	if !reflect.DeepEqual(idx, again) {
+		t.Errorf("index changed after writing")
+	}
+	if got := gitCmd(t, dir, "", "-c", "core.untrackedCache=true", "status", "--porcelain"); got != status {
+		t.Errorf("git status changed from:\n%s\nto:\n%s", status, got)
+	}
+
+	// a bitmap can't have more bits than there are directories
+	r := &indexReader{buf: []byte{
+		0x80, 0, 0, 0, // bits
+		0, 0, 0, 1, // words
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, // last marker
+	}}
+	if r.ewah(len(names)) != nil || r.err != ErrBadIndex {
+		t.Errorf("expected a 2^31 bit bitmap to be refused, got %v", r.err)
+	}
+}
+
+func contains(lst []string, s string) bool {
+	for _, x := range lst {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestIndexWriteTree(t *testing.T) {
+	dir := makeIndexRepo(t)
+	g, err := Open(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := g.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := strings.TrimSpace(gitCmd(t, dir, "", "write-tree"))
+	gitTree := idx.Cache
+
+	// from scratch...
+	idx.Cache = nil
+	tree, err := idx.WriteTree(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Name().String() != expect {
+		t.Errorf("expected tree %s, got %s", expect, tree.Name())
+	}
+	if !reflect.DeepEqual(idx.Cache, gitTree) {
+		t.Errorf("cache tree differs from git's")
+	}
+
+	// ...and after a change
+	blob, err := g.Put(ObjBlob, []byte("new\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Add(&IndexEntry{Path: "src/util/new.go", Mode: ModeFile, Ptr: blob})
+	idx.Remove("link")
+	if idx.Cache.EntryCount != -1 || idx.Cache.Subtrees[0].EntryCount < 0 {
+		t.Errorf("expected only the changed directories to be invalidated")
+	}
+	tree, err = idx.WriteTree(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.WriteIndex(idx); err != nil {
+		t.Fatal(err)
+	}
+	expect = strings.TrimSpace(gitCmd(t, dir, "", "write-tree"))
+	if tree.Name().String() != expect {
+		t.Errorf("expected tree %s, got %s", expect, tree.Name())
+	}
+	if got := gitCmd(t, dir, "", "ls-files", "-s"); got != lsFiles(idx) {
+		t.Errorf("git sees:\n%s", got)
+	}
+
+	// a directory of nothing but intent-to-add entries isn't in the
+	// tree at all
+	writeFile(t, dir, "planned/sub/a.txt", "a\n")
+	writeFile(t, dir, "planned/b.txt", "b\n")
+	gitCmd(t, dir, "", "add", "-N", "planned")
+	expect = strings.TrimSpace(gitCmd(t, dir, "", "write-tree"))
+	idx, err = g.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Cache = nil
+	tree, err = idx.WriteTree(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Name().String() != expect {
+		t.Errorf("with intent-to-add directory: expected tree %s, got %s", expect, tree.Name())
+	}
+}
@@ -0,0 +1,279 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// packIndexer builds the index of a pack as it arrives, as "git
+// index-pack --stdin --fix-thin" does
+type packIndexer struct {
+	repo    *Git
+	file    *os.File
+	entries []*indexEntry
+	end     int64 // where the objects end and the trailer starts
+	sum     Ptr
+	// the deltas waiting on each base, by offset or by name
+	ofsDeltas map[int64][]*indexEntry
+	refDeltas map[Ptr][]*indexEntry
+}
+
+// indexEntry is an object in the pack being indexed
+type indexEntry struct {
+	offset   int64
+	crc      uint32
+	typ      ObjType
+	name     Ptr
+	resolved bool
+}
+
+// IndexPack reads a pack stream, such as a server sends, and stores
+// it in dir (usually objects/pack) along with an index for it, then
+// adds it to the repository's stores.  Deltas may be against objects
+// the repository already has, as in a thin pack, in which case those
+// objects are added to the pack so that it stands on its own
+func IndexPack(g *Git, dir string, r io.Reader) (*PackFile, error) {
+	tmp, err := ioutil.TempFile(dir, "tmp_pack_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	ix := &packIndexer{
+		repo:      g,
+		file:      tmp,
+		ofsDeltas: make(map[int64][]*indexEntry),
+		refDeltas: make(map[Ptr][]*indexEntry),
+	}
+	if err := ix.read(r); err != nil {
+		return nil, err
+	}
+	if err := ix.resolve(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	names := make([]Ptr, len(ix.entries))
+	offsets := make([]int64, len(ix.entries))
+	crcs := make([]uint32, len(ix.entries))
+	for i, e := range ix.entries {
+		names[i], offsets[i], crcs[i] = e.name, e.offset, e.crc
+	}
+	var idx bytes.Buffer
+	if err := writePackIndex(&idx, names, offsets, crcs, ix.sum); err != nil {
+		return nil, err
+	}
+	pack, err := installPack(tmp.Name(), dir, ix.sum, idx.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return IncludePackFile(g, pack)
+}
+
+// read copies the pack to the file, noting where each object is and
+// naming those that aren't deltas
+func (ix *packIndexer) read(r io.Reader) error {
+	bw := bufio.NewWriter(ix.file)
+	ps := newPackStream(io.TeeReader(r, bw))
+	count, err := ps.header()
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < count; i++ {
+		pe, err := ps.entry()
+		if err != nil {
+			return err
+		}
+		e := &indexEntry{offset: pe.offset, crc: pe.crc}
+		switch pe.typ {
+		case ObjOffsetDelta:
+			ix.ofsDeltas[pe.baseOffset] = append(ix.ofsDeltas[pe.baseOffset], e)
+		case ObjRefDelta:
+			ix.refDeltas[pe.baseName] = append(ix.refDeltas[pe.baseName], e)
+		default:
+			e.typ = pe.typ
+			e.name = HashObject(pe.typ, pe.data)
+			e.resolved = true
+		}
+		ix.entries = append(ix.entries, e)
+	}
+	ix.end = ps.off
+	if ix.sum, err = ps.trailer(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	// the stream may have been read past the end of the pack
+	return ix.file.Truncate(ix.end + 20)
+}
+
+// entryAt reads back the object at an offset in the pack
+func (ix *packIndexer) entryAt(offset int64) (*packEntry, error) {
+	ps := newPackStream(io.NewSectionReader(ix.file, offset, ix.end-offset))
+	ps.off = offset
+	return ps.entry()
+}
+
+// resolve works out what the deltas are, starting from each object
+// that isn't one, then from any bases of a thin pack
+func (ix *packIndexer) resolve() error {
+	for _, e := range ix.entries {
+		if !e.resolved {
+			continue
+		}
+		pe, err := ix.entryAt(e.offset)
+		if err != nil {
+			return err
+		}
+		if err := ix.resolveDeltas(e, pe.data); err != nil {
+			return err
+		}
+	}
+
+	// what's left are deltas against objects the repository has, or
+	// against deltas against them.  A base found in the repository
+	// can turn up in the pack too, once its own base is found, so
+	// they are only added to the pack at the end, if they didn't
+	var waiting []Ptr
+	for name, deltas := range ix.refDeltas {
+		if !deltas[0].resolved {
+			waiting = append(waiting, name)
+		}
+	}
+	sort.Slice(waiting, func(i, j int) bool {
+		return waiting[i].Less(&waiting[j])
+	})
+	type thinBase struct {
+		typ  ObjType
+		data []byte
+	}
+	thin := make(map[Ptr]thinBase)
+	for _, name := range waiting {
+		name := name
+		if ix.refDeltas[name][0].resolved {
+			continue
+		}
+		data, t, err := ix.repo.rawObject(&name)
+		if err == ErrMissingObject {
+			continue
+		} else if err != nil {
+			return err
+		}
+		base := &indexEntry{offset: -1, typ: t, name: name, resolved: true}
+		if err := ix.resolveDeltas(base, data); err != nil {
+			return err
+		}
+		thin[name] = thinBase{t, data}
+	}
+
+	inPack := make(map[Ptr]bool, len(ix.entries))
+	for _, e := range ix.entries {
+		if !e.resolved {
+			// a delta against a delta whose base is missing, or
+			// (in a corrupt pack) against something not an object
+			return ErrMissingDeltaBase
+		}
+		inPack[e.name] = true
+	}
+	added := false
+	for _, name := range waiting {
+		b, ok := thin[name]
+		if !ok || inPack[name] {
+			continue
+		}
+		if _, err := ix.append(b.typ, b.data); err != nil {
+			return err
+		}
+		added = true
+	}
+	if added {
+		return ix.finish()
+	}
+	return nil
+}
+
+// resolveDeltas resolves the deltas against an object, and those
+// against them in turn
+func (ix *packIndexer) resolveDeltas(base *indexEntry, data []byte) error {
+	var deltas []*indexEntry
+	deltas = append(deltas, ix.ofsDeltas[base.offset]...)
+	deltas = append(deltas, ix.refDeltas[base.name]...)
+	for _, e := range deltas {
+		if e.resolved {
+			continue
+		}
+		pe, err := ix.entryAt(e.offset)
+		if err != nil {
+			return err
+		}
+		result, name, err := patchDelta(base.typ, data, pe.data)
+		if err != nil {
+			return err
+		}
+		e.typ = base.typ
+		e.name = *name
+		e.resolved = true
+		if err := ix.resolveDeltas(e, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append adds a whole object to the end of the pack, over the
+// trailer, which finish puts back
+func (ix *packIndexer) append(t ObjType, data []byte) (*indexEntry, error) {
+	var buf bytes.Buffer
+	buf.Write(packObjectHeader(t, len(data)))
+	z := zlib.NewWriter(&buf)
+	if _, err := z.Write(data); err != nil {
+		return nil, err
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	if _, err := ix.file.WriteAt(buf.Bytes(), ix.end); err != nil {
+		return nil, err
+	}
+	e := &indexEntry{
+		offset:   ix.end,
+		crc:      crc32.ChecksumIEEE(buf.Bytes()),
+		typ:      t,
+		name:     HashObject(t, data),
+		resolved: true,
+	}
+	ix.entries = append(ix.entries, e)
+	ix.end += int64(buf.Len())
+	return e, nil
+}
+
+// finish fixes up the object count and the trailer after objects
+// have been added to the pack
+func (ix *packIndexer) finish() error {
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], uint32(len(ix.entries)))
+	if _, err := ix.file.WriteAt(count[:], 8); err != nil {
+		return err
+	}
+	h := sha1.New()
+	if _, err := io.Copy(h, io.NewSectionReader(ix.file, 0, ix.end)); err != nil {
+		return err
+	}
+	copy(ix.sum.hash[:], h.Sum(nil))
+	if _, err := ix.file.WriteAt(ix.sum.hash[:], ix.end); err != nil {
+		return err
+	}
+	return ix.file.Truncate(ix.end + 20)
+}
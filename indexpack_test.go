@@ -0,0 +1,198 @@
+package git
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// packObjects runs "git pack-objects --stdout" on the revs given
+func packObjects(t *testing.T, dir, revs string, args ...string) []byte {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	cmd := exec.Command("git", append([]string{"pack-objects", "-q", "--stdout", "--revs"}, args...)...)
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(revs)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("pack-objects: %s", err)
+	}
+	return out
+}
+
+// rawEntry is an object for makePack, whole or as a delta against a
+// named base
+type rawEntry struct {
+	typ  ObjType
+	base Ptr // of an ObjRefDelta
+	data []byte
+}
+
+// makePack puts together a pack as it is given, for packs that git
+// wouldn't write
+func makePack(entries ...rawEntry) []byte {
+	var buf bytes.Buffer
+	var hdr [12]byte
+	binary.BigEndian.PutUint32(hdr[0:], GitPackSignature)
+	binary.BigEndian.PutUint32(hdr[4:], 2)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(len(entries)))
+	buf.Write(hdr[:])
+	for _, e := range entries {
+		buf.Write(packObjectHeader(e.typ, len(e.data)))
+		if e.typ == ObjRefDelta {
+			buf.Write(e.base.hash[:])
+		}
+		z := zlib.NewWriter(&buf)
+		z.Write(e.data)
+		z.Close()
+	}
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+func TestIndexPack(t *testing.T) {
+	dir := makeTestRepo(t)
+	g, err := Open(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a complete pack, with offset deltas
+	out := t.TempDir()
+	p, err := IndexPack(New(), out, bytes.NewReader(packObjects(t, dir, "HEAD\n", "--delta-base-offset")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := os.ReadFile(p.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs := filepath.Join(out, "theirs.idx")
+	gitCmd(t, out, "", "index-pack", "-o", theirs, p.Pack)
+	want, err := os.ReadFile(theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(idx, want) {
+		t.Errorf("index differs from git's")
+	}
+	if n := strings.Count(gitCmd(t, dir, "", "rev-list", "--objects", "HEAD"), "\n"); len(p.indexContents) != n {
+		t.Errorf("%d objects in the index, expected %d", len(p.indexContents), n)
+	}
+	for _, ptr := range p.indexContents {
+		ptr := ptr
+		buf, _, err := p.Get(&ptr).(*PackedObject).deDeltaifiedBytes(0)
+		if err != nil {
+			t.Fatalf("%s: %s", &ptr, err)
+		}
+		if want, _, _ := g.rawObject(&ptr); !bytes.Equal(buf, want) {
+			t.Fatalf("%s differs", &ptr)
+		}
+	}
+
+	// a thin pack has its bases added from the repository
+	thin := packObjects(t, dir, "HEAD\n^HEAD~1\n", "--thin")
+	if _, err := IndexPack(New(), t.TempDir(), bytes.NewReader(thin)); err != ErrMissingDeltaBase {
+		t.Errorf("thin pack without its bases: %v", err)
+	}
+	out = t.TempDir()
+	p, err = IndexPack(g, out, bytes.NewReader(thin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := gitCmd(t, out, "", "verify-pack", "-v", p.Pack)
+	if !strings.Contains(verify, "chain length = 1") {
+		t.Errorf("expected a delta\n%s", verify)
+	}
+	// the commit, its tree and blob, and the blob's base
+	if len(p.indexContents) != 4 {
+		t.Errorf("%d objects in the fixed pack, expected 4", len(p.indexContents))
+	}
+	head := mustRev(t, g, "HEAD")
+	if p.Get(head) == nil {
+		t.Errorf("fixed pack doesn't have HEAD")
+	}
+
+	// the pack is checked
+	bad := packObjects(t, dir, "HEAD\n")
+	bad[len(bad)-1] ^= 1
+	if _, err := IndexPack(New(), t.TempDir(), bytes.NewReader(bad)); err != ErrPackChecksum {
+		t.Errorf("bad checksum: %v", err)
+	}
+}
+
+func TestIndexPackWhileReading(t *testing.T) {
+	dir := makeTestRepo(t)
+	head := gitCmd(t, dir, "", "rev-parse", "HEAD")
+	pack := packObjects(t, dir, "HEAD\n")
+
+	// new packs are added to a repository that is in use
+	g := New()
+	ptr, _ := ParsePtr(strings.TrimSpace(head))
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for g.Get(&ptr) == nil {
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		if _, err := IndexPack(g, t.TempDir(), bytes.NewReader(pack)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestIndexPackThinChain(t *testing.T) {
+	x := []byte(strings.Repeat("a line of the base\n", 100))
+	b := append(x[:len(x):len(x)], "b\n"...)
+	c := append(b[:len(b):len(b)], "c\n"...)
+	names := map[Ptr][]byte{
+		HashObject(ObjBlob, x): x,
+		HashObject(ObjBlob, b): b,
+		HashObject(ObjBlob, c): c,
+	}
+
+	// c is a delta against b, which is a delta against x, which only
+	// the repository has
+	pack := makePack(
+		rawEntry{ObjRefDelta, HashObject(ObjBlob, b), newDeltaIndex(b).makeDelta(c, 0)},
+		rawEntry{ObjRefDelta, HashObject(ObjBlob, x), newDeltaIndex(x).makeDelta(b, 0)},
+	)
+	for _, hasB := range []bool{false, true} {
+		g := New()
+		m := newMemStore(g)
+		m.add(ObjBlob, string(x))
+		if hasB {
+			// and b isn't added to the pack just because the
+			// repository has it
+			m.add(ObjBlob, string(b))
+		}
+		p, err := IndexPack(g, t.TempDir(), bytes.NewReader(pack))
+		if err != nil {
+			t.Fatalf("repository has b %t: %s", hasB, err)
+		}
+		if len(p.indexContents) != len(names) {
+			t.Errorf("repository has b %t: %d objects in the fixed pack, expected %d",
+				hasB, len(p.indexContents), len(names))
+		}
+		for name, want := range names {
+			name := name
+			o, ok := p.Get(&name).(*PackedObject)
+			if !ok {
+				t.Fatalf("repository has b %t: %s is not in the pack", hasB, &name)
+			}
+			if buf, _, err := o.deDeltaifiedBytes(0); err != nil || !bytes.Equal(buf, want) {
+				t.Errorf("repository has b %t: %s differs (%v)", hasB, &name, err)
+			}
+		}
+	}
+}
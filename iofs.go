@@ -0,0 +1,349 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// the most symlinks followed in resolving one path, as in Linux
+const maxSymlinks = 40
+
+var ErrTooManyLinks = errors.New("too many levels of symbolic links")
+
+// FS returns the contents of the tree as an io/fs file system, which
+// also implements fs.ReadDirFS, fs.StatFS, fs.ReadFileFS and fs.SubFS.
+// Open and Stat follow symlinks, as long as they stay inside the
+// tree; ReadDir reports them as symlinks.  Submodules appear as empty
+// directories, as in a checkout.  A tree has no times of its own, so
+// ModTime is the zero time, as in fstest.MapFS; see Commit.FS
+func (t *Tree) FS() fs.FS {
+	if t == nil {
+		panic("null")
+	}
+	return &treeFS{root: t}
+}
+
+type treeFS struct {
+	root   *Tree
+	times  *modTimes // nil if we don't know the commit
+	prefix string    // where root is in the commit, for times
+}
+
+func (tf *treeFS) String() string {
+	return "git(" + tf.root.name.String()[0:7] + ")"
+}
+
+// resolve finds the node for a path, following symlinks in the
+// directories along the way, and in the last component if follow is
+// set; it also returns the path it ended up at.  The root, which has
+// no node of its own, is given one named "."
+func (tf *treeFS) resolve(name string, follow bool) (*Node, string, error) {
+	rootNode := &Node{Name: ".", Perm: ModeDir, Ref: tf.root.name}
+	if name == "." {
+		return rootNode, ".", nil
+	}
+	g := tf.root.repo
+	parts := strings.Split(name, "/")
+	at := tf.root
+	var done []string // the resolved path to at
+	links := 0
+	for i := 0; i < len(parts); i++ {
+		comp := parts[i]
+		n := at.contents[comp]
+		if n == nil {
+			return nil, "", fs.ErrNotExist
+		}
+		last := i == len(parts)-1
+		if n.IsSymLink() && (follow || !last) {
+			links++
+			if links > maxSymlinks {
+				return nil, "", ErrTooManyLinks
+			}
+			o, err := g.load(&n.Ref)
+			if err != nil {
+				return nil, "", err
+			}
+			b, ok := o.(*Blob)
+			if !ok {
+				return nil, "", ErrCorrupt
+			}
+			target := b.Value()
+			if path.IsAbs(target) {
+				return nil, "", fs.ErrNotExist
+			}
+			// start again from the top, with the link replaced
+			rest := append(append(done, target), parts[i+1:]...)
+			p := path.Join(rest...)
+			if p == ".." || strings.HasPrefix(p, "../") {
+				return nil, "", fs.ErrNotExist
+			}
+			if p == "." {
+				return rootNode, ".", nil
+			}
+			parts = strings.Split(p, "/")
+			at = tf.root
+			done = nil
+			i = -1
+			continue
+		}
+		if last {
+			return n, path.Join(append(done, comp)...), nil
+		}
+		if !n.IsDir() {
+			return nil, "", fs.ErrNotExist
+		}
+		t, err := g.peelToTree(&n.Ref)
+		if err != nil {
+			return nil, "", err
+		}
+		at = t
+		done = append(done, comp)
+	}
+	panic("unreachable")
+}
+
+// node is resolve, with errors suitable for returning from the
+// fs.FS methods
+func (tf *treeFS) node(op, name string, follow bool) (*Node, string, error) {
+	if !fs.ValidPath(name) {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	n, p, err := tf.resolve(name, follow)
+	if err != nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	// the name is the one asked for, not that of the link target
+	named := *n
+	named.Name = path.Base(name)
+	return &named, p, nil
+}
+
+// info describes the node at a (resolved) path
+func (tf *treeFS) info(n *Node, p string) *nodeFileInfo {
+	nfi := &nodeFileInfo{repo: tf.root.repo, n: n}
+	if tf.times != nil {
+		nfi.mtime = tf.times.get(path.Join(tf.prefix, p))
+	}
+	return nfi
+}
+
+// entries lists a directory in order of name; a submodule has none
+func (tf *treeFS) entries(n *Node, dir string) ([]fs.DirEntry, error) {
+	if n.IsSubmodule() {
+		return nil, nil
+	}
+	if !n.IsDir() {
+		return nil, ErrNotDir
+	}
+	// the root may not be stored anywhere, as for a submodule
+	t := tf.root
+	if n.Ref != t.name {
+		var err error
+		if t, err = tf.root.repo.peelToTree(&n.Ref); err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, len(t.list))
+	copy(names, t.list)
+	sort.Strings(names)
+	lst := make([]fs.DirEntry, len(names))
+	for i, name := range names {
+		lst[i] = fs.FileInfoToDirEntry(tf.info(t.contents[name], path.Join(dir, name)))
+	}
+	return lst, nil
+}
+
+func (tf *treeFS) blob(n *Node) (*Blob, error) {
+	o, err := tf.root.repo.load(&n.Ref)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := o.(*Blob)
+	if !ok {
+		return nil, ErrNotBlob
+	}
+	return b, nil
+}
+
+// Open implements fs.FS
+func (tf *treeFS) Open(name string) (fs.File, error) {
+	n, p, err := tf.node("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if n.IsDir() || n.IsSubmodule() {
+		lst, err := tf.entries(n, p)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &treeDir{name: name, info: tf.info(n, p), entries: lst}, nil
+	}
+	b, err := tf.blob(n)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	info := tf.info(n, p)
+	info.target = b
+	return &treeFile{
+		name:   name,
+		info:   info,
+		reader: bytes.NewReader(b.data),
+	}, nil
+}
+
+// ReadDir implements fs.ReadDirFS
+func (tf *treeFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, p, err := tf.node("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	lst, err := tf.entries(n, p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return lst, nil
+}
+
+// Stat implements fs.StatFS
+func (tf *treeFS) Stat(name string) (fs.FileInfo, error) {
+	n, p, err := tf.node("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return tf.info(n, p), nil
+}
+
+// ReadFile implements fs.ReadFileFS
+func (tf *treeFS) ReadFile(name string) ([]byte, error) {
+	n, _, err := tf.node("read", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if n.IsDir() || n.IsSubmodule() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: ErrIsDir}
+	}
+	b, err := tf.blob(n)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	// the caller is allowed to modify the result
+	return append([]byte(nil), b.data...), nil
+}
+
+// Sub implements fs.SubFS.  Symlinks in the result can't point
+// outside of it
+func (tf *treeFS) Sub(dir string) (fs.FS, error) {
+	n, p, err := tf.node("sub", dir, true)
+	if err != nil {
+		return nil, err
+	}
+	sub := &treeFS{times: tf.times, prefix: path.Join(tf.prefix, p)}
+	if n.IsSubmodule() {
+		// an empty directory, without storing the empty tree (the
+		// repository needn't have it, or be writable)
+		empty := HashObject(ObjTree, nil)
+		sub.root, err = tf.root.repo.loadTree(&empty, nil)
+		if err != nil {
+			return nil, &fs.PathError{Op: "sub", Path: dir, Err: err}
+		}
+		return sub, nil
+	}
+	if !n.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: ErrNotDir}
+	}
+	sub.root, err = tf.root.repo.peelToTree(&n.Ref)
+	if err != nil {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: err}
+	}
+	return sub, nil
+}
+
+// treeFile is an open blob; it also implements io.Seeker and
+// io.ReaderAt, which http.FS wants
+type treeFile struct {
+	name   string
+	info   *nodeFileInfo
+	reader *bytes.Reader
+}
+
+func (f *treeFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *treeFile) Read(buf []byte) (int, error) {
+	if f.reader == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	return f.reader.Read(buf)
+}
+
+func (f *treeFile) ReadAt(buf []byte, off int64) (int, error) {
+	if f.reader == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	return f.reader.ReadAt(buf, off)
+}
+
+func (f *treeFile) Seek(off int64, whence int) (int64, error) {
+	if f.reader == nil {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+	return f.reader.Seek(off, whence)
+}
+
+func (f *treeFile) Close() error {
+	if f.reader == nil {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.reader = nil
+	return nil
+}
+
+// treeDir is an open directory, which implements fs.ReadDirFile
+type treeDir struct {
+	name    string
+	info    *nodeFileInfo
+	entries []fs.DirEntry
+	offset  int
+	closed  bool
+}
+
+func (d *treeDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *treeDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: ErrIsDir}
+}
+
+func (d *treeDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: fs.ErrClosed}
+	}
+	rest := d.entries[d.offset:]
+	if count <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.offset += count
+	return rest[:count], nil
+}
+
+func (d *treeDir) Close() error {
+	if d.closed {
+		return &fs.PathError{Op: "close", Path: d.name, Err: fs.ErrClosed}
+	}
+	d.closed = true
+	return nil
+}
@@ -0,0 +1,123 @@
+package git
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"text/template"
+)
+
+func TestTreeFS(t *testing.T) {
+	dir := t.TempDir()
+	initRepo(t, dir)
+	writeFile(t, dir, "README", "hello\n")
+	writeFile(t, dir, "a.b", "sorts before a/\n")
+	writeFile(t, dir, "a/x.txt", "x\n")
+	writeFile(t, dir, "a/b/page.tmpl", "{{define \"page\"}}<p>{{.}}</p>{{end}}")
+	writeFile(t, dir, "tool", "#!/bin/sh\n")
+	os.Chmod(filepath.Join(dir, "tool"), 0755)
+	os.Symlink("a/x.txt", filepath.Join(dir, "link"))
+	os.Symlink("b", filepath.Join(dir, "a/bdir"))
+	gitCmd(t, dir, "", "add", ".")
+	gitCmd(t, dir, "", "commit", "-q", "-m", "base")
+
+	g, err := Open(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeFS := func() fs.FS {
+		tree, err := g.peelToTree(mustRev(t, g, "HEAD"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tree.FS()
+	}
+
+	err = fstest.TestFS(treeFS(), "README", "a.b", "a/x.txt",
+		"a/b/page.tmpl", "tool", "link")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fstest expects every entry to open, which a dangling link won't
+	os.Symlink("../outside", filepath.Join(dir, "dangling"))
+	gitCmd(t, dir, "", "add", ".")
+	gitCmd(t, dir, "", "commit", "-q", "-m", "dangling")
+	fsys := treeFS()
+
+	var walked []string
+	fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, p)
+		return nil
+	})
+	expect := ". README a a/b a/b/page.tmpl a/bdir a/x.txt a.b dangling link tool"
+	if got := strings.Join(walked, " "); got != expect {
+		t.Errorf("walked %q, expected %q", got, expect)
+	}
+
+	data, err := fs.ReadFile(fsys, "link")
+	if err != nil || string(data) != "x\n" {
+		t.Errorf("read through symlink: %q %v", data, err)
+	}
+	if _, err := fsys.Open("dangling"); !os.IsNotExist(err) {
+		t.Errorf("expected a link outside the tree to not exist, got %v", err)
+	}
+	fi, err := fs.Stat(fsys, "tool")
+	if err != nil || fi.Mode() != 0755 {
+		t.Errorf("expected tool to be executable, got %v %v", fi, err)
+	}
+
+	tmpl, err := template.ParseFS(fsys, "a/bdir/*.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	tmpl.ExecuteTemplate(&out, "page", "hi")
+	if out.String() != "<p>hi</p>" {
+		t.Errorf("template gave %q", out.String())
+	}
+
+	srv := httptest.NewServer(http.FileServer(http.FS(fsys)))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/a/x.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.ContentLength != 2 {
+		t.Errorf("GET /a/x.txt: %s, length %d", resp.Status, resp.ContentLength)
+	}
+}
+
+func TestTreeFSSubmodule(t *testing.T) {
+	// a repository that can't be written to
+	g := New()
+	m := newMemStore(g)
+	var commit Ptr
+	payload, err := EncodeTree([]*Node{{Name: "lib", Perm: ModeSubmodule, Ref: commit}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := m.add(ObjTree, string(payload))
+	tree, err := g.peelToTree(&root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := fs.Sub(tree.FS(), "lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fs.ReadDir(sub, ".")
+	if err != nil || len(entries) != 0 {
+		t.Errorf("submodule has %d entries, %v", len(entries), err)
+	}
+}
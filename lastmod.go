@@ -0,0 +1,198 @@
+package git
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// LastModified finds, for each entry of a directory in a commit's
+// tree, the committer time of the last commit that changed it; that
+// is, of the commit "git log -1 -- dir/name" would show.  The whole
+// directory costs one walk of the history
+func (g *Git) LastModified(rev *Ptr, dir string) (map[string]time.Time, error) {
+	c, err := g.peelToCommit(rev)
+	if err != nil {
+		return nil, err
+	}
+	w := &lastModWalk{
+		repo:    g,
+		dir:     strings.Trim(dir, "/"),
+		trees:   make(map[Ptr]*Tree),
+		pending: make(map[Ptr][]string),
+	}
+	top, err := w.dirTree(c)
+	if err != nil {
+		return nil, err
+	}
+	if top == nil {
+		return nil, ErrNoEntry
+	}
+	times := make(map[string]time.Time, len(top.list))
+	if len(top.list) == 0 {
+		return times, nil
+	}
+	w.pending[c.name] = append([]string(nil), top.list...)
+	w.queue.put(c)
+	for w.queue.Len() > 0 {
+		if err := w.step(times); err != nil {
+			return nil, err
+		}
+	}
+	return times, nil
+}
+
+// lastModWalk follows each entry of a directory back through the
+// history, the way "git log" simplifies it for a path: through a
+// merge, an entry follows the first parent that has it unchanged,
+// and the first commit that it doesn't pass through unchanged is the
+// one that changed it.  Entries going the same way are taken
+// together, so each commit is looked at once
+type lastModWalk struct {
+	repo    *Git
+	dir     string
+	trees   map[Ptr]*Tree    // the directory in each commit
+	pending map[Ptr][]string // entries yet to be placed, by commit
+	queue   commitQueue
+}
+
+// dirTree returns the directory in a commit, or nil if there is no
+// such directory
+func (w *lastModWalk) dirTree(c *Commit) (*Tree, error) {
+	if t, ok := w.trees[c.name]; ok {
+		return t, nil
+	}
+	t, err := w.repo.peelToTree(&c.Tree)
+	if err != nil {
+		return nil, err
+	}
+	if w.dir != "" {
+		n := t.Walk(w.dir)
+		if n == nil || !n.IsDir() {
+			t = nil
+		} else if t, err = w.repo.peelToTree(&n.Ref); err != nil {
+			return nil, err
+		}
+	}
+	w.trees[c.name] = t
+	return t, nil
+}
+
+func (w *lastModWalk) step(times map[string]time.Time) error {
+	c := w.queue.get()
+	names := w.pending[c.name]
+	delete(w.pending, c.name)
+	cur, err := w.dirTree(c)
+	if err != nil {
+		return err
+	}
+
+	parents := make([]*Commit, len(c.Parents))
+	trees := make([]*Tree, len(c.Parents))
+	for i := range c.Parents {
+		parents[i], err = w.repo.loadCommitPtr(&c.Parents[i])
+		if err != nil {
+			return err
+		}
+		trees[i], err = w.dirTree(parents[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		n := cur.contents[name]
+		same := -1
+		for i, t := range trees {
+			if t == nil {
+				continue
+			}
+			if pn := t.contents[name]; pn != nil && pn.Perm == n.Perm && pn.Ref == n.Ref {
+				same = i
+				break
+			}
+		}
+		if same < 0 {
+			times[name] = commitTime(c)
+			continue
+		}
+		p := parents[same]
+		if _, ok := w.pending[p.name]; !ok {
+			w.queue.put(p)
+		}
+		w.pending[p.name] = append(w.pending[p.name], name)
+	}
+	return nil
+}
+
+// modTimes remembers LastModified for the directories of a commit,
+// as they are asked for
+type modTimes struct {
+	repo   *Git
+	commit Ptr
+	lock   sync.Mutex
+	dirs   map[string]map[string]time.Time
+}
+
+func newModTimes(c *Commit) *modTimes {
+	return &modTimes{
+		repo:   c.repo,
+		commit: c.name,
+		dirs:   make(map[string]map[string]time.Time),
+	}
+}
+
+// get returns the time for a path; the top directory was last
+// changed when anything in it was
+func (m *modTimes) get(p string) time.Time {
+	p = strings.Trim(p, "/")
+	if p == "" || p == "." {
+		var last time.Time
+		for _, t := range m.dir("") {
+			if t.After(last) {
+				last = t
+			}
+		}
+		return last
+	}
+	dir, name := path.Split(p)
+	return m.dir(strings.TrimSuffix(dir, "/"))[name]
+}
+
+func (m *modTimes) dir(dir string) map[string]time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if times, ok := m.dirs[dir]; ok {
+		return times
+	}
+	times, err := m.repo.LastModified(&m.commit, dir)
+	if err != nil {
+		log.Error("Failed: %s", err)
+	}
+	m.dirs[dir] = times
+	return times
+}
+
+// VFS is like the VFS of the commit's tree, except that ModTime is
+// the time each file was last changed (see LastModified)
+func (c *Commit) VFS() (vfs.FileSystem, error) {
+	t, err := c.repo.peelToTree(&c.Tree)
+	if err != nil {
+		return nil, err
+	}
+	return &gitFS{root: t, times: newModTimes(c)}, nil
+}
+
+// FS is like the FS of the commit's tree, except that ModTime is the
+// time each file was last changed (see LastModified)
+func (c *Commit) FS() (fs.FS, error) {
+	t, err := c.repo.peelToTree(&c.Tree)
+	if err != nil {
+		return nil, err
+	}
+	return &treeFS{root: t, times: newModTimes(c)}, nil
+}
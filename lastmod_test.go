@@ -0,0 +1,146 @@
+package git
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLastModified(t *testing.T) {
+	dir := t.TempDir()
+	when := 1500000000
+	commit := func(msg string) {
+		when += 100
+		env := []string{"GIT_COMMITTER_DATE=" + strconv.Itoa(when) + " +0000"}
+		gitCmdEnv(t, dir, env, "", "add", "-A")
+		gitCmdEnv(t, dir, env, "", "commit", "-q", "-m", msg)
+	}
+	initRepo(t, dir)
+	writeFile(t, dir, "a", "a\n")
+	writeFile(t, dir, "b", "b\n")
+	writeFile(t, dir, "dir/x", "x\n")
+	writeFile(t, dir, "dir/y", "y\n")
+	writeFile(t, dir, "dir/z", "z\n")
+	commit("base")
+	writeFile(t, dir, "a", "a2\n")
+	commit("change a")
+	gitCmd(t, dir, "", "checkout", "-q", "-b", "side")
+	writeFile(t, dir, "dir/x", "x2\n")
+	writeFile(t, dir, "c", "c\n")
+	commit("change dir/x, add c")
+	writeFile(t, dir, "dir/z", "z2\n")
+	commit("change dir/z")
+	gitCmd(t, dir, "", "checkout", "-q", "main")
+	writeFile(t, dir, "b", "b2\n")
+	commit("change b")
+	writeFile(t, dir, "dir/z", "z2\n")
+	commit("the same change to dir/z")
+	when += 100
+	gitCmdEnv(t, dir, []string{"GIT_COMMITTER_DATE=" + strconv.Itoa(when) + " +0000"},
+		"", "merge", "-q", "--no-ff", "-m", "merge", "side")
+	os.Chmod(filepath.Join(dir, "dir/y"), 0755)
+	commit("make dir/y executable")
+
+	g, err := Open(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := mustRev(t, g, "HEAD")
+	expected := func(p string) time.Time {
+		out := gitCmd(t, dir, "", "log", "-1", "--format=%ct", "--", p)
+		sec, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Unix(sec, 0)
+	}
+
+	for _, d := range []string{"", "dir"} {
+		times, err := g.LastModified(head, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := g.peelToTree(head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != "" {
+			tree = tree.subtree(tree.Walk(d))
+		}
+		if len(times) != len(tree.list) {
+			t.Errorf("%q: got %d times for %d entries", d, len(times), len(tree.list))
+		}
+		for _, name := range tree.list {
+			p := path.Join(d, name)
+			if want := expected(p); !times[name].Equal(want) {
+				t.Errorf("%s: got %s, expected %s", p, times[name], want)
+			}
+		}
+	}
+
+	c, err := g.loadCommitPtr(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := c.FS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := fs.Stat(fsys, "dir/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(expected("dir/x")) {
+		t.Errorf("Stat(dir/x): got %s", fi.ModTime())
+	}
+	if fi, _ := fs.Stat(fsys, "."); !fi.ModTime().Equal(expected(".")) {
+		t.Errorf("Stat(.): got %s", fi.ModTime())
+	}
+	sub, err := fs.Sub(fsys, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fs.ReadDir(sub, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		fi, _ := e.Info()
+		if want := expected("dir/" + e.Name()); !fi.ModTime().Equal(want) {
+			t.Errorf("Sub(dir) %s: got %s, expected %s", e.Name(), fi.ModTime(), want)
+		}
+	}
+
+	vfs, err := c.VFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lst, err := vfs.ReadDir("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range lst {
+		if want := expected("dir/" + fi.Name()); !fi.ModTime().Equal(want) {
+			t.Errorf("VFS dir/%s: got %s, expected %s", fi.Name(), fi.ModTime(), want)
+		}
+	}
+
+	srv := httptest.NewServer(http.FileServer(http.FS(fsys)))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	want := expected("a").UTC().Format(http.TimeFormat)
+	if got := resp.Header.Get("Last-Modified"); got != want {
+		t.Errorf("Last-Modified: got %q, expected %q", got, want)
+	}
+}
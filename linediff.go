@@ -0,0 +1,336 @@
+package git
+
+import (
+	"bytes"
+	"sort"
+)
+
+type DiffAlgorithm int
+
+const (
+	MyersDiff = DiffAlgorithm(iota)
+	PatienceDiff
+	HistogramDiff
+)
+
+func (a DiffAlgorithm) String() string {
+	switch a {
+	case MyersDiff:
+		return "myers"
+	case PatienceDiff:
+		return "patience"
+	case HistogramDiff:
+		return "histogram"
+	default:
+		return "?"
+	}
+}
+
+// splitLines cuts data into lines, each including its '\n' (except
+// perhaps the last)
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		k := bytes.IndexByte(data, '\n')
+		if k < 0 {
+			lines = append(lines, string(data))
+			break
+		}
+		lines = append(lines, string(data[:k+1]))
+		data = data[k+1:]
+	}
+	return lines
+}
+
+// lineDiff holds the two sides of a line diff, with each distinct
+// line replaced by a number, and marks which lines were deleted
+// from a and inserted into b.  This is the same representation
+// git's xdiff uses
+type lineDiff struct {
+	a, b     []int
+	del, ins []bool
+}
+
+func newLineDiff(a, b []string) *lineDiff {
+	ids := make(map[string]int)
+	intern := func(lst []string) []int {
+		out := make([]int, len(lst))
+		for i, s := range lst {
+			id, ok := ids[s]
+			if !ok {
+				id = len(ids)
+				ids[s] = id
+			}
+			out[i] = id
+		}
+		return out
+	}
+	return &lineDiff{
+		a:   intern(a),
+		b:   intern(b),
+		del: make([]bool, len(a)),
+		ins: make([]bool, len(b)),
+	}
+}
+
+// diffLines compares two lists of lines, returning which lines of a
+// were deleted and which lines of b were inserted
+func diffLines(a, b []string, alg DiffAlgorithm) (del, ins []bool) {
+	d := newLineDiff(a, b)
+	switch alg {
+	case PatienceDiff:
+		d.patience(0, len(a), 0, len(b))
+	case HistogramDiff:
+		d.histogram(0, len(a), 0, len(b))
+	default:
+		d.myers(0, len(a), 0, len(b))
+	}
+	return d.del, d.ins
+}
+
+// trim narrows a range by removing the common prefix and suffix
+func (d *lineDiff) trim(a0, a1, b0, b1 int) (int, int, int, int) {
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		a0++
+		b0++
+	}
+	for a0 < a1 && b0 < b1 && d.a[a1-1] == d.b[b1-1] {
+		a1--
+		b1--
+	}
+	return a0, a1, b0, b1
+}
+
+// trivial handles ranges where one side is empty, returning true if
+// it did
+func (d *lineDiff) trivial(a0, a1, b0, b1 int) bool {
+	if a0 == a1 {
+		for j := b0; j < b1; j++ {
+			d.ins[j] = true
+		}
+		return true
+	}
+	if b0 == b1 {
+		for i := a0; i < a1; i++ {
+			d.del[i] = true
+		}
+		return true
+	}
+	return false
+}
+
+// myers is the classic O(ND) algorithm, finding a shortest edit
+// script for the given ranges.  This is the linear space variant:
+// find the middle snake of an optimal path, and recurse on each
+// side of it
+func (d *lineDiff) myers(a0, a1, b0, b1 int) {
+	a0, a1, b0, b1 = d.trim(a0, a1, b0, b1)
+	if d.trivial(a0, a1, b0, b1) {
+		return
+	}
+	x, y, u, v := d.middleSnake(a0, a1, b0, b1)
+	d.myers(a0, x, b0, y)
+	d.myers(u, a1, v, b1)
+}
+
+// middleSnake returns the start and end of the diagonal in the
+// middle of a shortest edit path, by searching forward from the
+// start and backward from the end until the two meet.  Since the
+// ranges have been trimmed, the edit distance is at least 2, so
+// both halves are smaller problems
+func (d *lineDiff) middleSnake(a0, a1, b0, b1 int) (int, int, int, int) {
+	n, m := a1-a0, b1-b0
+	max := n + m
+	delta := n - m
+	odd := delta%2 != 0
+	off := 2*max + 2
+	// the furthest x reached on each diagonal k = x-y, going
+	// forward and going backward
+	vf := make([]int, 4*max+5)
+	vb := make([]int, 4*max+5)
+	vf[off+1] = 0
+	vb[off+delta-1] = n
+
+	for dist := 0; dist <= (max+1)/2; dist++ {
+		for k := -dist; k <= dist; k += 2 {
+			var x int
+			if k == -dist || (k != dist && vf[off+k-1] < vf[off+k+1]) {
+				x = vf[off+k+1] // down: an insertion
+			} else {
+				x = vf[off+k-1] + 1 // right: a deletion
+			}
+			y := x - k
+			xs, ys := x, y
+			for x < n && y < m && d.a[a0+x] == d.b[b0+y] {
+				x++
+				y++
+			}
+			vf[off+k] = x
+			if odd && k >= delta-(dist-1) && k <= delta+(dist-1) && x >= vb[off+k] {
+				return a0 + xs, b0 + ys, a0 + x, b0 + y
+			}
+		}
+		for k := delta - dist; k <= delta+dist; k += 2 {
+			var x int
+			if k == delta+dist || (k != delta-dist && vb[off+k+1]-1 >= vb[off+k-1]) {
+				x = vb[off+k-1] // up: an insertion
+			} else {
+				x = vb[off+k+1] - 1 // left: a deletion
+			}
+			y := x - k
+			xe, ye := x, y
+			for x > 0 && y > 0 && d.a[a0+x-1] == d.b[b0+y-1] {
+				x--
+				y--
+			}
+			vb[off+k] = x
+			if !odd && k >= -dist && k <= dist && x <= vf[off+k] {
+				return a0 + x, b0 + y, a0 + xe, b0 + ye
+			}
+		}
+	}
+	panic("no middle snake") // can't happen
+}
+
+// patience matches up lines which occur exactly once on each side,
+// keeps the longest run of them that is in the same order on both
+// sides, and recurses between them
+func (d *lineDiff) patience(a0, a1, b0, b1 int) {
+	a0, a1, b0, b1 = d.trim(a0, a1, b0, b1)
+	if d.trivial(a0, a1, b0, b1) {
+		return
+	}
+
+	type occurrence struct {
+		countA, countB int
+		posA, posB     int
+	}
+	occ := make(map[int]*occurrence)
+	for i := a0; i < a1; i++ {
+		o := occ[d.a[i]]
+		if o == nil {
+			o = &occurrence{}
+			occ[d.a[i]] = o
+		}
+		o.countA++
+		o.posA = i
+	}
+	for j := b0; j < b1; j++ {
+		if o := occ[d.b[j]]; o != nil {
+			o.countB++
+			o.posB = j
+		}
+	}
+	var uniq [][2]int
+	for i := a0; i < a1; i++ {
+		o := occ[d.a[i]]
+		if o.countA == 1 && o.countB == 1 {
+			uniq = append(uniq, [2]int{i, o.posB})
+		}
+	}
+	if len(uniq) == 0 {
+		d.myers(a0, a1, b0, b1)
+		return
+	}
+
+	anchors := longestIncreasing(uniq)
+	prevA, prevB := a0, b0
+	for _, an := range anchors {
+		d.patience(prevA, an[0], prevB, an[1])
+		prevA, prevB = an[0]+1, an[1]+1
+	}
+	d.patience(prevA, a1, prevB, b1)
+}
+
+// longestIncreasing finds the longest subsequence of pairs (already
+// increasing in the first element) which is also increasing in the
+// second, using patience sorting
+func longestIncreasing(pairs [][2]int) [][2]int {
+	var tops []int // index into pairs of the top card of each pile
+	prev := make([]int, len(pairs))
+	for i, p := range pairs {
+		k := sort.Search(len(tops), func(t int) bool {
+			return pairs[tops[t]][1] > p[1]
+		})
+		if k > 0 {
+			prev[i] = tops[k-1]
+		} else {
+			prev[i] = -1
+		}
+		if k == len(tops) {
+			tops = append(tops, i)
+		} else {
+			tops[k] = i
+		}
+	}
+	out := make([][2]int, len(tops))
+	for i, k := len(tops)-1, tops[len(tops)-1]; i >= 0; i, k = i-1, prev[k] {
+		out[i] = pairs[k]
+	}
+	return out
+}
+
+// lines that occur more often than this are not used as anchors by
+// the histogram algorithm (the same limit as git)
+const maxHistogramChain = 64
+
+// histogram is like patience, but instead of requiring unique lines
+// it anchors on the longest common region containing the rarest
+// lines, which copes better with repetitive content
+func (d *lineDiff) histogram(a0, a1, b0, b1 int) {
+	a0, a1, b0, b1 = d.trim(a0, a1, b0, b1)
+	if d.trivial(a0, a1, b0, b1) {
+		return
+	}
+
+	where := make(map[int][]int)
+	for i := a0; i < a1; i++ {
+		where[d.a[i]] = append(where[d.a[i]], i)
+	}
+
+	bestLen, bestCount := 0, maxHistogramChain+1
+	var bestA, bestB int
+	for j := b0; j < b1; {
+		next := j + 1
+		occ := where[d.b[j]]
+		if len(occ) == 0 || len(occ) > bestCount {
+			j = next
+			continue
+		}
+		for _, i := range occ {
+			// extend the match in both directions
+			as, bs := i, j
+			for as > a0 && bs > b0 && d.a[as-1] == d.b[bs-1] {
+				as--
+				bs--
+			}
+			ae, be := i+1, j+1
+			for ae < a1 && be < b1 && d.a[ae] == d.b[be] {
+				ae++
+				be++
+			}
+			// how rare is the rarest line in the region?
+			count := len(occ)
+			for k := as; k < ae; k++ {
+				if c := len(where[d.a[k]]); c < count {
+					count = c
+				}
+			}
+			if count < bestCount || (count == bestCount && ae-as > bestLen) {
+				bestLen, bestCount = ae-as, count
+				bestA, bestB = as, bs
+			}
+			if be > next {
+				next = be
+			}
+		}
+		j = next
+	}
+
+	if bestLen == 0 {
+		d.myers(a0, a1, b0, b1)
+		return
+	}
+	d.histogram(a0, bestA, b0, bestB)
+	d.histogram(bestA+bestLen, a1, bestB+bestLen, b1)
+}
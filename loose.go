@@ -8,11 +8,15 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	"sync"
 )
 
 type GitDir struct {
-	owner *Git
-	Dir   string
+	owner      *Git
+	Dir        string
+	packedLock sync.Mutex
+	packedRefs *packedRefs
 }
 
 func Bare(g *Git, d string) (*GitDir, error) {
@@ -94,6 +98,79 @@ func (g *GitDir) Get(p *Ptr) GitObject {
 	}
 }
 
+// FindPrefix returns the names of the loose objects which start
+// with the given (lower case) hex digits.  The prefix must be at
+// least two digits long
+func (g *GitDir) FindPrefix(prefix string) []Ptr {
+	if len(prefix) < 2 {
+		return nil
+	}
+	lst, err := ioutil.ReadDir(path.Join(g.Dir, "objects", prefix[:2]))
+	if err != nil {
+		return nil
+	}
+	var found []Ptr
+	for _, fi := range lst {
+		full := prefix[:2] + fi.Name()
+		if !strings.HasPrefix(full, prefix) {
+			continue
+		}
+		if p, ok := ParsePtr(full); ok {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+// Put writes a loose object into the objects directory, in the
+// same format git uses: the preamble and payload, zlib compressed,
+// in objects/xx/yyyy...  The object is written to a temporary file
+// and renamed into place, so readers never see a partial object.
+func (g *GitDir) Put(t ObjType, payload []byte) (Ptr, error) {
+	p := HashObject(t, payload)
+	h := hex.EncodeToString(p.hash[:])
+	dir := path.Join(g.Dir, "objects", h[:2])
+	f := path.Join(dir, h[2:])
+
+	if _, err := os.Stat(f); err == nil {
+		// already have it
+		return p, nil
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return Ptr{}, err
+	}
+	tmp, err := ioutil.TempFile(dir, "tmp_obj_")
+	if err != nil {
+		return Ptr{}, err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	z := zlib.NewWriter(tmp)
+	z.Write(preamble(t, len(payload)))
+	z.Write(payload)
+	err = z.Close()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return Ptr{}, err
+	}
+	err = os.Chmod(tmp.Name(), 0444)
+	if err != nil {
+		return Ptr{}, err
+	}
+	err = os.Rename(tmp.Name(), f)
+	if err != nil {
+		return Ptr{}, err
+	}
+	return p, nil
+}
+
 /*func (g *Git) Get(p *Ptr) (io.ReadCloser, error) {
 	h := hex.EncodeToString(p.hash[:])
 	f := path.Join(g.Dir, "objects", h[:2], h[2:])
@@ -117,3 +194,27 @@ type ObjFile struct {
 	raw *os.File
 	unz io.ReadCloser
 }
+
+// writeLocked replaces a file the way git does, by writing a ".lock"
+// file next to it and renaming that into place.  It fails if the
+// lock file already exists, as when git is in the middle of writing
+func writeLocked(file string, data []byte) error {
+	lock := file + ".lock"
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(lock, file)
+	}
+	if err != nil {
+		os.Remove(lock)
+	}
+	return err
+}
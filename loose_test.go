@@ -0,0 +1,47 @@
+package git
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPutLooseObject(t *testing.T) {
+	dir := t.TempDir()
+	gitCmd(t, dir, "", "init", "-q", "--bare")
+
+	g, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "hello, world\n"
+	p, err := g.Put(ObjBlob, []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.TrimSpace(gitCmd(t, dir, content, "hash-object", "--stdin"))
+	if p.String() != want {
+		t.Fatalf("expected %s, got %s", want, &p)
+	}
+	if got := gitCmd(t, dir, "", "cat-file", "blob", p.String()); got != content {
+		t.Fatalf("git read back %q", got)
+	}
+
+	// writing it again is harmless
+	if _, err := g.Put(ObjBlob, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := g.Get(&p).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := o.(*Blob); !ok || b.Value() != content {
+		t.Fatalf("read back %#v", o)
+	}
+
+	tmps, _ := filepath.Glob(filepath.Join(dir, "objects", "*", "tmp_obj_*"))
+	if len(tmps) != 0 {
+		t.Fatalf("left temporary files %v", tmps)
+	}
+}
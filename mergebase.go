@@ -0,0 +1,335 @@
+package git
+
+import (
+	"container/heap"
+	"errors"
+	"time"
+)
+
+// commitQueue is a priority queue of commits, newest (by committer
+// date) first; commits with the same date come out in the order
+// they went in
+type commitQueue struct {
+	items []queuedCommit
+	seq   int
+}
+
+type queuedCommit struct {
+	c   *Commit
+	at  time.Time
+	seq int
+}
+
+func (q *commitQueue) Len() int {
+	return len(q.items)
+}
+
+func (q *commitQueue) Less(i, j int) bool {
+	a, b := &q.items[i], &q.items[j]
+	if !a.at.Equal(b.at) {
+		return a.at.After(b.at)
+	}
+	return a.seq < b.seq
+}
+
+func (q *commitQueue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+}
+
+func (q *commitQueue) Push(x interface{}) {
+	q.items = append(q.items, x.(queuedCommit))
+}
+
+func (q *commitQueue) Pop() interface{} {
+	n := len(q.items)
+	x := q.items[n-1]
+	q.items = q.items[:n-1]
+	return x
+}
+
+func (q *commitQueue) put(c *Commit) {
+	heap.Push(q, queuedCommit{c: c, at: commitTime(c), seq: q.seq})
+	q.seq++
+}
+
+func (q *commitQueue) get() *Commit {
+	return heap.Pop(q).(queuedCommit).c
+}
+
+func commitTime(c *Commit) time.Time {
+	if c.Committer == nil {
+		return time.Time{}
+	}
+	return c.Committer.Timestamp
+}
+
+// flags used while painting the commit graph
+const (
+	paintParent1 = 1 << iota
+	paintParent2
+	paintStale
+	paintResult
+)
+
+// paintDownToCommon walks back from one and twos at the same time,
+// the way git's merge-base does, and returns the commits reachable
+// from both sides that are not ancestors of other such commits
+// found earlier in the walk.  The result may still contain
+// redundant commits (ones that are ancestors of others) when clocks
+// are skewed; see removeRedundant
+func (g *Git) paintDownToCommon(one *Commit, twos []*Commit) ([]*Commit, error) {
+	flags := make(map[Ptr]int)
+	q := &commitQueue{}
+
+	flags[one.name] |= paintParent1
+	q.put(one)
+	for _, c := range twos {
+		flags[c.name] |= paintParent2
+		q.put(c)
+	}
+
+	// the queue still has something that could lead to a new result
+	stillInteresting := func() bool {
+		for _, item := range q.items {
+			if flags[item.c.name]&paintStale == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	var result []*Commit
+	for q.Len() > 0 && stillInteresting() {
+		c := q.get()
+		f := flags[c.name] & (paintParent1 | paintParent2 | paintStale)
+		if f == paintParent1|paintParent2 {
+			if flags[c.name]&paintResult == 0 {
+				flags[c.name] |= paintResult
+				result = append(result, c)
+			}
+			// anything beyond a common ancestor is not best
+			f |= paintStale
+		}
+		for i := range c.Parents {
+			p := &c.Parents[i]
+			if flags[*p]&f == f {
+				continue
+			}
+			pc, err := g.loadCommitPtr(p)
+			if err != nil {
+				return nil, err
+			}
+			flags[*p] |= f
+			q.put(pc)
+		}
+	}
+
+	// drop anything that was later found to be an ancestor of
+	// another result
+	best := result[:0]
+	for _, c := range result {
+		if flags[c.name]&paintStale == 0 {
+			best = append(best, c)
+		}
+	}
+	return best, nil
+}
+
+// mergeBases returns the best common ancestors of one and all of
+// twos, like "git merge-base --all"
+func (g *Git) mergeBases(one *Commit, twos []*Commit) ([]*Commit, error) {
+	for _, c := range twos {
+		if c.name == one.name {
+			return []*Commit{one}, nil
+		}
+	}
+	lst, err := g.paintDownToCommon(one, twos)
+	if err != nil {
+		return nil, err
+	}
+	return g.removeRedundant(lst)
+}
+
+// removeRedundant drops any commit that is an ancestor of another
+// commit in the list
+func (g *Git) removeRedundant(lst []*Commit) ([]*Commit, error) {
+	if len(lst) <= 1 {
+		return lst, nil
+	}
+	var out []*Commit
+	for i, c := range lst {
+		var others []*Commit
+		for j, o := range lst {
+			if j != i && o.name != c.name {
+				others = append(others, o)
+			}
+		}
+		common, err := g.paintDownToCommon(c, others)
+		if err != nil {
+			return nil, err
+		}
+		// if c is reachable from one of the others, it is its
+		// own (only) best common ancestor with them
+		redundant := false
+		for _, x := range common {
+			if x.name == c.name {
+				redundant = true
+			}
+		}
+		if !redundant {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+var ErrNoForkPoint = errors.New("no fork point")
+
+// loadCommits peels each of the given objects to a commit
+func (g *Git) loadCommits(lst []Ptr) ([]*Commit, error) {
+	out := make([]*Commit, len(lst))
+	for i := range lst {
+		c, err := g.peelToCommit(&lst[i])
+		if err != nil {
+			return nil, err
+		}
+		out[i] = c
+	}
+	return out, nil
+}
+
+func commitNames(lst []*Commit) []Ptr {
+	out := make([]Ptr, len(lst))
+	for i, c := range lst {
+		out[i] = c.name
+	}
+	return out
+}
+
+// MergeBase returns all the best common ancestors of a and the
+// others, like "git merge-base --all a b...".  With more than one
+// other commit, this is the merge base of a and a hypothetical
+// merge of all the others.  The result is empty if the histories
+// are unrelated
+func (g *Git) MergeBase(a Ptr, b ...Ptr) ([]Ptr, error) {
+	one, err := g.peelToCommit(&a)
+	if err != nil {
+		return nil, err
+	}
+	twos, err := g.loadCommits(b)
+	if err != nil {
+		return nil, err
+	}
+	bases, err := g.mergeBases(one, twos)
+	if err != nil {
+		return nil, err
+	}
+	return commitNames(bases), nil
+}
+
+// IsAncestor returns true if a is reachable from b, which includes
+// the case where they are the same commit.  In other words, a
+// branch at a could be fast-forwarded to b
+func (g *Git) IsAncestor(a, b Ptr) (bool, error) {
+	ca, err := g.peelToCommit(&a)
+	if err != nil {
+		return false, err
+	}
+	cb, err := g.peelToCommit(&b)
+	if err != nil {
+		return false, err
+	}
+	if ca.name == cb.name {
+		return true, nil
+	}
+	common, err := g.paintDownToCommon(ca, []*Commit{cb})
+	if err != nil {
+		return false, err
+	}
+	for _, c := range common {
+		if c.name == ca.name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Independent returns the commits from the list which are not
+// reachable from any of the others, like "git merge-base
+// --independent"
+func (g *Git) Independent(lst ...Ptr) ([]Ptr, error) {
+	commits, err := g.loadCommits(lst)
+	if err != nil {
+		return nil, err
+	}
+	// ignore duplicates
+	seen := make(map[Ptr]bool)
+	uniq := commits[:0]
+	for _, c := range commits {
+		if !seen[c.name] {
+			seen[c.name] = true
+			uniq = append(uniq, c)
+		}
+	}
+	out, err := g.removeRedundant(uniq)
+	if err != nil {
+		return nil, err
+	}
+	return commitNames(out), nil
+}
+
+// ForkPoint finds the point at which commit forked from the history
+// of the given ref (such as "refs/remotes/origin/main"), taking into
+// account that the ref may have been rewound or rebased since, like
+// "git merge-base --fork-point".  It uses the ref's reflog, and
+// returns ErrNoForkPoint if no entry in it is the fork point
+func (g *Git) ForkPoint(ref string, commit Ptr) (*Ptr, error) {
+	derived, err := g.peelToCommit(&commit)
+	if err != nil {
+		return nil, err
+	}
+	r, err := g.ResolveRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	if r.Unborn {
+		return nil, ErrNoForkPoint
+	}
+	entries, err := g.Reflog(r.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	// every value the ref has had, plus its current value
+	var candidates []*Commit
+	seen := make(map[Ptr]bool)
+	add := func(p Ptr) {
+		if p == (Ptr{}) || seen[p] {
+			return
+		}
+		seen[p] = true
+		c, err := g.peelToCommit(&p)
+		if err != nil {
+			// reflogs may mention commits that have since
+			// been pruned
+			return
+		}
+		candidates = append(candidates, c)
+	}
+	add(r.Ptr)
+	for _, entry := range entries {
+		add(entry.New)
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoForkPoint
+	}
+
+	bases, err := g.mergeBases(derived, candidates)
+	if err != nil {
+		return nil, err
+	}
+	if len(bases) != 1 || !seen[bases[0].name] {
+		return nil, ErrNoForkPoint
+	}
+	return &bases[0].name, nil
+}
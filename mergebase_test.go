@@ -0,0 +1,121 @@
+package git
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMergeBase(t *testing.T) {
+	dir := makeHistoryRepo(t)
+	// make a criss-cross merge, which has two merge bases
+	gitCmd(t, dir, "", "checkout", "-q", "-b", "x1", "main~1")
+	gitCmd(t, dir, "", "merge", "-q", "--no-ff", "-m", "x1", "topic")
+	gitCmd(t, dir, "", "checkout", "-q", "-b", "x2", "topic")
+	gitCmd(t, dir, "", "merge", "-q", "--no-ff", "-m", "x2", "main~1")
+	gitCmd(t, dir, "", "checkout", "-q", "main")
+
+	g, err := Open(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev := func(r string) Ptr {
+		p, err := g.ResolveRevision(r)
+		if err != nil {
+			t.Fatalf("%s: %s", r, err)
+		}
+		return *p
+	}
+	names := func(lst []Ptr) string {
+		var s []string
+		for i := range lst {
+			s = append(s, lst[i].String())
+		}
+		sort.Strings(s)
+		return strings.Join(s, "\n")
+	}
+	sorted := func(out string) string {
+		s := strings.Fields(out)
+		sort.Strings(s)
+		return strings.Join(s, "\n")
+	}
+
+	cases := [][]string{
+		{"main", "topic"},
+		{"x1", "x2"},
+		{"main", "main~2"},
+		{"main", "topic", "x2"},
+	}
+	for _, c := range cases {
+		var others []Ptr
+		for _, r := range c[1:] {
+			others = append(others, rev(r))
+		}
+		got, err := g.MergeBase(rev(c[0]), others...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := sorted(gitCmd(t, dir, "", append([]string{"merge-base", "--all"}, c...)...))
+		if names(got) != want {
+			t.Errorf("%v: got\n%s\nexpected\n%s", c, names(got), want)
+		}
+	}
+
+	anc := []struct {
+		a, b string
+		want bool
+	}{
+		{"main~2", "main", true},
+		{"main", "main", true},
+		{"main", "main~2", false},
+		{"topic", "main", false},
+		{"topic~1", "main", true},
+	}
+	for _, c := range anc {
+		got, err := g.IsAncestor(rev(c.a), rev(c.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("IsAncestor(%s, %s) = %t", c.a, c.b, got)
+		}
+	}
+
+	ind, err := g.Independent(rev("main"), rev("main~1"), rev("topic"), rev("x1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sorted(gitCmd(t, dir, "", "merge-base", "--independent", "main", "main~1", "topic", "x1"))
+	if names(ind) != want {
+		t.Errorf("independent: got\n%s\nexpected\n%s", names(ind), want)
+	}
+}
+
+func TestForkPoint(t *testing.T) {
+	dir := makeHistoryRepo(t)
+	// "upstream" moves forward, a branch forks from it, and then
+	// upstream is rewritten so that the fork point is no longer
+	// part of its history
+	gitCmd(t, dir, "", "branch", "upstream", "main~2")
+	gitCmd(t, dir, "", "update-ref", "-m", "advance", "refs/heads/upstream", "main~1")
+	gitCmd(t, dir, "", "branch", "derived", "upstream")
+	gitCmd(t, dir, "", "update-ref", "-m", "rewind", "refs/heads/upstream", "main~2")
+
+	g, err := Open(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived, err := g.ResolveRevision("derived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := g.ForkPoint("refs/heads/upstream", *derived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.TrimSpace(gitCmd(t, dir, "", "merge-base", "--fork-point", "upstream", "derived"))
+	if p.String() != want {
+		t.Fatalf("fork point %s, expected %s", p, want)
+	}
+}
@@ -1,6 +1,7 @@
 package git
 
 import (
+	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -99,6 +100,23 @@ func (p *Ptr) String() string {
 	return hex.EncodeToString(p.hash[:])
 }
 
+// preamble returns the header that git prepends to an object's
+// payload before hashing (and, for loose objects, compressing) it
+func preamble(t ObjType, size int) []byte {
+	return []byte(fmt.Sprintf("%s %d\x00", t, size))
+}
+
+// HashObject computes the name of an object with the given type and
+// payload
+func HashObject(t ObjType, data []byte) Ptr {
+	h := sha1.New()
+	h.Write(preamble(t, len(data)))
+	h.Write(data)
+	var p Ptr
+	copy(p.hash[:], h.Sum(nil))
+	return p
+}
+
 func objParse(hexref string) (ret Ptr, ok bool) {
 	z, err := hex.DecodeString(hexref)
 	if err != nil {
@@ -161,6 +179,8 @@ func (g *Git) Interpret(n *Ptr, t ObjType, data []byte) (GitObject, error) {
 		return g.loadCommit(n, data)
 	case ObjBlob:
 		return g.loadBlob(n, data)
+	case ObjTag:
+		return g.loadTag(n, data)
 	default:
 		return nil, ErrUnknownObjectType
 	}
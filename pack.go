@@ -1,16 +1,20 @@
 package git
 
 import (
+	"bytes"
 	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
 	"io"
-	"reflect"
+	"io/ioutil"
 	"sort"
-	"unsafe"
+	"strings"
 
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
+	"sync"
 )
 
 type PackFile struct {
@@ -19,11 +23,16 @@ type PackFile struct {
 	Index            string
 	firstLevelFanout [256][4]byte // from the index
 	indexContents    []Ptr
-	indexPtrs        []IndexPtr
-	indexCRCs        []uint32
-	crossRef         map[uint32]int
-	data             *os.File
-	cache            map[int64]*PackedObject
+	indexOffsets     []int64
+	indexCRCs        []uint32 // only in version 2 indexes
+	crossRef         map[int64]int
+	packChecksum     Ptr
+	// the pack is read only with ReadAt, so that it can be shared
+	// by any number of goroutines; lock covers opening it and the
+	// cache
+	lock  sync.Mutex
+	data  *os.File
+	cache map[int64]*PackedObject
 }
 
 func (p *PackFile) GetNamed(RefType, string) *NamedRef {
@@ -31,6 +40,8 @@ func (p *PackFile) GetNamed(RefType, string) *NamedRef {
 }
 
 func (p *PackFile) open() (*os.File, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	if p.data == nil {
 		f, err := os.Open(p.Pack)
 		if err != nil {
@@ -42,12 +53,16 @@ func (p *PackFile) open() (*os.File, error) {
 }
 
 type PackedObject struct {
-	name        Ptr
-	container   *PackFile
-	offset      int64
-	size        int64
-	typecode    ObjType
-	headerlen   uint8
+	name      Ptr
+	container *PackFile
+	offset    int64
+	size      int64
+	typecode  ObjType
+	headerlen uint8
+	// the expanded object, once it has been read; lock covers
+	// these, though not reading them in the first place, so two
+	// goroutines may both do that
+	lock        sync.Mutex
 	dedeltatype ObjType
 	dedelta     []byte
 }
@@ -64,8 +79,11 @@ var ErrUnknownObjectType = errors.New("unknown object type")
 
 func (p *PackFile) newPackedObject(obj *Ptr, at int64) (*PackedObject, error) {
 
-	if p.cache[at] != nil {
-		return p.cache[at], nil
+	p.lock.Lock()
+	po := p.cache[at]
+	p.lock.Unlock()
+	if po != nil {
+		return po, nil
 	}
 
 	data, err := p.open()
@@ -73,16 +91,12 @@ func (p *PackFile) newPackedObject(obj *Ptr, at int64) (*PackedObject, error) {
 		return nil, err
 	}
 
-	data.Seek(at, 0)
-
 	var header [10]byte
-	n, err := data.Read(header[:])
-	if err != nil {
+	n, err := data.ReadAt(header[:], at)
+	if err != nil && (err != io.EOF || n == 0) {
+		// (a tiny object can be near enough to the end)
 		return nil, err
 	}
-	if n != 10 {
-		return nil, fmt.Errorf("only read %d of header", n)
-	}
 
 	var size uint64
 	var typeCode byte
@@ -94,12 +108,15 @@ func (p *PackFile) newPackedObject(obj *Ptr, at int64) (*PackedObject, error) {
 	//fmt.Printf("at %d, size=%d\n", i, size)
 	for (header[i] & 0x80) != 0 {
 		i++
+		if i >= n {
+			return nil, fmt.Errorf("only read %d of header", n)
+		}
 		size += uint64(header[i]&0x7f) << shift
 		shift += 7
 		//fmt.Printf("at %d, size=%d\n", i, size)
 	}
 
-	po := &PackedObject{
+	po = &PackedObject{
 		name:        *obj,
 		container:   p,
 		offset:      at,
@@ -108,6 +125,13 @@ func (p *PackFile) newPackedObject(obj *Ptr, at int64) (*PackedObject, error) {
 		headerlen:   uint8(i + 1),
 		dedeltatype: ObjNone,
 	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// someone else may have got here first
+	if other := p.cache[at]; other != nil {
+		return other, nil
+	}
 	p.cache[at] = po
 	return po, nil
 }
@@ -117,6 +141,14 @@ func (po *PackedObject) Name() *Ptr {
 }
 
 func (po *PackedObject) Type() ObjType {
+	if po.typecode == ObjOffsetDelta || po.typecode == ObjRefDelta {
+		// the type of a delta is the type of its base
+		_, t, err := po.deDeltaifiedBytes(0)
+		if err != nil {
+			return ObjNone
+		}
+		return t
+	}
 	return po.typecode
 }
 
@@ -151,36 +183,38 @@ func (po *PackedObject) Payload() ([]byte, error) {
 	return out, err
 }
 
+// maxDeltaDepth is how long a chain of deltas can be before it is
+// taken to be a cycle, which only ref deltas can make
+const maxDeltaDepth = 4096
+
+var ErrDeltaTooDeep = errors.New("delta chain too long")
+
 func (po *PackedObject) deDeltaifiedBytes(depth int) ([]byte, ObjType, error) {
 
-	if po.dedeltatype != ObjNone {
-		return po.dedelta, po.dedeltatype, nil
+	po.lock.Lock()
+	buf, t := po.dedelta, po.dedeltatype
+	po.lock.Unlock()
+	if t != ObjNone {
+		return buf, t, nil
+	}
+	if depth > maxDeltaDepth {
+		return nil, ObjNone, ErrDeltaTooDeep
 	}
 
 	//log.Info("deDelatify[%d](%s)", depth, &po.name)
 	buf, base, err := po.read()
+	if err != nil {
+		return nil, ObjNone, err
+	}
 	if base == nil {
 		//log.Info("   leaf %s : %d bytes", po.typecode, len(buf))
-		po.dedeltatype = po.typecode
-		po.dedelta = buf
-		return buf, po.typecode, err
+		po.remember(buf, po.typecode)
+		return buf, po.typecode, nil
 	}
 
-	if base.offset == 0 {
-		panic("we only handle offset deltas so far")
-	}
-	p := po.container
-	i, ok := p.crossRef[uint32(base.offset)]
-	if !ok {
-		panic("not a real offset")
-	}
-	baseObj, err := p.newPackedObject(&(p.indexContents[i]), base.offset)
-	if err != nil {
-		return nil, ObjNone, err
-	}
-	baseData, t, err := baseObj.deDeltaifiedBytes(depth + 1)
+	baseData, t, err := po.baseBytes(base, depth)
 	if err != nil {
-		//fmt.Printf("Could not read base object %s!\n", &baseObj.name)
+		//fmt.Printf("Could not read base object %s!\n", base)
 		return nil, ObjNone, err
 	}
 	data, ptr, err := patchDelta(t, baseData, buf)
@@ -194,12 +228,52 @@ func (po *PackedObject) deDeltaifiedBytes(depth int) ([]byte, ObjType, error) {
 	if !ptr.Equals(&po.name) {
 		return nil, ObjNone, ErrDeltaMismatch
 	}
-	po.dedeltatype = t
-	po.dedelta = data
+	po.remember(data, t)
 	return data, t, err
 }
 
+// remember caches the expanded object
+func (po *PackedObject) remember(buf []byte, t ObjType) {
+	po.lock.Lock()
+	po.dedelta, po.dedeltatype = buf, t
+	po.lock.Unlock()
+}
+
 var ErrDeltaMismatch = errors.New("expanded delta name mismatch")
+var ErrBadBaseOffset = errors.New("delta base offset is not an object")
+
+// baseBytes returns the expanded contents of the base of a delta.
+// Offset deltas always refer to something in the same pack, but the
+// base of a ref delta may be anywhere in the repository
+func (po *PackedObject) baseBytes(base *BaseSpec, depth int) ([]byte, ObjType, error) {
+	p := po.container
+
+	if base.name == nil {
+		i, ok := p.crossRef[base.offset]
+		if !ok {
+			return nil, ObjNone, ErrBadBaseOffset
+		}
+		baseObj, err := p.newPackedObject(&(p.indexContents[i]), base.offset)
+		if err != nil {
+			return nil, ObjNone, err
+		}
+		return baseObj.deDeltaifiedBytes(depth + 1)
+	}
+
+	// prefer a copy in this pack, which is the usual case
+	if at := p.find(base.name); at != 0 {
+		baseObj, err := p.newPackedObject(base.name, at)
+		if err != nil {
+			return nil, ObjNone, err
+		}
+		return baseObj.deDeltaifiedBytes(depth + 1)
+	}
+	// which may be in another pack, still counting towards the depth
+	if baseObj, ok := p.repo.Get(base.name).(*PackedObject); ok {
+		return baseObj.deDeltaifiedBytes(depth + 1)
+	}
+	return p.repo.rawObject(base.name)
+}
 
 type BaseSpec struct {
 	name   *Ptr
@@ -209,19 +283,28 @@ type BaseSpec struct {
 func (po *PackedObject) read() ([]byte, *BaseSpec, error) {
 	var base *BaseSpec
 
-	data := po.container.data
-	data.Seek(po.offset+int64(po.headerlen), 0)
+	data, err := po.container.open()
+	if err != nil {
+		return nil, nil, err
+	}
+	start := po.offset + int64(po.headerlen)
 	/*log.Info("<%s>\noffset = %d  headerlen = %d  size = %d  type=%s",
 	&po.name,
 	po.offset,
 	po.headerlen,
 	po.size,
 	po.typecode)*/
-	var chunk [10]byte
-	n, err := data.Read(chunk[:])
+	// big enough for either an offset delta's base offset or a
+	// ref delta's base name
+	var chunk [20]byte
+	n, err := data.ReadAt(chunk[:], start)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
 	h := chunk[:n]
 
-	if po.typecode == ObjOffsetDelta {
+	switch po.typecode {
+	case ObjOffsetDelta:
 		delta_rel_offset, h2 := decodeOffsetDelta(h)
 		/*fmt.Printf("offset delta %d   ; implies offset @%d\n",
 		delta_rel_offset,
@@ -230,12 +313,22 @@ func (po *PackedObject) read() ([]byte, *BaseSpec, error) {
 		base = &BaseSpec{
 			offset: po.offset - delta_rel_offset,
 		}
+	case ObjRefDelta:
+		if len(h) < 20 {
+			return nil, nil, ErrBadDelta
+		}
+		name := &Ptr{}
+		copy(name.hash[:], h[:20])
+		h = h[20:]
+		base = &BaseSpec{
+			name: name,
+		}
 	}
 
-	data.Seek(po.offset+int64(po.headerlen)+10-int64(len(h)), 0)
-	rc, err := zlib.NewReader(data)
+	at := start + int64(n) - int64(len(h))
+	rc, err := zlib.NewReader(io.NewSectionReader(data, at, 1<<62))
 	if err != nil {
-		panic(err)
+		return nil, base, err
 	}
 	defer rc.Close()
 
@@ -281,56 +374,101 @@ func (p *PackFile) find(obj *Ptr) int64 {
 	if a+1 == b {
 		// only one thing in region
 		if obj.Equals(&p.indexContents[a]) {
-			return (&p.indexPtrs[a]).asOffset()
+			return p.indexOffsets[a]
 		}
+		return 0
 	}
 	k := sort.Search(b-a, func(i int) bool {
 		return !obj.Less(&p.indexContents[a+i])
 	})
-	if obj.Equals(&p.indexContents[a+k]) {
-		return (&p.indexPtrs[a+k]).asOffset()
+	if a+k < b && obj.Equals(&p.indexContents[a+k]) {
+		return p.indexOffsets[a+k]
 	}
 	return 0
 }
 
-type IndexPtr [4]byte
-
-func (ip *IndexPtr) asOffset() int64 {
-	u := binary.BigEndian.Uint32((*ip)[:])
-	return int64(u)
-}
-
-type memBlock interface{}
-
-func readRaw(dest memBlock, nbytes int, src *os.File) (int, error) {
-	var raw []byte
-	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&raw))
+// FindPrefix returns the names of the objects in this pack which
+// start with the given (lower case) hex digits
+func (p *PackFile) FindPrefix(prefix string) []Ptr {
+	var low Ptr
+	lowHex := prefix + strings.Repeat("0", 40-len(prefix))
+	hex.Decode(low.hash[:], []byte(lowHex))
 
-	dv := reflect.ValueOf(dest)
-	if dv.Kind() == reflect.Ptr {
-		hdr.Data = dv.Elem().UnsafeAddr()
-	} else if dv.Kind() == reflect.Slice {
-		hdr.Data = dv.Pointer()
+	// the first entry not less than low
+	k := sort.Search(len(p.indexContents), func(i int) bool {
+		return !low.Less(&p.indexContents[i])
+	})
+	var lst []Ptr
+	for ; k < len(p.indexContents); k++ {
+		if !strings.HasPrefix(p.indexContents[k].String(), prefix) {
+			break
+		}
+		lst = append(lst, p.indexContents[k])
 	}
-	hdr.Len = nbytes
-	hdr.Cap = nbytes
-	/*at, _ := src.Seek(0, 1)
-	fmt.Printf("Reading %d bytes at +%d...\n", nbytes, at)*/
-	return src.Read(raw)
+	return lst
 }
 
+const (
+	packIndexSignature = 0xff744f63 // "\377tOc"
+	packIndexVersion   = 2
+	largeOffsetFlag    = 0x80000000
+)
+
+var ErrBadPackIndex = errors.New("corrupt pack index")
+var ErrPackIndexVersion = errors.New("unsupported pack index version")
+var ErrPackIndexChecksum = errors.New("pack index checksum mismatch")
+var ErrPackChecksum = errors.New("pack index does not match pack")
+
+// loadIndex reads the .idx file that goes with the pack.  There are
+// two formats.  Version 1 (which has no header at all) is:
+//
+//	fanout     256 x 4-byte cumulative counts
+//	entries    N x (4-byte offset, 20-byte name)
+//	trailer    pack checksum, index checksum
+//
+// Version 2 starts with the signature "\377tOc" and the version
+// number, and then has:
+//
+//	fanout     256 x 4-byte cumulative counts
+//	names      N x 20-byte names
+//	crcs       N x 4-byte CRC32s of the packed data
+//	offsets    N x 4-byte offsets; if the high bit is set, the rest
+//	           is an index into the large offset table
+//	large      M x 8-byte offsets, for packs over 2GiB
+//	trailer    pack checksum, index checksum
 func (p *PackFile) loadIndex() error {
-	rdr, err := os.Open(p.Index)
+	buf, err := ioutil.ReadFile(p.Index)
 	if err != nil {
 		return err
 	}
-	defer rdr.Close()
+	if len(buf) < 256*4+40 {
+		return ErrBadPackIndex
+	}
 
-	var version, signature uint32
-	binary.Read(rdr, binary.BigEndian, &signature)
-	binary.Read(rdr, binary.BigEndian, &version)
+	// the trailing checksum covers everything before it
+	body := buf[:len(buf)-20]
+	sum := sha1.Sum(body)
+	if !bytes.Equal(sum[:], buf[len(buf)-20:]) {
+		return ErrPackIndexChecksum
+	}
+	copy(p.packChecksum.hash[:], body[len(body)-20:])
+	body = body[:len(body)-20]
 
-	readRaw(&p.firstLevelFanout, 256*4, rdr)
+	version := uint32(1)
+	if binary.BigEndian.Uint32(body) == packIndexSignature {
+		version = binary.BigEndian.Uint32(body[4:])
+		if version != packIndexVersion {
+			return ErrPackIndexVersion
+		}
+		body = body[8:]
+	}
+	if len(body) < 256*4 {
+		return ErrBadPackIndex
+	}
+	for i := range p.firstLevelFanout {
+		copy(p.firstLevelFanout[i][:], body[i*4:])
+	}
+	body = body[256*4:]
 	/*
 		for i, f := range p.firstLevelFanout[:] {
 			fmt.Printf("  [0x%02x] %#x %d\n", i, f[:], binary.BigEndian.Uint32(f[:]))
@@ -338,27 +476,84 @@ func (p *PackFile) loadIndex() error {
 
 	count := int(binary.BigEndian.Uint32(p.firstLevelFanout[255][:]))
 	entries := make([]Ptr, count)
-	crctable := make([]uint32, count)
-	ptrs := make([]IndexPtr, count)
-	crossRef := make(map[uint32]int, count)
+	offsets := make([]int64, count)
+	var crctable []uint32
 
-	readRaw(entries, count*20, rdr)
-	readRaw(crctable, count*4, rdr)
-	readRaw(ptrs, count*4, rdr)
+	if version == 1 {
+		if len(body) != count*24 {
+			return ErrBadPackIndex
+		}
+		for i := 0; i < count; i++ {
+			rec := body[i*24:]
+			offsets[i] = int64(binary.BigEndian.Uint32(rec))
+			copy(entries[i].hash[:], rec[4:24])
+		}
+	} else {
+		if len(body) < count*28 {
+			return ErrBadPackIndex
+		}
+		names := body[:count*20]
+		crcs := body[count*20 : count*24]
+		small := body[count*24 : count*28]
+		large := body[count*28:]
+		if len(large)%8 != 0 {
+			return ErrBadPackIndex
+		}
+		crctable = make([]uint32, count)
+		for i := 0; i < count; i++ {
+			copy(entries[i].hash[:], names[i*20:])
+			crctable[i] = binary.BigEndian.Uint32(crcs[i*4:])
+			off := binary.BigEndian.Uint32(small[i*4:])
+			if off&largeOffsetFlag == 0 {
+				offsets[i] = int64(off)
+				continue
+			}
+			k := int(off &^ largeOffsetFlag)
+			if (k+1)*8 > len(large) {
+				return ErrBadPackIndex
+			}
+			offsets[i] = int64(binary.BigEndian.Uint64(large[k*8:]))
+		}
+	}
 
-	for i := 0; i < count; i++ {
-		offset := binary.BigEndian.Uint32(ptrs[i][:])
+	crossRef := make(map[int64]int, count)
+	for i, offset := range offsets {
 		crossRef[offset] = i
 	}
 
 	/*	for i := 0; i < count; i++ {
-		offset := binary.BigEndian.Uint32(ptrs[i][:])
-		fmt.Printf("  [%d] %s  @%d\n", i, &entries[i], offset)
+		fmt.Printf("  [%d] %s  @%d\n", i, &entries[i], offsets[i])
 	}*/
 	p.indexContents = entries
 	p.indexCRCs = crctable
-	p.indexPtrs = ptrs
+	p.indexOffsets = offsets
 	p.crossRef = crossRef
+	return p.checkPackTrailer()
+}
+
+// checkPackTrailer makes sure the pack's trailing checksum is the
+// one recorded in the index, so we don't use an index with the
+// wrong pack
+func (p *PackFile) checkPackTrailer() error {
+	data, err := p.open()
+	if err != nil {
+		return err
+	}
+	fi, err := data.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < 12+20 {
+		return ErrNotAPack
+	}
+	var trailer Ptr
+	_, err = data.ReadAt(trailer.hash[:], fi.Size()-20)
+	if err != nil {
+		return err
+	}
+	if !trailer.Equals(&p.packChecksum) {
+		return ErrPackChecksum
+	}
 	return nil
 }
 
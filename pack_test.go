@@ -1,6 +1,13 @@
 package git
 
 import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -25,3 +32,245 @@ func TestRelativeDeltaDecoding(t *testing.T) {
 		}
 	}
 }
+
+// gitCmd runs the stock git binary in dir, skipping the test if
+// git is not installed
+func gitCmd(t *testing.T, dir string, stdin string, args ...string) string {
+	return gitCmdEnv(t, dir, nil, stdin, args...)
+}
+
+// gitCmdEnv is like gitCmd, with extra environment settings which
+// override the defaults
+func gitCmdEnv(t *testing.T, dir string, env []string, stdin string, args ...string) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=A U Thor",
+		"GIT_AUTHOR_EMAIL=author@example.com",
+		"GIT_AUTHOR_DATE=1500000000 -0500",
+		"GIT_COMMITTER_NAME=C O Mitter",
+		"GIT_COMMITTER_EMAIL=committer@example.com",
+		"GIT_COMMITTER_DATE=1500000000 -0500",
+		"GIT_CONFIG_NOSYSTEM=1",
+		"HOME="+dir,
+	)
+	cmd.Env = append(cmd.Env, env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// initRepo creates a repository with a work tree in dir, on branch
+// main
+func initRepo(t *testing.T, dir string) {
+	gitCmd(t, dir, "", "init", "-q", "-b", "main")
+}
+
+// writeFile writes a file in a work tree, making the directories it
+// goes in
+func writeFile(t *testing.T, dir, name, body string) {
+	full := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(full, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// makeTestRepo creates a small repository with a couple of similar
+// revisions of a file, so that packing it produces deltas
+func makeTestRepo(t *testing.T) string {
+	dir := t.TempDir()
+	initRepo(t, dir)
+
+	var lines []string
+	for i := 0; i < 200; i++ {
+		lines = append(lines, fmt.Sprintf("line %d of the file", i))
+	}
+	for rev := 0; rev < 3; rev++ {
+		lines[rev*50] = fmt.Sprintf("revision %d", rev)
+		writeFile(t, dir, "file.txt", strings.Join(lines, "\n")+"\n")
+		gitCmd(t, dir, "", "add", "file.txt")
+		gitCmd(t, dir, "", "commit", "-q", "-m", fmt.Sprintf("rev %d", rev))
+	}
+	return dir
+}
+
+func TestRefDeltaPack(t *testing.T) {
+	dir := makeTestRepo(t)
+	objs := gitCmd(t, dir, "", "rev-list", "--objects", "--all")
+
+	// without --delta-base-offset, pack-objects writes REF_DELTAs
+	out := filepath.Join(t.TempDir(), "test")
+	sum := gitCmd(t, dir, objs, "pack-objects", "-q", "--no-reuse-delta", out)
+	pack := out + "-" + strings.TrimSpace(sum) + ".pack"
+
+	g := New()
+	p, err := IncludePackFile(g, pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deltas := 0
+	for _, ptr := range p.indexContents {
+		ptr := ptr
+		po := p.Get(&ptr).(*PackedObject)
+		if po.typecode == ObjRefDelta {
+			deltas++
+		}
+		buf, typ, err := po.deDeltaifiedBytes(0)
+		if err != nil {
+			t.Fatalf("%s: %s", &ptr, err)
+		}
+		want := gitCmd(t, dir, "", "cat-file", typ.String(), ptr.String())
+		if string(buf) != want {
+			t.Fatalf("%s: contents differ", &ptr)
+		}
+	}
+	if deltas == 0 {
+		t.Fatalf("expected some ref deltas in the pack")
+	}
+}
+
+func TestPackIndexVersions(t *testing.T) {
+	dir := makeTestRepo(t)
+	objs := gitCmd(t, dir, "", "rev-list", "--objects", "--all")
+	out := filepath.Join(t.TempDir(), "test")
+	sum := gitCmd(t, dir, objs, "pack-objects", "-q", "--delta-base-offset", out)
+	pack := out + "-" + strings.TrimSpace(sum) + ".pack"
+
+	// version 1, and version 2 with every offset in the large table
+	for _, v := range []string{"1", "2,1"} {
+		gitCmd(t, dir, "", "index-pack", "--index-version="+v, pack)
+
+		g := New()
+		p, err := IncludePackFile(g, pack)
+		if err != nil {
+			t.Fatalf("version %s: %s", v, err)
+		}
+		want := len(strings.Split(strings.TrimSpace(objs), "\n"))
+		if len(p.indexContents) != want {
+			t.Fatalf("version %s: expected %d objects, got %d", v, want, len(p.indexContents))
+		}
+		for _, ptr := range p.indexContents {
+			ptr := ptr
+			buf, typ, err := g.rawObject(&ptr)
+			if err != nil {
+				t.Fatalf("version %s: %s: %s", v, &ptr, err)
+			}
+			want := gitCmd(t, dir, "", "cat-file", typ.String(), ptr.String())
+			if string(buf) != want {
+				t.Fatalf("version %s: %s: contents differ", v, &ptr)
+			}
+		}
+	}
+}
+
+func TestPackConcurrentReads(t *testing.T) {
+	dir := makeTestRepo(t)
+	objs := gitCmd(t, dir, "", "rev-list", "--objects", "--all")
+	out := filepath.Join(t.TempDir(), "test")
+	sum := gitCmd(t, dir, objs, "pack-objects", "-q", "--delta-base-offset", out)
+	pack := out + "-" + strings.TrimSpace(sum) + ".pack"
+
+	// everything at once, with nothing in the cache yet, so that
+	// the deltas and their bases are all read at the same time
+	g := New()
+	p, err := IncludePackFile(g, pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*len(p.indexContents))
+	for i := 0; i < 8; i++ {
+		for _, ptr := range p.indexContents {
+			wg.Add(1)
+			go func(ptr Ptr) {
+				defer wg.Done()
+				buf, typ, err := g.rawObject(&ptr)
+				if err == nil && HashObject(typ, buf) != ptr {
+					err = fmt.Errorf("%s: read the wrong contents", &ptr)
+				}
+				errs <- err
+			}(ptr)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// includeRawPack indexes a pack made by makePack, as it is, and adds
+// it to a repository
+func includeRawPack(t *testing.T, g *Git, names []Ptr, entries ...rawEntry) *PackFile {
+	pack := makePack(entries...)
+	ps := newPackStream(bytes.NewReader(pack))
+	if _, err := ps.header(); err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int64
+	var crcs []uint32
+	for range entries {
+		pe, err := ps.entry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, pe.offset)
+		crcs = append(crcs, pe.crc)
+	}
+	var sum Ptr
+	copy(sum.hash[:], pack[len(pack)-20:])
+	var idx bytes.Buffer
+	if err := writePackIndex(&idx, names, offsets, crcs, sum); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, "tmp_pack")
+	if err := os.WriteFile(tmp, pack, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := installPack(tmp, dir, sum, idx.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := IncludePackFile(g, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestDeltaCycle(t *testing.T) {
+	a := []byte(strings.Repeat("a line of a\n", 50))
+	b := []byte(strings.Repeat("a line of b\n", 50))
+	aName, bName := HashObject(ObjBlob, a), HashObject(ObjBlob, b)
+	aDelta := rawEntry{ObjRefDelta, bName, newDeltaIndex(b).makeDelta(a, 0)}
+	bDelta := rawEntry{ObjRefDelta, aName, newDeltaIndex(a).makeDelta(b, 0)}
+
+	// each a delta against the other, in one pack
+	g := New()
+	p := includeRawPack(t, g, []Ptr{aName, bName}, aDelta, bDelta)
+	if _, _, err := p.Get(&aName).(*PackedObject).deDeltaifiedBytes(0); err != ErrDeltaTooDeep {
+		t.Errorf("cycle in a pack: %v", err)
+	}
+
+	// and in two
+	g = New()
+	p = includeRawPack(t, g, []Ptr{aName}, aDelta)
+	includeRawPack(t, g, []Ptr{bName}, bDelta)
+	if _, _, err := p.Get(&aName).(*PackedObject).deDeltaifiedBytes(0); err != ErrDeltaTooDeep {
+		t.Errorf("cycle across packs: %v", err)
+	}
+}
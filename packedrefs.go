@@ -0,0 +1,181 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// packedRefs is the parsed contents of a packed-refs file, which is
+// where "git pack-refs" (and hence "git gc") moves refs to.  The
+// file looks like:
+//
+//	# pack-refs with: peeled fully-peeled sorted
+//	<hex> refs/heads/main
+//	<hex> refs/tags/v1.0
+//	^<hex>
+//
+// where a line starting with '^' gives the peeled value of the
+// preceding (annotated tag) ref
+type packedRefs struct {
+	traits  map[string]bool
+	refs    map[string]*packedRef
+	order   []string
+	modTime time.Time
+	size    int64
+}
+
+type packedRef struct {
+	ptr    Ptr
+	peeled *Ptr
+}
+
+var ErrBadPackedRefs = errors.New("malformed packed-refs")
+
+func parsePackedRefs(buf []byte) (*packedRefs, error) {
+	pr := &packedRefs{
+		traits: make(map[string]bool),
+		refs:   make(map[string]*packedRef),
+	}
+	var last *packedRef
+
+	scan := bufio.NewScanner(bytes.NewReader(buf))
+	for scan.Scan() {
+		line := scan.Text()
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "# pack-refs with:"):
+			for _, t := range strings.Fields(line[len("# pack-refs with:"):]) {
+				pr.traits[t] = true
+			}
+		case line[0] == '#':
+			continue
+		case line[0] == '^':
+			if last == nil {
+				return nil, ErrBadPackedRefs
+			}
+			p, ok := ParsePtr(line[1:])
+			if !ok {
+				return nil, ErrBadPackedRefs
+			}
+			last.peeled = &p
+			last = nil
+		default:
+			if len(line) < 42 || line[40] != ' ' {
+				return nil, ErrBadPackedRefs
+			}
+			p, ok := ParsePtr(line[:40])
+			if !ok {
+				return nil, ErrBadPackedRefs
+			}
+			name := line[41:]
+			last = &packedRef{ptr: p}
+			if _, dup := pr.refs[name]; !dup {
+				pr.order = append(pr.order, name)
+			}
+			pr.refs[name] = last
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+// packed returns the current contents of the packed-refs file,
+// re-reading it if it has changed since we last looked.  If there
+// is no packed-refs file, it returns an empty set
+func (g *GitDir) packed() (*packedRefs, error) {
+	file := path.Join(g.Dir, "packed-refs")
+
+	g.packedLock.Lock()
+	defer g.packedLock.Unlock()
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			g.packedRefs = nil
+			return &packedRefs{}, nil
+		}
+		return nil, err
+	}
+	pr := g.packedRefs
+	if pr != nil && pr.modTime.Equal(fi.ModTime()) && pr.size == fi.Size() {
+		return pr, nil
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pr, err = parsePackedRefs(buf)
+	if err != nil {
+		return nil, err
+	}
+	pr.modTime = fi.ModTime()
+	pr.size = fi.Size()
+	g.packedRefs = pr
+	return pr, nil
+}
+
+// PackedRefTraits returns the traits listed in the packed-refs
+// header, such as "peeled" and "sorted"
+func (g *GitDir) PackedRefTraits() ([]string, error) {
+	pr, err := g.packed()
+	if err != nil {
+		return nil, err
+	}
+	var lst []string
+	for t := range pr.traits {
+		lst = append(lst, t)
+	}
+	return lst, nil
+}
+
+// getPacked looks up a ref (e.g., "refs/heads/main") in packed-refs
+func (g *GitDir) getPacked(t RefType, name string) *NamedRef {
+	pr, err := g.packed()
+	if err != nil {
+		log.Warning("Failed to read packed-refs: %s", err)
+		return nil
+	}
+	r := pr.refs[path.Join("refs", t.String(), name)]
+	if r == nil {
+		return nil
+	}
+	return &NamedRef{
+		Ptr:     r.ptr,
+		RefType: t,
+		Name:    name,
+		Peeled:  r.peeled,
+	}
+}
+
+// enumPacked returns all the refs of the given type in packed-refs
+func (g *GitDir) enumPacked(t RefType) ([]NamedRef, error) {
+	pr, err := g.packed()
+	if err != nil {
+		return nil, err
+	}
+	prefix := "refs/" + t.String() + "/"
+	var lst []NamedRef
+	for _, full := range pr.order {
+		if !strings.HasPrefix(full, prefix) {
+			continue
+		}
+		r := pr.refs[full]
+		lst = append(lst, NamedRef{
+			Ptr:     r.ptr,
+			RefType: t,
+			Name:    full[len(prefix):],
+			Peeled:  r.peeled,
+		})
+	}
+	return lst, nil
+}
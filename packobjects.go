@@ -0,0 +1,156 @@
+package git
+
+import (
+	"io"
+	"path"
+)
+
+// objectWalk collects the objects needed to go from one set of
+// commits to another, as "git rev-list --objects" does
+type objectWalk struct {
+	repo *Git
+	seen map[Ptr]bool
+	pack *PackWriter
+}
+
+// objectsToPack adds to a pack everything reachable from wants
+// (commits, tags, trees or blobs) but not from the commits in haves.
+// Only the trees of the haves themselves are left out, rather than
+// of all of their history, so an object that went away and came
+// back may be sent even though the other side has it
+func (g *Git) objectsToPack(pw *PackWriter, wants, haves []Ptr) error {
+	ow := &objectWalk{repo: g, seen: make(map[Ptr]bool), pack: pw}
+	var exclude []Ptr
+	for i := range haves {
+		c, err := g.peelToCommit(&haves[i])
+		if err != nil {
+			return err
+		}
+		exclude = append(exclude, c.name)
+		if err := ow.markTree(&c.Tree); err != nil {
+			return err
+		}
+	}
+
+	var commits, rest []Ptr
+	for _, p := range wants {
+		if ow.seen[p] {
+			continue
+		}
+		// keep any tags, and peel them to see what they are of
+		for {
+			o, err := g.load(&p)
+			if err != nil {
+				return err
+			}
+			if tag, ok := o.(*AnnotatedTag); ok {
+				if ow.seen[p] {
+					break
+				}
+				ow.add(p, "")
+				p = tag.Object
+				continue
+			}
+			if o.Type() == ObjCommit {
+				commits = append(commits, p)
+			} else {
+				rest = append(rest, p)
+			}
+			break
+		}
+	}
+
+	if len(commits) > 0 {
+		walk := g.RevList(&RevListOptions{Include: commits, Exclude: exclude})
+		for {
+			c, err := walk.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			ow.add(c.name, "")
+			if err := ow.addTree(&c.Tree, ""); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range rest {
+		o, err := g.load(&rest[i])
+		if err != nil {
+			return err
+		}
+		if o.Type() == ObjTree {
+			err = ow.addTree(&rest[i], "")
+		} else {
+			ow.add(rest[i], "")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add adds an object, with the path it was found at as a hint for
+// finding deltas
+func (ow *objectWalk) add(p Ptr, name string) {
+	if !ow.seen[p] {
+		ow.seen[p] = true
+		ow.pack.Add(p, name)
+	}
+}
+
+// addTree adds a tree and everything in it that hasn't been seen
+func (ow *objectWalk) addTree(p *Ptr, dir string) error {
+	if ow.seen[*p] {
+		return nil
+	}
+	ow.add(*p, dir)
+	return ow.eachNode(p, func(n *Node) error {
+		if n.IsDir() {
+			return ow.addTree(&n.Ref, path.Join(dir, n.Name))
+		}
+		ow.add(n.Ref, path.Join(dir, n.Name))
+		return nil
+	})
+}
+
+// markTree marks a tree and everything in it as seen, without
+// adding them
+func (ow *objectWalk) markTree(p *Ptr) error {
+	if ow.seen[*p] {
+		return nil
+	}
+	ow.seen[*p] = true
+	return ow.eachNode(p, func(n *Node) error {
+		if n.IsDir() {
+			return ow.markTree(&n.Ref)
+		}
+		ow.seen[n.Ref] = true
+		return nil
+	})
+}
+
+// eachNode calls fn on the entries of a tree, except for submodules,
+// whose commits are in some other repository
+func (ow *objectWalk) eachNode(p *Ptr, fn func(*Node) error) error {
+	o, err := ow.repo.load(p)
+	if err != nil {
+		return err
+	}
+	t, ok := o.(*Tree)
+	if !ok {
+		return ErrNotTree
+	}
+	for _, n := range t.Nodes() {
+		if n.IsSubmodule() {
+			continue
+		}
+		if err := fn(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
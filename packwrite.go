@@ -0,0 +1,498 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var ErrPackNotWritten = errors.New("pack has not been written yet")
+
+// PackWriter builds a pack (and its index) out of a set of objects,
+// storing objects as deltas against similar ones where that is
+// smaller.  Deltas already in the repository's packs are reused when
+// their bases are going into the pack too
+type PackWriter struct {
+	// Window is how many of the objects sorted before each one
+	// (which are of the same type, and probably at the same path)
+	// are tried as its delta base
+	Window int
+	// Depth is the longest chain of deltas allowed
+	Depth int
+	// RefDeltas names delta bases by object name (REF_DELTA)
+	// instead of offset, for readers that don't know OFS_DELTA
+	RefDeltas bool
+
+	repo   *Git
+	objs   []*packObject
+	byName map[Ptr]*packObject
+	sum    Ptr
+	done   bool
+}
+
+// packObject is an object on its way into a pack
+type packObject struct {
+	name     Ptr
+	typ      ObjType
+	size     int
+	pathHash uint32
+	base     *packObject
+	delta    []byte
+	depth    int
+	written  bool
+	offset   int64
+	crc      uint32
+}
+
+func NewPackWriter(g *Git) *PackWriter {
+	return &PackWriter{
+		Window: 10,
+		Depth:  50,
+		repo:   g,
+		byName: make(map[Ptr]*packObject),
+	}
+}
+
+// Add puts an object in the pack.  The path it was found at, if any,
+// is a hint as to which other objects it is like
+func (pw *PackWriter) Add(p Ptr, path string) {
+	if _, ok := pw.byName[p]; ok {
+		return
+	}
+	o := &packObject{name: p, pathHash: packNameHash(path)}
+	pw.objs = append(pw.objs, o)
+	pw.byName[p] = o
+}
+
+// Has tells whether an object has been added
+func (pw *PackWriter) Has(p Ptr) bool {
+	_, ok := pw.byName[p]
+	return ok
+}
+
+// Len is the number of objects added
+func (pw *PackWriter) Len() int {
+	return len(pw.objs)
+}
+
+// packNameHash is git's hash of a path, which mostly depends on the
+// last few characters so that files with the same name or extension
+// sort near each other
+func packNameHash(name string) uint32 {
+	var h uint32
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			continue
+		}
+		h = h>>2 + uint32(c)<<24
+	}
+	return h
+}
+
+// WritePack writes the pack, returning its checksum (which is also
+// its name)
+func (pw *PackWriter) WritePack(w io.Writer) (Ptr, error) {
+	if err := pw.prepare(); err != nil {
+		return Ptr{}, err
+	}
+	if err := pw.reuseDeltas(); err != nil {
+		return Ptr{}, err
+	}
+	if err := pw.findDeltas(); err != nil {
+		return Ptr{}, err
+	}
+
+	h := sha1.New()
+	cw := &countingWriter{w: io.MultiWriter(w, h)}
+
+	var hdr [12]byte
+	binary.BigEndian.PutUint32(hdr[0:], GitPackSignature)
+	binary.BigEndian.PutUint32(hdr[4:], 2)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(len(pw.objs)))
+	if _, err := cw.Write(hdr[:]); err != nil {
+		return Ptr{}, err
+	}
+	for _, o := range pw.objs {
+		if err := pw.write(cw, o); err != nil {
+			return Ptr{}, err
+		}
+	}
+
+	copy(pw.sum.hash[:], h.Sum(nil))
+	if _, err := w.Write(pw.sum.hash[:]); err != nil {
+		return Ptr{}, err
+	}
+	pw.done = true
+	return pw.sum, nil
+}
+
+// prepare finds out the type and size of every object, forgetting
+// anything from writing the pack before
+func (pw *PackWriter) prepare() error {
+	for _, o := range pw.objs {
+		o.base, o.delta, o.written = nil, nil, false
+		data, t, err := pw.repo.rawObject(&o.name)
+		if err != nil {
+			return err
+		}
+		o.typ = t
+		o.size = len(data)
+	}
+	return nil
+}
+
+// reuseDeltas keeps the deltas of objects that are already stored
+// as deltas in a pack, when their bases are in this pack too
+func (pw *PackWriter) reuseDeltas() error {
+	for _, o := range pw.objs {
+		po, ok := pw.repo.Get(&o.name).(*PackedObject)
+		if !ok || (po.typecode != ObjOffsetDelta && po.typecode != ObjRefDelta) {
+			continue
+		}
+		delta, spec, err := po.read()
+		if err != nil {
+			return err
+		}
+		var baseName Ptr
+		if spec.name != nil {
+			baseName = *spec.name
+		} else {
+			p := po.container
+			i, ok := p.crossRef[spec.offset]
+			if !ok {
+				return ErrBadBaseOffset
+			}
+			baseName = p.indexContents[i]
+		}
+		base, ok := pw.byName[baseName]
+		if !ok || base.dependsOn(o) {
+			continue
+		}
+		o.base = base
+		o.delta = delta
+	}
+	return nil
+}
+
+// dependsOn tells whether o is x or a delta against it, however
+// indirectly
+func (o *packObject) dependsOn(x *packObject) bool {
+	for ; o != nil; o = o.base {
+		if o == x {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *packObject) chainDepth() int {
+	d := 0
+	for b := o.base; b != nil; b = b.base {
+		d++
+	}
+	return d
+}
+
+// windowEntry is an object in the window of possible delta bases
+type windowEntry struct {
+	obj   *packObject
+	data  []byte
+	index *deltaIndex
+}
+
+// findDeltas looks for deltas for the objects that don't have one,
+// going through them sorted so that likely bases are close by
+func (pw *PackWriter) findDeltas() error {
+	if pw.Window <= 0 || pw.Depth <= 0 {
+		return nil
+	}
+	sorted := make([]*packObject, len(pw.objs))
+	copy(sorted, pw.objs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.typ != b.typ {
+			return a.typ < b.typ
+		}
+		if a.pathHash != b.pathHash {
+			return a.pathHash < b.pathHash
+		}
+		// bigger first, since deleting is cheaper than adding
+		return a.size > b.size
+	})
+
+	var window []*windowEntry
+	for _, o := range sorted {
+		if o.typ == ObjCommit || o.typ == ObjTag {
+			// these hardly ever have anything in common
+			continue
+		}
+		data, _, err := pw.repo.rawObject(&o.name)
+		if err != nil {
+			return err
+		}
+		if o.base == nil {
+			pw.tryDeltas(o, data, window)
+		}
+		o.depth = o.chainDepth()
+
+		window = append(window, &windowEntry{obj: o, data: data})
+		if len(window) > pw.Window {
+			window = window[1:]
+		}
+	}
+	return nil
+}
+
+// tryDeltas picks the base in the window that makes for the
+// smallest delta, if any is worth it
+func (pw *PackWriter) tryDeltas(o *packObject, data []byte, window []*windowEntry) {
+	// a delta has to save something over storing the object
+	// whole, and over its header and the base's offset
+	max := o.size/2 - 20
+	for i := len(window) - 1; i >= 0; i-- {
+		if max <= 0 {
+			return
+		}
+		e := window[i]
+		if e.obj.typ != o.typ || e.obj.depth >= pw.Depth || e.obj.dependsOn(o) {
+			continue
+		}
+		if e.obj.size < o.size/32 {
+			// too small to have much of o in it
+			continue
+		}
+		if e.index == nil {
+			e.index = newDeltaIndex(e.data)
+		}
+		delta := e.index.makeDelta(data, max)
+		if delta == nil {
+			continue
+		}
+		o.base = e.obj
+		o.delta = delta
+		max = len(delta) - 1
+	}
+}
+
+// write writes an object, after its delta base if it has one
+func (pw *PackWriter) write(cw *countingWriter, o *packObject) error {
+	if o.written {
+		return nil
+	}
+	if o.base != nil {
+		if err := pw.write(cw, o.base); err != nil {
+			return err
+		}
+		o.depth = o.base.depth + 1
+		if o.depth > pw.Depth {
+			// a reused delta at the end of too long a chain
+			o.base, o.delta, o.depth = nil, nil, 0
+		}
+	} else {
+		o.depth = 0
+	}
+
+	var buf bytes.Buffer
+	data := o.delta
+	switch {
+	case o.base == nil:
+		whole, t, err := pw.repo.rawObject(&o.name)
+		if err != nil {
+			return err
+		}
+		data = whole
+		buf.Write(packObjectHeader(t, len(data)))
+	case pw.RefDeltas:
+		buf.Write(packObjectHeader(ObjRefDelta, len(data)))
+		buf.Write(o.base.name.hash[:])
+	default:
+		buf.Write(packObjectHeader(ObjOffsetDelta, len(data)))
+		buf.Write(encodeOffsetDelta(cw.n - o.base.offset))
+	}
+	z := zlib.NewWriter(&buf)
+	if _, err := z.Write(data); err != nil {
+		return err
+	}
+	if err := z.Close(); err != nil {
+		return err
+	}
+
+	o.offset = cw.n
+	o.crc = crc32.ChecksumIEEE(buf.Bytes())
+	o.written = true
+	// the delta is no longer needed
+	o.delta = nil
+	_, err := cw.Write(buf.Bytes())
+	return err
+}
+
+// WriteIndex writes a version 2 index for the pack, which has to
+// have been written already
+func (pw *PackWriter) WriteIndex(w io.Writer) error {
+	if !pw.done {
+		return ErrPackNotWritten
+	}
+	names := make([]Ptr, len(pw.objs))
+	offsets := make([]int64, len(pw.objs))
+	crcs := make([]uint32, len(pw.objs))
+	for i, o := range pw.objs {
+		names[i], offsets[i], crcs[i] = o.name, o.offset, o.crc
+	}
+	return writePackIndex(w, names, offsets, crcs, pw.sum)
+}
+
+// writePackIndex writes a version 2 index of the objects in a pack,
+// given their names and where they are, in any order
+func writePackIndex(w io.Writer, names []Ptr, offsets []int64, crcs []uint32, sum Ptr) error {
+	order := make([]int, len(names))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(names[order[i]].hash[:], names[order[j]].hash[:]) < 0
+	})
+
+	h := sha1.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+	put32 := func(x uint32) {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], x)
+		bw.Write(b[:])
+	}
+
+	put32(packIndexSignature)
+	put32(packIndexVersion)
+	var fanout [256]uint32
+	for _, p := range names {
+		fanout[p.hash[0]]++
+	}
+	total := uint32(0)
+	for _, n := range fanout {
+		total += n
+		put32(total)
+	}
+	for _, i := range order {
+		bw.Write(names[i].hash[:])
+	}
+	for _, i := range order {
+		put32(crcs[i])
+	}
+	var large []int64
+	for _, i := range order {
+		if offsets[i] < largeOffsetFlag {
+			put32(uint32(offsets[i]))
+		} else {
+			put32(largeOffsetFlag | uint32(len(large)))
+			large = append(large, offsets[i])
+		}
+	}
+	for _, off := range large {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(off))
+		bw.Write(b[:])
+	}
+	bw.Write(sum.hash[:])
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(h.Sum(nil))
+	return err
+}
+
+// WriteFiles writes the pack and its index into a directory (such
+// as objects/pack) as pack-<checksum>.pack and .idx, returning the
+// name of the pack file
+func (pw *PackWriter) WriteFiles(dir string) (string, error) {
+	tmp, err := ioutil.TempFile(dir, "tmp_pack_")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriter(tmp)
+	sum, err := pw.WritePack(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var idx bytes.Buffer
+	if err := pw.WriteIndex(&idx); err != nil {
+		return "", err
+	}
+	return installPack(tmp.Name(), dir, sum, idx.Bytes())
+}
+
+// installPack moves a finished pack into place in dir, and writes
+// its index, returning the name of the pack file
+func installPack(tmp, dir string, sum Ptr, idx []byte) (string, error) {
+	// packs are never changed once written
+	if err := os.Chmod(tmp, 0444); err != nil {
+		return "", err
+	}
+	base := filepath.Join(dir, "pack-"+sum.String())
+	if err := os.Rename(tmp, base+".pack"); err != nil {
+		return "", err
+	}
+	// the index goes last, since it is what makes the pack visible
+	if err := writeLocked(base+".idx", idx); err != nil {
+		return "", err
+	}
+	return base + ".pack", nil
+}
+
+// packObjectHeader encodes the type and (inflated) size that start
+// each object in a pack
+func packObjectHeader(t ObjType, size int) []byte {
+	buf := []byte{byte(t)<<4 | byte(size&0x0f)}
+	size >>= 4
+	for size > 0 {
+		buf[len(buf)-1] |= 0x80
+		buf = append(buf, byte(size&0x7f))
+		size >>= 7
+	}
+	return buf
+}
+
+// encodeOffsetDelta encodes how far back an OFS_DELTA's base is, the
+// inverse of decodeOffsetDelta
+func encodeOffsetDelta(rel int64) []byte {
+	var buf [10]byte
+	i := len(buf) - 1
+	buf[i] = byte(rel & 0x7f)
+	for rel >>= 7; rel != 0; rel >>= 7 {
+		rel--
+		i--
+		buf[i] = 0x80 | byte(rel&0x7f)
+	}
+	return buf[i:]
+}
+
+// countingWriter keeps track of how much has been written
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(buf []byte) (int, error) {
+	n, err := cw.w.Write(buf)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,154 @@
+package git
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMakeDelta(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		buf := make([]byte, n)
+		r.Read(buf)
+		return buf
+	}
+	base := random(100000)
+	var edited []byte
+	edited = append(edited, base[:30000]...)
+	edited = append(edited, random(500)...)
+	edited = append(edited, base[40000:]...)
+	edited = append(edited, base[:100]...)
+
+	for _, c := range []struct {
+		name         string
+		base, target []byte
+		small        bool
+	}{
+		{"same", base, base, true},
+		{"edited", base, edited, true},
+		{"unrelated", base, random(1000), false},
+		{"empty target", base, nil, true},
+		{"empty base", nil, base[:1000], false},
+		{"tiny", []byte("abc"), []byte("abcd"), false},
+	} {
+		delta := newDeltaIndex(c.base).makeDelta(c.target, 0)
+		got, _, err := patchDelta(ObjBlob, c.base, delta)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if !bytes.Equal(got, c.target) {
+			t.Fatalf("%s: delta does not reproduce the target", c.name)
+		}
+		if c.small && len(delta) > 1000 {
+			t.Errorf("%s: %d byte delta", c.name, len(delta))
+		}
+	}
+
+	if newDeltaIndex(base).makeDelta(random(1000), 100) != nil {
+		t.Errorf("expected to give up on a delta over the limit")
+	}
+}
+
+func TestPackWriter(t *testing.T) {
+	dir := makeTestRepo(t)
+	gitCmd(t, dir, "", "tag", "-a", "-m", "a tag", "v1")
+	g, err := Open(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := mustRev(t, g, "v1")
+
+	check := func(name string, pw *PackWriter) {
+		out := t.TempDir()
+		pack, err := pw.WritePack(&bytes.Buffer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := pw.WriteFiles(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file != filepath.Join(out, "pack-"+pack.String()+".pack") {
+			t.Errorf("%s: wrote %s", name, file)
+		}
+
+		verify := gitCmd(t, out, "", "verify-pack", "-v", file)
+		if !strings.Contains(verify, "chain length = 1") {
+			t.Errorf("%s: expected some deltas\n%s", name, verify)
+		}
+		// git's own index of the pack should be the same as ours
+		idx, err := os.ReadFile(strings.TrimSuffix(file, ".pack") + ".idx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		theirs := filepath.Join(out, "theirs.idx")
+		gitCmd(t, out, "", "index-pack", "-o", theirs, file)
+		want, err := os.ReadFile(theirs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(idx, want) {
+			t.Errorf("%s: index differs from git's", name)
+		}
+
+		// and we can read it back
+		p, err := IncludePackFile(New(), file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p.indexContents) != pw.Len() {
+			t.Errorf("%s: %d objects in pack, expected %d",
+				name, len(p.indexContents), pw.Len())
+		}
+		for _, ptr := range p.indexContents {
+			ptr := ptr
+			buf, typ, err := p.Get(&ptr).(*PackedObject).deDeltaifiedBytes(0)
+			if err != nil {
+				t.Fatalf("%s: %s: %s", name, &ptr, err)
+			}
+			want, wantType, err := g.rawObject(&ptr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if typ != wantType || !bytes.Equal(buf, want) {
+				t.Fatalf("%s: %s differs", name, &ptr)
+			}
+		}
+	}
+
+	pw := NewPackWriter(g)
+	if err := g.objectsToPack(pw, []Ptr{*head}, nil); err != nil {
+		t.Fatal(err)
+	}
+	objs := gitCmd(t, dir, "", "rev-list", "--objects", "v1")
+	if n := strings.Count(objs, "\n"); pw.Len() != n {
+		t.Errorf("packing %d objects, expected %d", pw.Len(), n)
+	}
+	check("new deltas", pw)
+
+	pw = NewPackWriter(g)
+	pw.RefDeltas = true
+	g.objectsToPack(pw, []Ptr{*head}, nil)
+	check("ref deltas", pw)
+
+	pw = NewPackWriter(g)
+	if err := pw.WriteIndex(&bytes.Buffer{}); err != ErrPackNotWritten {
+		t.Errorf("index before pack: %v", err)
+	}
+
+	// once git has packed it, the deltas can be reused without
+	// looking for any
+	gitCmd(t, dir, "", "gc", "-q")
+	g, err = Open(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw = NewPackWriter(g)
+	pw.Window = 0
+	g.objectsToPack(pw, []Ptr{*head}, nil)
+	check("reused deltas", pw)
+}
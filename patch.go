@@ -0,0 +1,432 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// PatchOptions controls the output of DiffBlobs and WritePatch
+type PatchOptions struct {
+	// Context is the number of unchanged lines shown around each
+	// change ("-U"); git's default is 3
+	Context   int
+	Algorithm DiffAlgorithm
+	// Abbrev is the number of hex digits of each object name shown
+	// in "index" lines; the default is 7
+	Abbrev int
+}
+
+// DefaultPatchOptions are the same as plain "git diff"
+var DefaultPatchOptions = PatchOptions{Context: 3, Abbrev: 7}
+
+// A Hunk is one section of a unified diff.  The starting line
+// numbers are 1-based, except that they are the line before the
+// change when the corresponding side is empty, as in the "@@" line.
+// Each of Lines starts with ' ', '-' or '+' (or is "\ No newline at
+// end of file") and ends with a newline
+type Hunk struct {
+	OldStart, OldLines int
+	NewStart, NewLines int
+	// Section is the function (or other) heading shown after the
+	// "@@" line, if any
+	Section string
+	Lines   []string
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return strconv.Itoa(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// Header returns the "@@ -a,b +c,d @@" line, without a newline
+func (h *Hunk) Header() string {
+	s := fmt.Sprintf("@@ -%s +%s @@",
+		hunkRange(h.OldStart, h.OldLines),
+		hunkRange(h.NewStart, h.NewLines))
+	if h.Section != "" {
+		s += " " + h.Section
+	}
+	return s
+}
+
+func (h *Hunk) String() string {
+	var buf strings.Builder
+	buf.WriteString(h.Header())
+	buf.WriteByte('\n')
+	for _, l := range h.Lines {
+		buf.WriteString(l)
+	}
+	return buf.String()
+}
+
+const noNewline = "\\ No newline at end of file\n"
+
+// IsBinary guesses whether some content is binary, the way git does:
+// it is if there is a NUL in the first 8000 bytes
+func IsBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// DiffBlobs compares the lines of two blobs, returning the hunks of
+// a unified diff.  Either blob may be nil, meaning empty content.
+// The result is empty if the contents are the same
+func DiffBlobs(a, b *Blob, opts *PatchOptions) []*Hunk {
+	var da, db []byte
+	if a != nil {
+		da = a.data
+	}
+	if b != nil {
+		db = b.data
+	}
+	if opts == nil {
+		opts = &DefaultPatchOptions
+	}
+	return diffHunks(da, db, opts)
+}
+
+// a line of the diff, with its index on each side (one of which
+// is -1 for a deleted or inserted line)
+type diffLine struct {
+	op   byte
+	a, b int
+}
+
+func diffHunks(da, db []byte, opts *PatchOptions) []*Hunk {
+	a, b := splitLines(da), splitLines(db)
+	del, ins := diffLines(a, b, opts.Algorithm)
+
+	var script []diffLine
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && del[i]:
+			script = append(script, diffLine{'-', i, -1})
+			i++
+		case j < len(b) && ins[j]:
+			script = append(script, diffLine{'+', -1, j})
+			j++
+		default:
+			script = append(script, diffLine{' ', i, j})
+			i++
+			j++
+		}
+	}
+
+	ctx := opts.Context
+	if ctx < 0 {
+		ctx = 0
+	}
+	var hunks []*Hunk
+	funcLine := ""
+	funcScanned := 0
+	for k := 0; k < len(script); {
+		if script[k].op == ' ' {
+			k++
+			continue
+		}
+		// k is the first change in a hunk; find the last, merging
+		// changes separated by no more than twice the context
+		last := k
+		for n := k + 1; n < len(script); n++ {
+			if script[n].op == ' ' {
+				continue
+			}
+			if n-last-1 > 2*ctx {
+				break
+			}
+			last = n
+		}
+		start := k - ctx
+		if start < 0 {
+			start = 0
+		}
+		end := last + 1 + ctx
+		if end > len(script) {
+			end = len(script)
+		}
+
+		h := &Hunk{}
+		// the position of the hunk on each side
+		oldAt, newAt := 0, 0
+		if start > 0 {
+			oldAt, newAt = lineAfter(script[:start])
+		}
+		for _, dl := range script[start:end] {
+			var text string
+			switch dl.op {
+			case '-':
+				text = a[dl.a]
+				h.OldLines++
+			case '+':
+				text = b[dl.b]
+				h.NewLines++
+			default:
+				text = a[dl.a]
+				h.OldLines++
+				h.NewLines++
+			}
+			h.Lines = append(h.Lines, string(dl.op)+text)
+			if !strings.HasSuffix(text, "\n") {
+				h.Lines[len(h.Lines)-1] += "\n"
+				h.Lines = append(h.Lines, noNewline)
+			}
+		}
+		h.OldStart, h.NewStart = oldAt, newAt
+		if h.OldLines > 0 {
+			h.OldStart++
+		}
+		if h.NewLines > 0 {
+			h.NewStart++
+		}
+
+		// look back for a section heading, starting just before
+		// the hunk; like git, we don't rescan lines we've already
+		// looked at for an earlier hunk
+		for n := oldAt - 1; n >= funcScanned; n-- {
+			if s, ok := funcName(a[n]); ok {
+				funcLine = s
+				break
+			}
+		}
+		if oldAt > funcScanned {
+			funcScanned = oldAt
+		}
+		h.Section = funcLine
+
+		hunks = append(hunks, h)
+		k = last + 1
+	}
+	return hunks
+}
+
+// lineAfter returns how many lines of each side are used by the
+// given part of the script
+func lineAfter(script []diffLine) (int, int) {
+	na, nb := 0, 0
+	for _, dl := range script {
+		if dl.op != '+' {
+			na++
+		}
+		if dl.op != '-' {
+			nb++
+		}
+	}
+	return na, nb
+}
+
+// funcName is git's default rule for the heading shown in "@@"
+// lines: the nearest line before the hunk that starts with a
+// letter, '_' or '$'
+func funcName(line string) (string, bool) {
+	if line == "" {
+		return "", false
+	}
+	ch := line[0]
+	if !(ch >= 'a' && ch <= 'z') && !(ch >= 'A' && ch <= 'Z') && ch != '_' && ch != '$' {
+		return "", false
+	}
+	if len(line) > 80 {
+		line = line[:80]
+	}
+	return strings.TrimRight(line, " \t\r\n\v\f"), true
+}
+
+// WritePatch writes the changes from a tree diff as a patch, in the
+// same format as "git diff"
+func (g *Git) WritePatch(w io.Writer, changes []*Change, opts *PatchOptions) error {
+	if opts == nil {
+		opts = &DefaultPatchOptions
+	}
+	for _, c := range changes {
+		if c.Type == TypeChanged {
+			// git shows these as a deletion and an addition
+			err := g.writeFilePatch(w, &Change{Type: Deleted, OldPath: c.OldPath, Old: c.Old}, opts)
+			if err != nil {
+				return err
+			}
+			c = &Change{Type: Added, NewPath: c.NewPath, New: c.New}
+		}
+		if err := g.writeFilePatch(w, c, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nodeContent returns what a patch compares for a tree entry: the
+// blob's content, or for a submodule, a line naming the commit
+func (g *Git) nodeContent(n *Node) ([]byte, error) {
+	if n == nil {
+		return nil, nil
+	}
+	if n.IsSubmodule() {
+		return []byte("Subproject commit " + n.Ref.String() + "\n"), nil
+	}
+	o, err := g.load(&n.Ref)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := o.(*Blob)
+	if !ok {
+		return nil, ErrNotBlob
+	}
+	return b.data, nil
+}
+
+func (g *Git) writeFilePatch(w io.Writer, c *Change, opts *PatchOptions) error {
+	oldPath, newPath := c.OldPath, c.NewPath
+	if oldPath == "" {
+		oldPath = newPath
+	}
+	if newPath == "" {
+		newPath = oldPath
+	}
+	aName := quotePath("a/" + oldPath)
+	bName := quotePath("b/" + newPath)
+
+	var hdr strings.Builder
+	fmt.Fprintf(&hdr, "diff --git %s %s\n", aName, bName)
+
+	var oldRef, newRef Ptr
+	var oldMode, newMode uint
+	if c.Old != nil {
+		oldRef, oldMode = c.Old.Ref, c.Old.Perm
+	}
+	if c.New != nil {
+		newRef, newMode = c.New.Ref, c.New.Perm
+	}
+
+	switch {
+	case c.Old == nil:
+		fmt.Fprintf(&hdr, "new file mode %06o\n", newMode)
+	case c.New == nil:
+		fmt.Fprintf(&hdr, "deleted file mode %06o\n", oldMode)
+	case oldMode != newMode:
+		fmt.Fprintf(&hdr, "old mode %06o\nnew mode %06o\n", oldMode, newMode)
+	}
+	switch c.Type {
+	case Renamed:
+		fmt.Fprintf(&hdr, "similarity index %d%%\nrename from %s\nrename to %s\n",
+			c.Score, quotePath(oldPath), quotePath(newPath))
+	case Copied:
+		fmt.Fprintf(&hdr, "similarity index %d%%\ncopy from %s\ncopy to %s\n",
+			c.Score, quotePath(oldPath), quotePath(newPath))
+	}
+
+	if oldRef == newRef {
+		// a pure rename or mode change
+		_, err := io.WriteString(w, hdr.String())
+		return err
+	}
+	fmt.Fprintf(&hdr, "index %s..%s", abbrevPtr(oldRef, opts.Abbrev), abbrevPtr(newRef, opts.Abbrev))
+	if oldMode == newMode {
+		fmt.Fprintf(&hdr, " %06o", newMode)
+	}
+	hdr.WriteByte('\n')
+
+	oldData, err := g.nodeContent(c.Old)
+	if err != nil {
+		return err
+	}
+	newData, err := g.nodeContent(c.New)
+	if err != nil {
+		return err
+	}
+
+	aLabel, bLabel := aName, bName
+	if c.Old == nil {
+		aLabel = "/dev/null"
+	}
+	if c.New == nil {
+		bLabel = "/dev/null"
+	}
+
+	if IsBinary(oldData) || IsBinary(newData) {
+		fmt.Fprintf(&hdr, "Binary files %s and %s differ\n", aLabel, bLabel)
+		_, err := io.WriteString(w, hdr.String())
+		return err
+	}
+
+	hunks := diffHunks(oldData, newData, opts)
+	if len(hunks) > 0 {
+		fmt.Fprintf(&hdr, "--- %s%s\n+++ %s%s\n",
+			aLabel, tabIfSpace(aLabel), bLabel, tabIfSpace(bLabel))
+		for _, h := range hunks {
+			hdr.WriteString(h.String())
+		}
+	}
+	_, err = io.WriteString(w, hdr.String())
+	return err
+}
+
+// git ends the ---/+++ lines with a tab when the name has a space,
+// to make them easier to parse
+func tabIfSpace(name string) string {
+	if strings.Contains(name, " ") {
+		return "\t"
+	}
+	return ""
+}
+
+func abbrevPtr(p Ptr, n int) string {
+	s := p.String()
+	if n > 0 && n < len(s) {
+		return s[:n]
+	}
+	return s
+}
+
+// quotePath quotes a path the way git does (with core.quotePath on)
+// if it contains anything unusual
+func quotePath(p string) string {
+	needs := false
+	for i := 0; i < len(p); i++ {
+		if ch := p[i]; ch < 0x20 || ch >= 0x7f || ch == '"' || ch == '\\' {
+			needs = true
+			break
+		}
+	}
+	if !needs {
+		return p
+	}
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for i := 0; i < len(p); i++ {
+		ch := p[i]
+		switch ch {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(ch)
+		case '\a':
+			buf.WriteString(`\a`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\v':
+			buf.WriteString(`\v`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\r':
+			buf.WriteString(`\r`)
+		default:
+			if ch < 0x20 || ch >= 0x7f {
+				fmt.Fprintf(&buf, "\\%03o", ch)
+			} else {
+				buf.WriteByte(ch)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
@@ -0,0 +1,185 @@
+package git
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWritePatch(t *testing.T) {
+	dir := t.TempDir()
+	initRepo(t, dir)
+	var prog []string
+	for i := 0; i < 30; i++ {
+		if i%10 == 0 {
+			prog = append(prog, fmt.Sprintf("func f%d() {", i))
+		} else {
+			prog = append(prog, fmt.Sprintf("\tstatement(%d)", i))
+		}
+	}
+	body := strings.Join(prog, "\n") + "\n"
+	var long []string
+	for i := 0; i < 40; i++ {
+		long = append(long, fmt.Sprintf("this is line %d of a longer file", i))
+	}
+	longBody := strings.Join(long, "\n") + "\n"
+
+	writeFile(t, dir, "prog.go", body)
+	writeFile(t, dir, "mode.sh", "#!/bin/sh\necho hi\n")
+	writeFile(t, dir, "both.sh", "#!/bin/sh\necho one\n")
+	writeFile(t, dir, "gone.txt", "deleted\nfile\n")
+	writeFile(t, dir, "eol.txt", "no newline")
+	writeFile(t, dir, "bin.dat", "\x00\x01\x02")
+	writeFile(t, dir, "with space.txt", "x\n")
+	writeFile(t, dir, "similar.txt", longBody)
+	os.Symlink("target", filepath.Join(dir, "link"))
+	gitCmd(t, dir, "", "add", ".")
+	gitCmd(t, dir, "", "commit", "-q", "-m", "one")
+
+	writeFile(t, dir, "prog.go", strings.Replace(strings.Replace(body,
+		"statement(2)", "changed(2)", 1),
+		"statement(25)", "changed(25)\n\tadded()", 1))
+	os.Chmod(filepath.Join(dir, "mode.sh"), 0755)
+	writeFile(t, dir, "both.sh", "#!/bin/sh\necho two\n")
+	os.Chmod(filepath.Join(dir, "both.sh"), 0755)
+	os.Remove(filepath.Join(dir, "gone.txt"))
+	writeFile(t, dir, "eol.txt", "no newline still")
+	writeFile(t, dir, "bin.dat", "\x00\x01\x03")
+	writeFile(t, dir, "with space.txt", "y\n")
+	writeFile(t, dir, "new.txt", "brand\nnew\n")
+	writeFile(t, dir, "empty", "")
+	os.Remove(filepath.Join(dir, "similar.txt"))
+	writeFile(t, dir, "renamed.txt", strings.Replace(longBody, "line 3 ", "LINE 3 ", 1))
+	os.Remove(filepath.Join(dir, "link"))
+	os.Symlink("elsewhere", filepath.Join(dir, "link"))
+	gitCmd(t, dir, "", "add", "-A")
+	gitCmd(t, dir, "", "commit", "-q", "-m", "two")
+
+	g, err := Open(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := g.peelToTree(mustRev(t, g, "HEAD~1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := g.peelToTree(mustRev(t, g, "HEAD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		flags []string
+		diff  *DiffOptions
+		patch *PatchOptions
+	}{
+		{nil, nil, nil},
+		{[]string{"-M"}, &DiffOptions{DetectRenames: true}, nil},
+		{[]string{"-U1"}, nil, &PatchOptions{Context: 1, Abbrev: 7}},
+		{[]string{"-U0"}, nil, &PatchOptions{Context: 0, Abbrev: 7}},
+		{[]string{"--full-index"}, nil, &PatchOptions{Context: 3, Abbrev: 40}},
+		{[]string{"--patience"}, nil, &PatchOptions{Context: 3, Algorithm: PatienceDiff, Abbrev: 7}},
+		{[]string{"--histogram"}, nil, &PatchOptions{Context: 3, Algorithm: HistogramDiff, Abbrev: 7}},
+	}
+	for _, c := range cases {
+		changes, err := DiffTrees(a, b, c.diff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out strings.Builder
+		err = g.WritePatch(&out, changes, c.patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := append([]string{"-c", "core.quotePath=true", "diff", "--no-color",
+			"--no-ext-diff", "--no-renames", "--abbrev=7"}, c.flags...)
+		args = append(args, "HEAD~1", "HEAD")
+		expect := gitCmd(t, dir, "", args...)
+		if out.String() != expect {
+			t.Errorf("git diff %v:\n--- got ---\n%s--- expected ---\n%s", c.flags, out.String(), expect)
+		}
+	}
+}
+
+// applyHunks rebuilds the new side of a diff from the old side
+func applyHunks(t *testing.T, old string, hunks []*Hunk) string {
+	lines := splitLines([]byte(old))
+	var out []string
+	at := 0
+	for _, h := range hunks {
+		start := h.OldStart - 1
+		if h.OldLines == 0 {
+			start = h.OldStart
+		}
+		out = append(out, lines[at:start]...)
+		at = start
+		var prev byte
+		for _, l := range h.Lines {
+			switch l[0] {
+			case ' ', '-':
+				if lines[at] != strings.TrimSuffix(l[1:], "\n") && lines[at] != l[1:] {
+					t.Fatalf("hunk does not apply at line %d", at+1)
+				}
+				if l[0] == ' ' {
+					out = append(out, lines[at])
+				}
+				at++
+			case '+':
+				out = append(out, l[1:])
+			case '\\':
+				// the previous line had no newline
+				if prev != '-' {
+					out[len(out)-1] = strings.TrimSuffix(out[len(out)-1], "\n")
+				}
+			}
+			prev = l[0]
+		}
+	}
+	out = append(out, lines[at:]...)
+	return strings.Join(out, "")
+}
+
+func TestDiffAlgorithms(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	randomText := func() string {
+		var lines []string
+		n := r.Intn(30)
+		for i := 0; i < n; i++ {
+			lines = append(lines, fmt.Sprintf("%d\n", r.Intn(8)))
+		}
+		s := strings.Join(lines, "")
+		if r.Intn(4) == 0 {
+			s += "end"
+		}
+		return s
+	}
+
+	for _, alg := range []DiffAlgorithm{MyersDiff, PatienceDiff, HistogramDiff} {
+		for i := 0; i < 300; i++ {
+			a, b := randomText(), randomText()
+			for _, ctx := range []int{0, 3} {
+				opts := &PatchOptions{Context: ctx, Algorithm: alg}
+				hunks := diffHunks([]byte(a), []byte(b), opts)
+				if got := applyHunks(t, a, hunks); got != b {
+					t.Fatalf("%s -U%d: %q to %q gave %q", alg, ctx, a, b, got)
+				}
+			}
+		}
+	}
+
+	// myers finds a shortest edit script
+	del, ins := diffLines(splitLines([]byte("a\nb\nc\na\nb\nb\na\n")),
+		splitLines([]byte("c\nb\na\nb\na\nc\n")), MyersDiff)
+	n := 0
+	for _, x := range append(del, ins...) {
+		if x {
+			n++
+		}
+	}
+	if n != 5 {
+		t.Errorf("expected an edit distance of 5, got %d", n)
+	}
+}
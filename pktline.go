@@ -0,0 +1,152 @@
+package git
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// the largest pkt-line, including its 4 byte length
+const maxPktLen = 65520
+
+var ErrBadPktLine = errors.New("malformed pkt-line")
+
+// the kinds of pkt-line; the special ones have no payload
+type pktKind int
+
+const (
+	pktData  = pktKind(iota)
+	pktFlush // "0000"
+	pktDelim // "0001", which separates sections in protocol v2
+	pktEnd   // "0002", the end of a response in protocol v2
+)
+
+// pktReader reads pkt-lines, as used throughout git's wire protocol
+type pktReader struct {
+	r   *bufio.Reader
+	buf [maxPktLen]byte
+}
+
+func newPktReader(r io.Reader) *pktReader {
+	return &pktReader{r: bufio.NewReader(r)}
+}
+
+// next reads one pkt-line.  The payload is only good until the next
+// call
+func (pr *pktReader) next() ([]byte, pktKind, error) {
+	hdr := pr.buf[:4]
+	if _, err := io.ReadFull(pr.r, hdr); err != nil {
+		return nil, pktData, err
+	}
+	n, err := strconv.ParseUint(string(hdr), 16, 16)
+	if err != nil {
+		return nil, pktData, ErrBadPktLine
+	}
+	switch n {
+	case 0:
+		return nil, pktFlush, nil
+	case 1:
+		return nil, pktDelim, nil
+	case 2:
+		return nil, pktEnd, nil
+	case 3:
+		return nil, pktData, ErrBadPktLine
+	}
+	if n > maxPktLen {
+		return nil, pktData, ErrBadPktLine
+	}
+	data := pr.buf[4:n]
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, pktData, err
+	}
+	return data, pktData, nil
+}
+
+// line reads a data pkt-line as a string without its trailing
+// newline; at a special pkt-line, it returns "" and the kind
+func (pr *pktReader) line() (string, pktKind, error) {
+	data, kind, err := pr.next()
+	if err != nil || kind != pktData {
+		return "", kind, err
+	}
+	if n := len(data); n > 0 && data[n-1] == '\n' {
+		data = data[:n-1]
+	}
+	return string(data), kind, nil
+}
+
+// pktWriter writes pkt-lines; the first error sticks, so that a
+// sequence of writes only needs checking at the end
+type pktWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (pw *pktWriter) write(data []byte) error {
+	if pw.err != nil {
+		return pw.err
+	}
+	if len(data)+4 > maxPktLen {
+		pw.err = ErrBadPktLine
+		return pw.err
+	}
+	_, pw.err = fmt.Fprintf(pw.w, "%04x%s", len(data)+4, data)
+	return pw.err
+}
+
+func (pw *pktWriter) printf(format string, args ...interface{}) error {
+	return pw.write([]byte(fmt.Sprintf(format, args...)))
+}
+
+func (pw *pktWriter) special(kind pktKind) error {
+	if pw.err != nil {
+		return pw.err
+	}
+	_, pw.err = fmt.Fprintf(pw.w, "%04x", int(kind)-int(pktFlush))
+	return pw.err
+}
+
+func (pw *pktWriter) flush() error {
+	return pw.special(pktFlush)
+}
+
+func (pw *pktWriter) delim() error {
+	return pw.special(pktDelim)
+}
+
+// the side-band channels
+const (
+	bandData     = 1
+	bandProgress = 2
+	bandError    = 3
+)
+
+// sidebandWriter sends everything written to it on one channel of a
+// multiplexed ("side-band") stream
+type sidebandWriter struct {
+	pw   *pktWriter
+	band byte
+	max  int // the largest payload, not counting the band
+}
+
+func (sw *sidebandWriter) Write(data []byte) (int, error) {
+	buf := make([]byte, 0, sw.max+1)
+	n := 0
+	for n < len(data) {
+		chunk := data[n:]
+		if len(chunk) > sw.max {
+			chunk = chunk[:sw.max]
+		}
+		buf = append(append(buf[:0], sw.band), chunk...)
+		if err := sw.pw.write(buf); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
@@ -0,0 +1,94 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+var ErrBadReflog = errors.New("malformed reflog")
+
+// A ReflogEntry records one change to a ref
+type ReflogEntry struct {
+	Old     Ptr
+	New     Ptr
+	Who     *Stamp
+	Message string
+}
+
+// optional interface, for stores that keep reflogs
+type ReflogReader interface {
+	Reflog(name string) ([]ReflogEntry, error)
+}
+
+// Reflog reads the log of changes to a ref (given by its full name,
+// like "refs/heads/main"), oldest first.  A ref with no log has no
+// entries
+func (g *GitDir) Reflog(name string) ([]ReflogEntry, error) {
+	if !validRefName(name) {
+		return nil, ErrInvalidRef
+	}
+	buf, err := ioutil.ReadFile(path.Join(g.Dir, "logs", name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseReflog(buf)
+}
+
+// parseReflog parses lines of the form
+//
+//	<old> <new> <name> <<email>> <time> <tz>\t<message>
+func parseReflog(buf []byte) ([]ReflogEntry, error) {
+	var lst []ReflogEntry
+	scan := bufio.NewScanner(bytes.NewReader(buf))
+	for scan.Scan() {
+		line := scan.Text()
+		if len(line) < 82 || line[40] != ' ' || line[81] != ' ' {
+			return nil, ErrBadReflog
+		}
+		var e ReflogEntry
+		var ok bool
+		if e.Old, ok = ParsePtr(line[:40]); !ok {
+			return nil, ErrBadReflog
+		}
+		if e.New, ok = ParsePtr(line[41:81]); !ok {
+			return nil, ErrBadReflog
+		}
+		who := line[82:]
+		if k := strings.IndexByte(who, '\t'); k >= 0 {
+			e.Message = who[k+1:]
+			who = who[:k]
+		}
+		s, err := parseStamp([]byte(who))
+		if err != nil {
+			return nil, err
+		}
+		e.Who = s
+		lst = append(lst, e)
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	return lst, nil
+}
+
+// Reflog returns the reflog for a ref from the first store that has
+// one
+func (g *Git) Reflog(name string) ([]ReflogEntry, error) {
+	for _, store := range g.storeList() {
+		if rr, ok := store.(ReflogReader); ok {
+			lst, err := rr.Reflog(name)
+			if err != nil || len(lst) > 0 {
+				return lst, err
+			}
+		}
+	}
+	return nil, nil
+}
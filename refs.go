@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 )
 
 func (g *Git) Branch(name string) (*Ptr, error) {
@@ -23,7 +24,7 @@ func (g *Git) Tag(name string) (*Ptr, error) {
 }
 
 func (g *Git) readRef(t RefType, name string) (*NamedRef, error) {
-	for _, store := range g.stores {
+	for _, store := range g.storeList() {
 		nr := store.GetNamed(t, name)
 		if nr != nil {
 			return nr, nil
@@ -35,7 +36,7 @@ func (g *Git) readRef(t RefType, name string) (*NamedRef, error) {
 	case Tag:
 		return nil, ErrNoTag
 	default:
-		panic("invalid ref type")
+		return nil, ErrNoRef
 	}
 }
 
@@ -44,6 +45,7 @@ type RefType int
 const (
 	Head = RefType(iota)
 	Tag
+	Remote
 )
 
 func (t RefType) String() string {
@@ -52,6 +54,8 @@ func (t RefType) String() string {
 		return "heads"
 	case Tag:
 		return "tags"
+	case Remote:
+		return "remotes"
 	default:
 		panic("unknown reftype")
 	}
@@ -61,10 +65,32 @@ type NamedRef struct {
 	Ptr     Ptr
 	RefType RefType
 	Name    string
+	Peeled  *Ptr // what an annotated tag points to, if known
 }
 
+// NameEnumerate lists the refs of the given type, both loose and
+// in packed-refs.  A loose ref overrides a packed one of the same
+// name, because git only updates the loose copy
 func (g *GitDir) NameEnumerate(t RefType) ([]NamedRef, error) {
-	return g.walkLinks(t, path.Join(g.Dir, "refs", t.String()))
+	loose, err := g.walkLinks(t, path.Join(g.Dir, "refs", t.String()))
+	if err != nil {
+		return nil, err
+	}
+	packed, err := g.enumPacked(t)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(loose))
+	for _, nr := range loose {
+		seen[nr.Name] = true
+	}
+	for _, nr := range packed {
+		if !seen[nr.Name] {
+			loose = append(loose, nr)
+		}
+	}
+	return loose, nil
 }
 
 func (g *GitDir) walkLinks(t RefType, refdir string) ([]NamedRef, error) {
@@ -75,6 +101,10 @@ func (g *GitDir) walkLinks(t RefType, refdir string) ([]NamedRef, error) {
 		d := path.Join(refdir, pre)
 		fi, err := ioutil.ReadDir(d)
 		if err != nil {
+			if pre == "" && os.IsNotExist(err) {
+				// no loose refs of this type at all
+				return nil
+			}
 			log.Error("Error walking refs: %s", err)
 			return err
 		}
@@ -87,15 +117,23 @@ func (g *GitDir) walkLinks(t RefType, refdir string) ([]NamedRef, error) {
 					return err
 				}
 			} else {
-				ptr, err := g.readRef(path.Join(d, n))
+				full := path.Join("refs", t.String(), refname)
+				r, err := resolveRef(g.ReadRef, full)
 				if err != nil {
-					log.Error("could not read ref %s", err)
-					return err
+					// a broken ref, such as a symref loop,
+					// shouldn't hide all the others
+					log.Warning("ignoring broken ref %s: %s", full, err)
+					continue
+				}
+				if r.Unborn {
+					// a dangling symref, like origin/HEAD
+					// after the branch it names is deleted
+					continue
 				}
 				nr := NamedRef{
 					RefType: t,
 					Name:    refname,
-					Ptr:     *ptr,
+					Ptr:     r.Ptr,
 				}
 				ret = append(ret, nr)
 			}
@@ -110,43 +148,127 @@ func (g *GitDir) walkLinks(t RefType, refdir string) ([]NamedRef, error) {
 }
 
 func (g *GitDir) Branches() ([]NamedRef, error) {
-	return g.walkLinks(Head, "heads")
+	return g.NameEnumerate(Head)
 }
 
 func (g *GitDir) Tags() ([]NamedRef, error) {
-	return g.walkLinks(Tag, "tags")
+	return g.NameEnumerate(Tag)
 }
 
 func (g *GitDir) GetNamed(t RefType, name string) *NamedRef {
-	ptr, err := g.readRef(path.Join(g.Dir, "refs", t.String(), name))
+	r, err := resolveRef(g.ReadRef, path.Join("refs", t.String(), name))
 	if err != nil {
-		if !os.IsNotExist(err) {
+		if err != ErrNoRef {
 			log.Warning("Failed to read %s/%s: %s", t, name, err)
 		}
 		return nil
 	}
-	return &NamedRef{
-		Ptr:     *ptr,
+	if r.Unborn {
+		return nil
+	}
+	nr := &NamedRef{
+		Ptr:     r.Ptr,
 		RefType: t,
 		Name:    name,
 	}
+	if r.Target == r.Name {
+		// only the packed copy knows the peeled value
+		if packed := g.getPacked(t, name); packed != nil && packed.Ptr == r.Ptr {
+			nr.Peeled = packed.Peeled
+		}
+	}
+	return nr
 }
 
-func (g *GitDir) readRef(file string) (*Ptr, error) {
-	buf, err := ioutil.ReadFile(file)
+// ReadRef reads a ref given its full name, such as "HEAD" or
+// "refs/heads/main", without following symbolic refs.  Loose refs
+// take precedence over packed-refs
+func (g *GitDir) ReadRef(name string) (*RawRef, error) {
+	if !validRefName(name) {
+		return nil, ErrInvalidRef
+	}
+	file := path.Join(g.Dir, name)
+	fi, err := os.Stat(file)
+	if err == nil && !fi.IsDir() {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return parseRef(name, buf)
+	}
+
+	pr, err := g.packed()
 	if err != nil {
 		return nil, err
 	}
-	// we expect it to be 41 bytes, which is a SHA1 + '\n'
-	if len(buf) != 41 {
-		return nil, ErrInvalidRef
+	if r := pr.refs[name]; r != nil {
+		return &RawRef{Name: name, Ptr: r.ptr}, nil
+	}
+	return nil, ErrNoRef
+}
+
+// WriteRef points a ref, given its full name, at an object.  It is
+// written as a loose ref, which overrides any copy in packed-refs
+func (g *GitDir) WriteRef(name string, p Ptr) error {
+	return g.writeRef(name, p.String()+"\n")
+}
+
+// WriteSymRef makes a ref (usually HEAD) a symbolic ref to another
+func (g *GitDir) WriteSymRef(name, target string) error {
+	if !validRefName(target) {
+		return ErrInvalidRef
+	}
+	return g.writeRef(name, "ref: "+target+"\n")
+}
+
+func (g *GitDir) writeRef(name, content string) error {
+	if !validRefName(name) {
+		return ErrInvalidRef
+	}
+	file := path.Join(g.Dir, name)
+	if err := os.MkdirAll(path.Dir(file), 0777); err != nil {
+		return err
 	}
-	if buf[40] != '\n' {
+	return writeLocked(file, []byte(content))
+}
+
+// parseRef parses the contents of a loose ref file, which is either
+// a hex object name or "ref: " and the name of another ref
+func parseRef(name string, buf []byte) (*RawRef, error) {
+	s := strings.TrimRight(string(buf), " \t\r\n")
+	if strings.HasPrefix(s, "ref: ") {
+		target := strings.TrimSpace(s[5:])
+		if !validRefName(target) {
+			return nil, ErrInvalidRef
+		}
+		return &RawRef{Name: name, Target: target}, nil
+	}
+	p, ok := ParsePtr(s)
+	if !ok {
 		return nil, ErrInvalidRef
 	}
-	p, ok := ParsePtr(string(buf[:40]))
-	if ok {
-		return &p, nil
+	return &RawRef{Name: name, Ptr: p}, nil
+}
+
+// validRefName checks that a full ref name is either one of the
+// special all-caps names in the top level (HEAD, FETCH_HEAD, etc.)
+// or something under refs/, and cannot escape the git directory
+func validRefName(name string) bool {
+	if strings.HasPrefix(name, "refs/") {
+		for _, comp := range strings.Split(name, "/") {
+			if comp == "" || comp == "." || comp == ".." {
+				return false
+			}
+		}
+		return true
+	}
+	if name == "" {
+		return false
+	}
+	for _, ch := range name {
+		if !(ch >= 'A' && ch <= 'Z') && ch != '_' {
+			return false
+		}
 	}
-	return nil, ErrInvalidRef
+	return true
 }
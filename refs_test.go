@@ -0,0 +1,138 @@
+package git
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPackedRefs(t *testing.T) {
+	dir := makeTestRepo(t)
+	gitCmd(t, dir, "", "tag", "-a", "-m", "release", "v1", "HEAD~1")
+	gitCmd(t, dir, "", "tag", "light", "HEAD~2")
+	gitCmd(t, dir, "", "branch", "old", "HEAD~2")
+	gitCmd(t, dir, "", "pack-refs", "--all", "--prune")
+	// a loose ref takes precedence over the packed copy
+	gitCmd(t, dir, "", "update-ref", "refs/heads/old", "HEAD~1")
+
+	rev := func(r string) string {
+		return strings.TrimSpace(gitCmd(t, dir, "", "rev-parse", r))
+	}
+
+	g, err := Open(dir + "/.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := g.Branch("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.String() != rev("main") {
+		t.Fatalf("main is %s", p)
+	}
+	p, err = g.Branch("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.String() != rev("HEAD~1") {
+		t.Fatalf("old is %s, loose ref should win", p)
+	}
+
+	tags, err := g.Tags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]NamedRef{}
+	for _, nr := range tags {
+		found[nr.Name] = nr
+	}
+	if len(found) != 2 {
+		t.Fatalf("expected 2 tags, got %v", tags)
+	}
+	v1 := found["v1"]
+	if v1.Ptr.String() != rev("v1") || v1.Peeled == nil || v1.Peeled.String() != rev("v1^{}") {
+		t.Fatalf("bad v1 %#v", v1)
+	}
+	light := found["light"]
+	if light.Ptr.String() != rev("light") || light.Peeled != nil {
+		t.Fatalf("bad light %#v", light)
+	}
+
+	branches, err := g.Branches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(branches) != 2 {
+		t.Fatalf("expected 2 branches, got %v", branches)
+	}
+}
+
+func TestSymbolicRefs(t *testing.T) {
+	dir := makeTestRepo(t)
+	gitDir := dir + "/.git"
+	rev := func(r string) string {
+		return strings.TrimSpace(gitCmd(t, dir, "", "rev-parse", r))
+	}
+	g, err := Open(gitDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := g.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Detached() || h.Branch() != "main" || h.Ptr.String() != rev("HEAD") {
+		t.Fatalf("bad HEAD %#v", h)
+	}
+
+	gitCmd(t, dir, "", "update-ref", "refs/remotes/origin/main", "HEAD~1")
+	gitCmd(t, dir, "", "symbolic-ref", "refs/remotes/origin/HEAD", "refs/remotes/origin/main")
+	r, err := g.ResolveRef("refs/remotes/origin/HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Target != "refs/remotes/origin/main" || r.Ptr.String() != rev("HEAD~1") {
+		t.Fatalf("bad origin/HEAD %#v", r)
+	}
+	remotes, err := g.enumNamed(Remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remotes) != 2 {
+		t.Fatalf("expected 2 remote refs, got %v", remotes)
+	}
+
+	gitCmd(t, dir, "", "checkout", "-q", "--detach", "HEAD~2")
+	h, err = g.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Detached() || h.Ptr.String() != rev("HEAD") {
+		t.Fatalf("expected detached HEAD, got %#v", h)
+	}
+
+	gitCmd(t, dir, "", "symbolic-ref", "HEAD", "refs/heads/nothing-yet")
+	h, err = g.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Unborn || h.Branch() != "nothing-yet" {
+		t.Fatalf("expected unborn branch, got %#v", h)
+	}
+
+	gitCmd(t, dir, "", "symbolic-ref", "refs/heads/a", "refs/heads/b")
+	gitCmd(t, dir, "", "symbolic-ref", "refs/heads/b", "refs/heads/a")
+	if _, err := g.ResolveRef("refs/heads/a"); err != ErrRefLoop {
+		t.Fatalf("expected loop error, got %v", err)
+	}
+	branches, err := g.Branches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(branches) != 1 || branches[0].Name != "main" {
+		t.Fatalf("expected the looping refs to be left out, got %v", branches)
+	}
+	if _, err := g.ResolveRef("refs/../../etc/passwd"); err != ErrInvalidRef {
+		t.Fatalf("expected invalid ref, got %v", err)
+	}
+}
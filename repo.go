@@ -8,6 +8,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 )
 
 var ErrNoBranch = errors.New("no such branch")
@@ -15,8 +16,13 @@ var ErrNoTag = errors.New("no such tag")
 
 var log = logging.New("git")
 
+// A Git may be shared by any number of goroutines; lock covers the
+// list of stores and the writer, which can change while it is in use
+// (as when a fetched pack is added)
 type Git struct {
+	lock   sync.RWMutex
 	stores []Store
+	writer ObjectWriter
 }
 
 func New() *Git {
@@ -24,9 +30,21 @@ func New() *Git {
 }
 
 func (g *Git) AddStore(s Store) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	// (appending never changes what a storeList already returned
+	// can see)
 	g.stores = append(g.stores, s)
 }
 
+// storeList returns the stores as they are now, to range over
+// without holding the lock
+func (g *Git) storeList() []Store {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.stores
+}
+
 type Store interface {
 	GetNamed(RefType, string) *NamedRef
 	Get(obj *Ptr) GitObject
@@ -38,9 +56,70 @@ type NameEnumerater interface {
 	NameEnumerate(t RefType) ([]NamedRef, error)
 }
 
+// optional interface, for stores that can accept new objects
+type ObjectWriter interface {
+	Put(t ObjType, payload []byte) (Ptr, error)
+}
+
+var ErrReadOnly = errors.New("no writable store")
+
+// SetWriter designates the store that new objects are written to.
+// If none is designated, Put uses the first store that can accept
+// writes
+func (g *Git) SetWriter(w ObjectWriter) {
+	g.lock.Lock()
+	g.writer = w
+	g.lock.Unlock()
+}
+
+// Put stores a new object with the given type and payload (not
+// including the preamble), returning its name
+func (g *Git) Put(t ObjType, payload []byte) (Ptr, error) {
+	g.lock.RLock()
+	w := g.writer
+	g.lock.RUnlock()
+	if w == nil {
+		for _, store := range g.storeList() {
+			if ow, ok := store.(ObjectWriter); ok {
+				w = ow
+				break
+			}
+		}
+	}
+	if w == nil {
+		return Ptr{}, ErrReadOnly
+	}
+	return w.Put(t, payload)
+}
+
+// Init creates an empty bare repository in d, as "git init --bare"
+// does, and opens it.  Anything already there is left alone
+func Init(d string) (*Git, error) {
+	for _, dir := range []string{"objects/info", "objects/pack", "refs/heads", "refs/tags"} {
+		if err := os.MkdirAll(path.Join(d, dir), 0777); err != nil {
+			return nil, err
+		}
+	}
+	files := []struct{ name, content string }{
+		{"HEAD", "ref: refs/heads/master\n"},
+		{"config", "[core]\n\trepositoryformatversion = 0\n\tfilemode = true\n\tbare = true\n"},
+	}
+	for _, f := range files {
+		file := path.Join(d, f.name)
+		if _, err := os.Stat(file); err == nil {
+			continue
+		}
+		if err := ioutil.WriteFile(file, []byte(f.content), 0666); err != nil {
+			return nil, err
+		}
+	}
+	return Open(d)
+}
+
 func Open(d string) (*Git, error) {
 	g := &Git{}
-	Bare(g, d)
+	bare, _ := Bare(g, d)
+	g.SetWriter(bare)
 
 	lst, err := ioutil.ReadDir(path.Join(d, "objects/pack"))
 
@@ -60,7 +139,7 @@ func Open(d string) (*Git, error) {
 }
 
 func (g *Git) Get(p *Ptr) GitObject {
-	for _, store := range g.stores {
+	for _, store := range g.storeList() {
 		o := store.Get(p)
 		if o != nil {
 			return o
@@ -69,6 +148,28 @@ func (g *Git) Get(p *Ptr) GitObject {
 	return nil
 }
 
+// rawObject returns the type and payload (without the preamble) of
+// the named object, from whichever store has it
+func (g *Git) rawObject(p *Ptr) ([]byte, ObjType, error) {
+	o := g.Get(p)
+	if o == nil {
+		return nil, ObjNone, ErrMissingObject
+	}
+	if po, ok := o.(*PackedObject); ok {
+		// avoid interpreting the object just to get its bytes
+		return po.deDeltaifiedBytes(0)
+	}
+	x, err := o.Load()
+	if err != nil {
+		return nil, ObjNone, err
+	}
+	buf, err := x.Payload()
+	if err != nil {
+		return nil, ObjNone, err
+	}
+	return buf, x.Type(), nil
+}
+
 func (g *Git) Enumerate() <-chan Ptr {
 	ch := make(chan Ptr, 10000)
 
@@ -79,7 +180,7 @@ func (g *Git) Enumerate() <-chan Ptr {
 func (g *Git) enumerateTo(to chan<- Ptr) {
 	defer close(to)
 
-	for _, store := range g.stores {
+	for _, store := range g.storeList() {
 		store.EnumerateTo(to)
 	}
 }
@@ -134,7 +235,7 @@ func (g *GitDir) EnumerateTo(to chan<- Ptr) {
 
 func (g *Git) enumNamed(t RefType) ([]NamedRef, error) {
 	var lst []NamedRef
-	for _, store := range g.stores {
+	for _, store := range g.storeList() {
 		if ne, ok := store.(NameEnumerater); ok {
 			more, err := ne.NameEnumerate(t)
 			if err != nil {
@@ -0,0 +1,438 @@
+package git
+
+import (
+	"io"
+	"strings"
+)
+
+type RevOrder int
+
+const (
+	// OrderDefault is the order the walk finds commits in, which
+	// is newest first by committer date, like plain "git rev-list"
+	OrderDefault = RevOrder(iota)
+	// OrderDate is like OrderDefault, but never shows a parent
+	// before all of its children ("--date-order")
+	OrderDate
+	// OrderTopo never shows a parent before all of its children,
+	// and avoids interleaving lines of history ("--topo-order")
+	OrderTopo
+)
+
+// RevListOptions selects the commits for a RevWalker, the way the
+// arguments to "git rev-list" do
+type RevListOptions struct {
+	Include     []Ptr // start from these commits...
+	Exclude     []Ptr // ...but leave out anything reachable from these
+	Order       RevOrder
+	Reverse     bool // show oldest first; applied after Skip and Limit
+	FirstParent bool // only follow the first parent of merges
+	Skip        int  // leave out this many commits first
+	Limit       int  // show at most this many commits, if > 0
+}
+
+// AddRevision adds a rev-list argument to the options.  This can be
+// a revision ("main"), an exclusion ("^main"), a range ("A..B",
+// which is "B ^A") or a symmetric difference ("A...B", the commits
+// reachable from either but not both).  A missing side of a range
+// means HEAD
+func (o *RevListOptions) AddRevision(g *Git, spec string) error {
+	if strings.HasPrefix(spec, "^") {
+		p, err := g.ResolveRevision(spec[1:])
+		if err != nil {
+			return err
+		}
+		o.Exclude = append(o.Exclude, *p)
+		return nil
+	}
+
+	sides := func(sep string) (*Ptr, *Ptr, error) {
+		k := strings.Index(spec, sep)
+		left, right := spec[:k], spec[k+len(sep):]
+		if left == "" {
+			left = "HEAD"
+		}
+		if right == "" {
+			right = "HEAD"
+		}
+		a, err := g.ResolveRevision(left)
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := g.ResolveRevision(right)
+		if err != nil {
+			return nil, nil, err
+		}
+		return a, b, nil
+	}
+
+	if strings.Contains(spec, "...") {
+		a, b, err := sides("...")
+		if err != nil {
+			return err
+		}
+		ca, err := g.peelToCommit(a)
+		if err != nil {
+			return err
+		}
+		cb, err := g.peelToCommit(b)
+		if err != nil {
+			return err
+		}
+		bases, err := g.mergeBases(ca, []*Commit{cb})
+		if err != nil {
+			return err
+		}
+		o.Include = append(o.Include, ca.name, cb.name)
+		for _, c := range bases {
+			o.Exclude = append(o.Exclude, c.name)
+		}
+		return nil
+	}
+
+	if strings.Contains(spec, "..") {
+		a, b, err := sides("..")
+		if err != nil {
+			return err
+		}
+		o.Exclude = append(o.Exclude, *a)
+		o.Include = append(o.Include, *b)
+		return nil
+	}
+
+	p, err := g.ResolveRevision(spec)
+	if err != nil {
+		return err
+	}
+	o.Include = append(o.Include, *p)
+	return nil
+}
+
+// A RevWalker iterates over the commits selected by a
+// RevListOptions
+type RevWalker struct {
+	repo    *Git
+	opts    RevListOptions
+	seen    map[Ptr]*walkState
+	queue   commitQueue
+	started bool
+	list    []*Commit // when the whole list has to be computed up front
+	listed  bool
+	shown   int
+	skipped int
+}
+
+type walkState struct {
+	c             *Commit
+	uninteresting bool
+	added         bool // parents have been queued
+}
+
+// how many extra uninteresting commits to walk, to cope with clock
+// skew, once everything left is uninteresting (the same as git)
+const walkSlop = 5
+
+// RevList starts a walk over the commits selected by opts
+func (g *Git) RevList(opts *RevListOptions) *RevWalker {
+	return &RevWalker{
+		repo: g,
+		opts: *opts,
+		seen: make(map[Ptr]*walkState),
+	}
+}
+
+// Next returns the next commit in the walk, or io.EOF when there
+// are no more
+func (w *RevWalker) Next() (*Commit, error) {
+	if !w.started {
+		w.started = true
+		err := w.start()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if w.needList() {
+		if !w.listed {
+			err := w.buildList()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(w.list) == 0 {
+			return nil, io.EOF
+		}
+		c := w.list[0]
+		w.list = w.list[1:]
+		return c, nil
+	}
+
+	if w.opts.Limit > 0 && w.shown >= w.opts.Limit {
+		return nil, io.EOF
+	}
+	for w.queue.Len() > 0 {
+		c, err := w.step()
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			continue
+		}
+		if w.skipped < w.opts.Skip {
+			w.skipped++
+			continue
+		}
+		w.shown++
+		return c, nil
+	}
+	return nil, io.EOF
+}
+
+// needList is true if the walk can't be streamed, because the
+// commits to exclude or the order can only be known by looking at
+// everything first
+func (w *RevWalker) needList() bool {
+	return len(w.opts.Exclude) > 0 ||
+		w.opts.Order != OrderDefault ||
+		w.opts.Reverse
+}
+
+func (w *RevWalker) start() error {
+	for i := range w.opts.Exclude {
+		err := w.push(&w.opts.Exclude[i], true)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range w.opts.Include {
+		err := w.push(&w.opts.Include[i], false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// push adds a starting point, following any tags to the commit
+func (w *RevWalker) push(p *Ptr, uninteresting bool) error {
+	c, err := w.repo.peelToCommit(p)
+	if err != nil {
+		return err
+	}
+	ws := w.seen[c.name]
+	if ws == nil {
+		ws = &walkState{c: c}
+		w.seen[c.name] = ws
+		w.queue.put(c)
+	}
+	if uninteresting {
+		w.markUninteresting(ws)
+	}
+	return nil
+}
+
+// step takes the next commit off the queue and queues its parents.
+// It returns the commit if it is (so far) interesting
+func (w *RevWalker) step() (*Commit, error) {
+	c := w.queue.get()
+	ws := w.seen[c.name]
+	ws.added = true
+
+	parents := c.Parents
+	if w.opts.FirstParent && !ws.uninteresting && len(parents) > 1 {
+		parents = parents[:1]
+	}
+	for i := range parents {
+		p := &parents[i]
+		ps := w.seen[*p]
+		if ps == nil {
+			pc, err := w.repo.loadCommitPtr(p)
+			if err != nil {
+				return nil, err
+			}
+			ps = &walkState{c: pc}
+			w.seen[*p] = ps
+			w.queue.put(pc)
+		}
+		if ws.uninteresting {
+			w.markUninteresting(ps)
+		}
+	}
+	if ws.uninteresting {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// markUninteresting marks a commit and all of its ancestors that we
+// have already seen as uninteresting
+func (w *RevWalker) markUninteresting(ws *walkState) {
+	stack := []*walkState{ws}
+	for len(stack) > 0 {
+		at := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if at.uninteresting {
+			continue
+		}
+		at.uninteresting = true
+		if !at.added {
+			// its parents will be marked when it comes off
+			// the queue
+			continue
+		}
+		for i := range at.c.Parents {
+			if ps := w.seen[at.c.Parents[i]]; ps != nil {
+				stack = append(stack, ps)
+			}
+		}
+	}
+}
+
+// everythingUninteresting is true if nothing left in the queue can
+// lead to another interesting commit
+func (w *RevWalker) everythingUninteresting() bool {
+	for _, item := range w.queue.items {
+		if !w.seen[item.c.name].uninteresting {
+			return false
+		}
+	}
+	return true
+}
+
+// buildList walks everything that could be in the output, and then
+// puts it in the requested order
+func (w *RevWalker) buildList() error {
+	w.listed = true
+
+	var found []*Commit
+	slop := walkSlop
+	for w.queue.Len() > 0 {
+		c, err := w.step()
+		if err != nil {
+			return err
+		}
+		if c != nil {
+			found = append(found, c)
+		}
+		if len(w.opts.Exclude) == 0 {
+			continue
+		}
+		if w.everythingUninteresting() {
+			slop--
+			if slop == 0 {
+				break
+			}
+		} else {
+			slop = walkSlop
+		}
+	}
+
+	// something found early may have turned out to be reachable
+	// from an excluded commit after all
+	lst := found[:0]
+	for _, c := range found {
+		if !w.seen[c.name].uninteresting {
+			lst = append(lst, c)
+		}
+	}
+
+	switch w.opts.Order {
+	case OrderDate, OrderTopo:
+		lst = w.sortTopo(lst)
+	}
+
+	if w.opts.Skip >= len(lst) {
+		lst = nil
+	} else {
+		lst = lst[w.opts.Skip:]
+	}
+	if w.opts.Limit > 0 && len(lst) > w.opts.Limit {
+		lst = lst[:w.opts.Limit]
+	}
+	if w.opts.Reverse {
+		for i, j := 0, len(lst)-1; i < j; i, j = i+1, j-1 {
+			lst[i], lst[j] = lst[j], lst[i]
+		}
+	}
+	w.list = lst
+	return nil
+}
+
+// sortTopo orders commits so that no parent comes before any of its
+// children.  Among the commits that are ready to be shown, OrderDate
+// picks the newest, and OrderTopo picks the one most recently made
+// ready, which keeps each line of history together
+func (w *RevWalker) sortTopo(lst []*Commit) []*Commit {
+	// lst is in walk order, which is roughly newest first
+	index := make(map[Ptr]bool, len(lst))
+	for _, c := range lst {
+		index[c.name] = true
+	}
+	parentsOf := func(c *Commit) []Ptr {
+		if w.opts.FirstParent && len(c.Parents) > 1 {
+			return c.Parents[:1]
+		}
+		return c.Parents
+	}
+	children := make(map[Ptr]int, len(lst))
+	for _, c := range lst {
+		for _, p := range parentsOf(c) {
+			if index[p] {
+				children[p]++
+			}
+		}
+	}
+	byName := make(map[Ptr]*Commit, len(lst))
+	for _, c := range lst {
+		byName[c.name] = c
+	}
+
+	out := make([]*Commit, 0, len(lst))
+	if w.opts.Order == OrderDate {
+		q := &commitQueue{}
+		for _, c := range lst {
+			if children[c.name] == 0 {
+				q.put(c)
+			}
+		}
+		for q.Len() > 0 {
+			c := q.get()
+			out = append(out, c)
+			for _, p := range parentsOf(c) {
+				if !index[p] {
+					continue
+				}
+				children[p]--
+				if children[p] == 0 {
+					q.put(byName[p])
+				}
+			}
+		}
+		return out
+	}
+
+	// a stack, with the newest tip on top
+	var stack []*Commit
+	for i := len(lst) - 1; i >= 0; i-- {
+		if children[lst[i].name] == 0 {
+			stack = append(stack, lst[i])
+		}
+	}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		out = append(out, c)
+		// like git, this means the last parent of a merge is
+		// followed first
+		for _, p := range parentsOf(c) {
+			if !index[p] {
+				continue
+			}
+			children[p]--
+			if children[p] == 0 {
+				stack = append(stack, byName[p])
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,95 @@
+package git
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// makeHistoryRepo builds a repository with some branching and
+// merging, where the commit dates interleave the branches
+func makeHistoryRepo(t *testing.T) string {
+	dir := t.TempDir()
+	initRepo(t, dir)
+
+	date := 1500000000
+	commit := func(msg string) {
+		writeFile(t, dir, msg, msg+"\n")
+		gitCmd(t, dir, "", "add", msg)
+		d := fmt.Sprintf("%d -0500", date)
+		gitCmdEnv(t, dir, []string{"GIT_AUTHOR_DATE=" + d, "GIT_COMMITTER_DATE=" + d},
+			"", "commit", "-q", "-m", msg)
+		date += 100
+	}
+	commit("a")
+	commit("b")
+	gitCmd(t, dir, "", "checkout", "-q", "-b", "topic")
+	commit("c")
+	commit("d")
+	gitCmd(t, dir, "", "checkout", "-q", "main")
+	commit("e")
+	gitCmd(t, dir, "", "merge", "-q", "--no-ff", "-m", "merge", "topic")
+	commit("f")
+	gitCmd(t, dir, "", "checkout", "-q", "topic")
+	commit("g")
+	gitCmd(t, dir, "", "checkout", "-q", "main")
+	return dir
+}
+
+func walkAll(t *testing.T, w *RevWalker) string {
+	var lst []string
+	for {
+		c, err := w.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		lst = append(lst, c.name.String())
+	}
+	return strings.Join(lst, "\n")
+}
+
+func TestRevList(t *testing.T) {
+	dir := makeHistoryRepo(t)
+	g, err := Open(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		revs  []string
+		flags []string
+		opts  RevListOptions
+	}{
+		{[]string{"main"}, nil, RevListOptions{}},
+		{[]string{"main", "topic"}, nil, RevListOptions{}},
+		{[]string{"topic..main"}, nil, RevListOptions{}},
+		{[]string{"main...topic"}, nil, RevListOptions{}},
+		{[]string{"main", "^topic~1"}, nil, RevListOptions{}},
+		{[]string{"main"}, []string{"--topo-order"}, RevListOptions{Order: OrderTopo}},
+		{[]string{"main", "topic"}, []string{"--date-order"}, RevListOptions{Order: OrderDate}},
+		{[]string{"main"}, []string{"--reverse"}, RevListOptions{Reverse: true}},
+		{[]string{"main"}, []string{"--first-parent"}, RevListOptions{FirstParent: true}},
+		{[]string{"main"}, []string{"--skip=1", "-n3"}, RevListOptions{Skip: 1, Limit: 3}},
+		{[]string{"main"}, []string{"--reverse", "-n2"}, RevListOptions{Reverse: true, Limit: 2}},
+		{[]string{"main", "^topic"}, []string{"--topo-order", "--reverse"}, RevListOptions{Order: OrderTopo, Reverse: true}},
+	}
+	for _, c := range cases {
+		opts := c.opts
+		for _, r := range c.revs {
+			if err := opts.AddRevision(g, r); err != nil {
+				t.Fatalf("%v: %s", c.revs, err)
+			}
+		}
+		args := append(append([]string{"rev-list"}, c.flags...), c.revs...)
+		want := strings.TrimSpace(gitCmd(t, dir, "", args...))
+		got := walkAll(t, g.RevList(&opts))
+		if got != want {
+			t.Errorf("%v: got\n%s\nexpected\n%s", args, got, want)
+		}
+	}
+}
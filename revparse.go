@@ -0,0 +1,426 @@
+package git
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrBadRevision = errors.New("invalid revision syntax")
+var ErrUnknownRevision = errors.New("unknown revision")
+var ErrAmbiguousRevision = errors.New("ambiguous short object name")
+var ErrNoUpstream = errors.New("no upstream configured")
+var ErrNotCommit = errors.New("not a commit")
+var ErrNotTree = errors.New("not a tree")
+
+// git won't consider anything shorter than this an abbreviated name
+const minAbbrev = 4
+
+// optional interface, for stores that can look up objects by an
+// abbreviated name
+type PrefixFinder interface {
+	FindPrefix(prefix string) []Ptr
+}
+
+// the order in which git tries to expand a short ref name
+var refRevParseRules = []string{
+	"%s",
+	"refs/%s",
+	"refs/tags/%s",
+	"refs/heads/%s",
+	"refs/remotes/%s",
+	"refs/remotes/%s/HEAD",
+}
+
+// ResolveRevision interprets a revision expression the way
+// "git rev-parse" does, and returns the name of the object it
+// refers to.  Supported are full and abbreviated object names, ref
+// names (which are expanded the same way git does, so "main" can
+// mean refs/heads/main and "origin" refs/remotes/origin/HEAD), "@"
+// for HEAD, "<branch>@{upstream}" (or "@{u}"), and any sequence of
+// the suffixes "~N", "^N", "^{type}" and "^{}", optionally followed
+// by ":path" to name something in the resulting tree
+func (g *Git) ResolveRevision(rev string) (*Ptr, error) {
+	spec, treePath, hasPath := splitRevPath(rev)
+	if hasPath && spec == "" {
+		// ":path" refers to the index, which we don't read here
+		return nil, ErrBadRevision
+	}
+
+	// the base is everything up to the first navigation suffix
+	k := strings.IndexAny(spec, "~^")
+	base, suffix := spec, ""
+	if k >= 0 {
+		base, suffix = spec[:k], spec[k:]
+	}
+	p, err := g.resolveBase(base)
+	if err != nil {
+		return nil, err
+	}
+
+	for suffix != "" {
+		p, suffix, err = g.applyRevSuffix(p, suffix)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if hasPath {
+		return g.resolveTreePath(p, treePath)
+	}
+	return p, nil
+}
+
+// splitRevPath separates "rev:path", taking care not to split on a
+// colon inside braces
+func splitRevPath(rev string) (string, string, bool) {
+	depth := 0
+	for i := 0; i < len(rev); i++ {
+		switch rev[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ':':
+			if depth == 0 {
+				return rev[:i], rev[i+1:], true
+			}
+		}
+	}
+	return rev, "", false
+}
+
+func (g *Git) resolveBase(base string) (*Ptr, error) {
+	if base == "" || base == "@" {
+		base = "HEAD"
+	}
+	if k := strings.Index(base, "@{"); k >= 0 {
+		if !strings.HasSuffix(base, "}") {
+			return nil, ErrBadRevision
+		}
+		switch base[k+2 : len(base)-1] {
+		case "upstream", "u":
+			return g.resolveUpstream(base[:k])
+		default:
+			// reflog entries are not supported
+			return nil, ErrBadRevision
+		}
+	}
+
+	if p, ok := ParsePtr(base); ok {
+		return &p, nil
+	}
+	if p, err := g.dwimRef(base); err != ErrNoRef {
+		return p, err
+	}
+	if len(base) >= minAbbrev && len(base) < 40 && isHex(base) {
+		return g.resolveAbbrev(strings.ToLower(base))
+	}
+	return nil, ErrUnknownRevision
+}
+
+// dwimRef expands a short ref name using git's rules, returning
+// ErrNoRef if none of them match
+func (g *Git) dwimRef(name string) (*Ptr, error) {
+	full, err := g.dwimRefName(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := g.ResolveRef(full)
+	if err != nil {
+		return nil, err
+	}
+	return &r.Ptr, nil
+}
+
+// dwimRefName returns the full name of the ref that a short name
+// refers to
+func (g *Git) dwimRefName(name string) (string, error) {
+	for _, rule := range refRevParseRules {
+		full := strings.Replace(rule, "%s", name, 1)
+		r, err := g.ResolveRef(full)
+		if err == ErrNoRef || err == ErrInvalidRef {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if r.Unborn {
+			continue
+		}
+		return full, nil
+	}
+	return "", ErrNoRef
+}
+
+func isHex(s string) bool {
+	for _, ch := range s {
+		if !(ch >= '0' && ch <= '9') && !(ch >= 'a' && ch <= 'f') && !(ch >= 'A' && ch <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveAbbrev finds the unique object whose name starts with the
+// given prefix, in any store
+func (g *Git) resolveAbbrev(prefix string) (*Ptr, error) {
+	found := make(map[Ptr]bool)
+	for _, store := range g.storeList() {
+		if pf, ok := store.(PrefixFinder); ok {
+			for _, p := range pf.FindPrefix(prefix) {
+				found[p] = true
+			}
+		}
+	}
+	if len(found) > 1 {
+		return nil, ErrAmbiguousRevision
+	}
+	for p := range found {
+		return &p, nil
+	}
+	return nil, ErrUnknownRevision
+}
+
+// resolveUpstream finds the remote-tracking branch that a branch
+// (or, if branch is "", the current branch) is configured to track
+func (g *Git) resolveUpstream(branch string) (*Ptr, error) {
+	if branch == "" || branch == "HEAD" {
+		h, err := g.Head()
+		if err != nil {
+			return nil, err
+		}
+		branch = h.Branch()
+		if branch == "" {
+			// detached
+			return nil, ErrNoUpstream
+		}
+	}
+	branch = strings.TrimPrefix(branch, "refs/heads/")
+
+	cfg, err := g.Config()
+	if err != nil {
+		return nil, err
+	}
+	remote := cfg.Get("branch." + branch + ".remote")
+	merge := cfg.Get("branch." + branch + ".merge")
+	if remote == "" || merge == "" {
+		return nil, ErrNoUpstream
+	}
+
+	tracking := merge
+	if remote != "." {
+		tracking = ""
+		for _, spec := range cfg.GetAll("remote." + remote + ".fetch") {
+			if dst, ok := applyRefSpec(spec, merge); ok {
+				tracking = dst
+				break
+			}
+		}
+		if tracking == "" {
+			return nil, ErrNoUpstream
+		}
+	}
+	r, err := g.ResolveRef(tracking)
+	if err != nil {
+		return nil, err
+	}
+	if r.Unborn {
+		return nil, ErrNoRef
+	}
+	return &r.Ptr, nil
+}
+
+// applyRefSpec maps a ref through a fetch refspec such as
+// "+refs/heads/*:refs/remotes/origin/*"
+func applyRefSpec(spec, ref string) (string, bool) {
+	spec = strings.TrimPrefix(spec, "+")
+	k := strings.IndexByte(spec, ':')
+	if k < 0 {
+		return "", false
+	}
+	src, dst := spec[:k], spec[k+1:]
+	star := strings.IndexByte(src, '*')
+	if star < 0 {
+		return dst, src == ref
+	}
+	pre, post := src[:star], src[star+1:]
+	if !strings.HasPrefix(ref, pre) || !strings.HasSuffix(ref, post) ||
+		len(ref) < len(pre)+len(post) {
+		return "", false
+	}
+	matched := ref[len(pre) : len(ref)-len(post)]
+	return strings.Replace(dst, "*", matched, 1), true
+}
+
+// applyRevSuffix applies the first navigation suffix in s, returning
+// the rest of s
+func (g *Git) applyRevSuffix(p *Ptr, s string) (*Ptr, string, error) {
+	op := s[0]
+	s = s[1:]
+
+	if op == '^' && strings.HasPrefix(s, "{") {
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return nil, "", ErrBadRevision
+		}
+		q, err := g.peelRevTo(p, s[1:end])
+		return q, s[end+1:], err
+	}
+
+	// an optional number; "~" and "^" on their own mean 1
+	n := 1
+	digits := 0
+	for digits < len(s) && s[digits] >= '0' && s[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 {
+		v, err := strconv.Atoi(s[:digits])
+		if err != nil {
+			return nil, "", ErrBadRevision
+		}
+		n = v
+		s = s[digits:]
+	}
+
+	c, err := g.peelToCommit(p)
+	if err != nil {
+		return nil, "", err
+	}
+	if op == '^' {
+		if n == 0 {
+			return &c.name, s, nil
+		}
+		if n > len(c.Parents) {
+			return nil, "", ErrUnknownRevision
+		}
+		return &c.Parents[n-1], s, nil
+	}
+
+	// op == '~'
+	for i := 0; i < n; i++ {
+		parent := c.FirstParent()
+		if parent == nil {
+			return nil, "", ErrUnknownRevision
+		}
+		c, err = g.loadCommitPtr(parent)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return &c.name, s, nil
+}
+
+// peelRevTo implements the "^{type}" suffix
+func (g *Git) peelRevTo(p *Ptr, what string) (*Ptr, error) {
+	switch what {
+	case "":
+		o, err := g.Peel(p)
+		if err != nil {
+			return nil, err
+		}
+		return o.Name(), nil
+	case "commit":
+		c, err := g.peelToCommit(p)
+		if err != nil {
+			return nil, err
+		}
+		return &c.name, nil
+	case "tree":
+		t, err := g.peelToTree(p)
+		if err != nil {
+			return nil, err
+		}
+		return &t.name, nil
+	case "blob", "tag", "object":
+		o, err := g.load(p)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			if what == "object" || o.Type().String() == what {
+				return o.Name(), nil
+			}
+			t, ok := o.(*AnnotatedTag)
+			if !ok {
+				return nil, ErrUnknownRevision
+			}
+			o, err = g.load(&t.Object)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, ErrBadRevision
+	}
+}
+
+// load finds and loads an object from any store
+func (g *Git) load(p *Ptr) (GitObject, error) {
+	o := g.Get(p)
+	if o == nil {
+		return nil, ErrMissingObject
+	}
+	return o.Load()
+}
+
+func (g *Git) loadCommitPtr(p *Ptr) (*Commit, error) {
+	o, err := g.load(p)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := o.(*Commit)
+	if !ok {
+		return nil, ErrNotCommit
+	}
+	return c, nil
+}
+
+// peelToCommit follows tags until reaching a commit
+func (g *Git) peelToCommit(p *Ptr) (*Commit, error) {
+	o, err := g.Peel(p)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := o.(*Commit)
+	if !ok {
+		return nil, ErrNotCommit
+	}
+	return c, nil
+}
+
+// peelToTree follows tags and commits until reaching a tree
+func (g *Git) peelToTree(p *Ptr) (*Tree, error) {
+	o, err := g.Peel(p)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := o.(*Commit); ok {
+		o, err = g.load(&c.Tree)
+		if err != nil {
+			return nil, err
+		}
+	}
+	t, ok := o.(*Tree)
+	if !ok {
+		return nil, ErrNotTree
+	}
+	return t, nil
+}
+
+// resolveTreePath implements "rev:path"
+func (g *Git) resolveTreePath(p *Ptr, treePath string) (*Ptr, error) {
+	t, err := g.peelToTree(p)
+	if err != nil {
+		return nil, err
+	}
+	treePath = strings.Trim(treePath, "/")
+	if treePath == "" {
+		return &t.name, nil
+	}
+	n := t.Walk(treePath)
+	if n == nil {
+		return nil, ErrNoEntry
+	}
+	return &n.Ref, nil
+}
@@ -0,0 +1,123 @@
+package git
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveRevision(t *testing.T) {
+	dir := makeTestRepo(t)
+	writeFile(t, dir, "other.txt", "side\n")
+	gitCmd(t, dir, "", "checkout", "-q", "-b", "side", "HEAD~1")
+	gitCmd(t, dir, "", "add", "other.txt")
+	gitCmd(t, dir, "", "commit", "-q", "-m", "side")
+	gitCmd(t, dir, "", "checkout", "-q", "main")
+	gitCmd(t, dir, "", "merge", "-q", "--no-ff", "-m", "merge", "side")
+	gitCmd(t, dir, "", "tag", "-a", "-m", "annotated", "v1", "HEAD^2")
+	gitCmd(t, dir, "", "update-ref", "refs/remotes/origin/main", "HEAD~2")
+	gitCmd(t, dir, "", "config", "branch.main.remote", "origin")
+	gitCmd(t, dir, "", "config", "branch.main.merge", "refs/heads/main")
+	gitCmd(t, dir, "", "config", "remote.origin.fetch", "+refs/heads/*:refs/remotes/origin/*")
+
+	g, err := Open(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head := strings.TrimSpace(gitCmd(t, dir, "", "rev-parse", "HEAD"))
+	cases := []string{
+		"HEAD",
+		"@",
+		"main",
+		"heads/main",
+		"refs/heads/main",
+		"side",
+		"v1",
+		"v1^{}",
+		"v1^{commit}",
+		"v1^{tree}",
+		"v1^{tag}",
+		"HEAD~",
+		"HEAD~2",
+		"HEAD^",
+		"HEAD^2",
+		"HEAD^2~1",
+		"HEAD^0",
+		"HEAD^^{tree}",
+		"HEAD:file.txt",
+		"v1:other.txt",
+		"HEAD~1:",
+		"origin/main",
+		"main@{upstream}",
+		"@{u}",
+		head,
+		head[:7],
+		strings.ToUpper(head[:10]),
+	}
+	for _, c := range cases {
+		want := strings.TrimSpace(gitCmd(t, dir, "", "rev-parse", c))
+		p, err := g.ResolveRevision(c)
+		if err != nil {
+			t.Errorf("%s: %s", c, err)
+			continue
+		}
+		if p.String() != want {
+			t.Errorf("%s: got %s, expected %s", c, p, want)
+		}
+	}
+
+	bad := map[string]error{
+		"nosuch":       ErrUnknownRevision,
+		"HEAD^3":       ErrUnknownRevision,
+		"HEAD~100":     ErrUnknownRevision,
+		"HEAD^{bogus}": ErrBadRevision,
+		"HEAD:missing": ErrNoEntry,
+		"side@{u}":     ErrNoUpstream,
+		"HEAD@{1}":     ErrBadRevision,
+	}
+	for c, want := range bad {
+		_, err := g.ResolveRevision(c)
+		if err != want {
+			t.Errorf("%s: expected %v, got %v", c, want, err)
+		}
+	}
+}
+
+func TestAmbiguousAbbrev(t *testing.T) {
+	g := New()
+	m := newMemStore(g)
+	g.stores = []Store{&prefixStore{m}}
+
+	name := m.add(ObjBlob, "x")
+	p, err := g.ResolveRevision(name.String()[:6])
+	if err != nil || !p.Equals(&name) {
+		t.Fatalf("got %v %v", p, err)
+	}
+
+	// fake up another object sharing all but the last digit
+	other := name
+	other.hash[19] ^= 1
+	m.objs[other] = m.objs[name]
+	if _, err := g.ResolveRevision(name.String()[:6]); err != ErrAmbiguousRevision {
+		t.Fatalf("expected ambiguity, got %v", err)
+	}
+	p, err = g.ResolveRevision(name.String())
+	if err != nil || !p.Equals(&name) {
+		t.Fatalf("full name: got %v %v", p, err)
+	}
+}
+
+type prefixStore struct {
+	*memStore
+}
+
+func (ps *prefixStore) FindPrefix(prefix string) []Ptr {
+	var lst []Ptr
+	for p := range ps.objs {
+		if strings.HasPrefix(p.String(), prefix) {
+			lst = append(lst, p)
+		}
+	}
+	return lst
+}
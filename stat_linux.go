@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package git
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// statData extracts what the index records about a file
+func statData(fi os.FileInfo) StatData {
+	sd := StatData{
+		MTime: fi.ModTime(),
+		Size:  uint32(fi.Size()),
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		sd.CTime = time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec))
+		sd.Dev = uint32(st.Dev)
+		sd.Ino = uint32(st.Ino)
+		sd.UID = st.Uid
+		sd.GID = st.Gid
+	}
+	return sd
+}
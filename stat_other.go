@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package git
+
+import (
+	"os"
+)
+
+// statData extracts what the index records about a file; only the
+// portable parts are available here
+func statData(fi os.FileInfo) StatData {
+	return StatData{
+		MTime: fi.ModTime(),
+		Size:  uint32(fi.Size()),
+	}
+}
@@ -0,0 +1,509 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// StatusOptions controls Status
+type StatusOptions struct {
+	// NoUntracked skips looking for untracked files, like "-uno"
+	NoUntracked bool
+	// DetectRenames pairs up staged deletions and additions
+	DetectRenames bool
+	// Refresh writes back the index if the stat data of any file was
+	// found to be out of date, so it needn't be hashed again next
+	// time.  git status does this
+	Refresh bool
+}
+
+// A StatusEntry describes a path which differs between HEAD, the
+// index and the work tree
+type StatusEntry struct {
+	Path string
+	// Staged is the difference between HEAD and the index, if any.
+	// For a rename, its OldPath is the original name
+	Staged *Change
+	// Unstaged is the difference between the index and the work
+	// tree, if any
+	Unstaged *Change
+	// Unmerged holds the index entries of a path with a conflict
+	Unmerged  []*IndexEntry
+	Untracked bool
+}
+
+// Status is the state of a work tree.  The entries are in order of
+// path, except that untracked files come last
+type Status struct {
+	Entries []*StatusEntry
+}
+
+// Clean returns true if there is nothing to report at all
+func (s *Status) Clean() bool {
+	return len(s.Entries) == 0
+}
+
+// Code returns the two letter status code, as shown by "git status
+// --short"
+func (e *StatusEntry) Code() string {
+	if e.Untracked {
+		return "??"
+	}
+	if e.Unmerged != nil {
+		return unmergedCode(e.Unmerged)
+	}
+	code := []byte("  ")
+	if e.Staged != nil {
+		code[0] = e.Staged.Type.String()[0]
+	}
+	if e.Unstaged != nil {
+		code[1] = e.Unstaged.Type.String()[0]
+	}
+	return string(code)
+}
+
+func unmergedCode(stages []*IndexEntry) string {
+	var have [4]bool
+	for _, e := range stages {
+		have[e.Stage] = true
+	}
+	switch {
+	case have[1] && have[2] && have[3]:
+		return "UU"
+	case have[2] && have[3]:
+		return "AA"
+	case have[1] && have[2]:
+		return "UD"
+	case have[1] && have[3]:
+		return "DU"
+	case have[2]:
+		return "AU"
+	case have[3]:
+		return "UA"
+	default:
+		return "DD"
+	}
+}
+
+// String formats the status like "git status --porcelain"
+func (s *Status) String() string {
+	var buf strings.Builder
+	for _, e := range s.Entries {
+		buf.WriteString(e.Code())
+		buf.WriteByte(' ')
+		if e.Staged != nil && (e.Staged.Type == Renamed || e.Staged.Type == Copied) {
+			buf.WriteString(quotePath(e.Staged.OldPath))
+			buf.WriteString(" -> ")
+		}
+		buf.WriteString(quotePath(e.Path))
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// Status compares HEAD, the index and the work tree in dir, like "git
+// status".  Files whose stat data matches the index are assumed to be
+// unchanged, so only files that look modified are read
+func (g *Git) Status(dir string, opts *StatusOptions) (*Status, error) {
+	if opts == nil {
+		opts = &StatusOptions{}
+	}
+	idx, err := g.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	head, err := g.headFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &statusScan{
+		repo:    g,
+		dir:     dir,
+		idx:     idx,
+		entries: make(map[string]*StatusEntry),
+		tracked: make(map[string]bool),
+		dirs:    make(map[string]bool),
+	}
+	for _, e := range idx.Entries {
+		s.tracked[e.Path] = true
+		for d := path.Dir(e.Path); d != "."; d = path.Dir(d) {
+			s.dirs[d] = true
+		}
+	}
+
+	if err := s.staged(head, opts.DetectRenames); err != nil {
+		return nil, err
+	}
+	if err := s.unstaged(); err != nil {
+		return nil, err
+	}
+	if !opts.NoUntracked {
+		m, err := g.ignoreMatcher()
+		if err != nil {
+			return nil, err
+		}
+		s.ignore = m
+		if err := s.walkUntracked("", false); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Refresh && s.refreshed {
+		if err := g.WriteIndex(idx); err != nil {
+			return nil, err
+		}
+	}
+
+	st := &Status{}
+	for _, e := range s.entries {
+		st.Entries = append(st.Entries, e)
+	}
+	sort.Slice(st.Entries, func(i, j int) bool {
+		return st.Entries[i].Path < st.Entries[j].Path
+	})
+	sort.Strings(s.untracked)
+	for _, p := range s.untracked {
+		st.Entries = append(st.Entries, &StatusEntry{Path: p, Untracked: true})
+	}
+	return st, nil
+}
+
+type statusScan struct {
+	repo      *Git
+	dir       string
+	idx       *Index
+	entries   map[string]*StatusEntry
+	tracked   map[string]bool // paths in the index
+	dirs      map[string]bool // directories with something in the index
+	ignore    *IgnoreMatcher
+	untracked []string
+	refreshed bool
+}
+
+func (s *statusScan) entry(p string) *StatusEntry {
+	e := s.entries[p]
+	if e == nil {
+		e = &StatusEntry{Path: p}
+		s.entries[p] = e
+	}
+	return e
+}
+
+// headFiles returns everything in HEAD's tree, by path; if HEAD is
+// unborn, there is nothing
+func (g *Git) headFiles() (map[string]*Node, error) {
+	files := make(map[string]*Node)
+	h, err := g.Head()
+	if err != nil {
+		return nil, err
+	}
+	if h.Unborn {
+		return files, nil
+	}
+	t, err := g.peelToTree(&h.Ptr)
+	if err != nil {
+		return nil, err
+	}
+	return files, g.flattenTree(t, "", files)
+}
+
+// flattenTree lists all the non-directory entries in a tree
+func (g *Git) flattenTree(t *Tree, dir string, out map[string]*Node) error {
+	for _, n := range t.Nodes() {
+		p := path.Join(dir, n.Name)
+		if !n.IsDir() {
+			out[p] = n
+			continue
+		}
+		sub, err := g.peelToTree(&n.Ref)
+		if err != nil {
+			return err
+		}
+		if err := g.flattenTree(sub, p, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexNode(e *IndexEntry) *Node {
+	return &Node{Name: path.Base(e.Path), Perm: e.Mode, Ref: e.Ptr}
+}
+
+// staged compares HEAD with the index
+func (s *statusScan) staged(head map[string]*Node, renames bool) error {
+	var changes []*Change
+	for _, e := range s.idx.Entries {
+		if e.Stage != 0 {
+			se := s.entry(e.Path)
+			se.Unmerged = append(se.Unmerged, e)
+			continue
+		}
+		if e.IntentToAdd {
+			continue
+		}
+		n := head[e.Path]
+		switch {
+		case n == nil:
+			changes = append(changes, &Change{Type: Added, NewPath: e.Path, New: indexNode(e)})
+		case n.Ref != e.Ptr || n.Perm != e.Mode:
+			t := Modified
+			if n.Perm&modeTypeMask != e.Mode&modeTypeMask {
+				t = TypeChanged
+			}
+			changes = append(changes, &Change{
+				Type:    t,
+				OldPath: e.Path,
+				NewPath: e.Path,
+				Old:     n,
+				New:     indexNode(e),
+			})
+		}
+	}
+	for p, n := range head {
+		if !s.tracked[p] {
+			changes = append(changes, &Change{Type: Deleted, OldPath: p, Old: n})
+		}
+	}
+	changePath := func(c *Change) string {
+		if c.NewPath != "" {
+			return c.NewPath
+		}
+		return c.OldPath
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changePath(changes[i]) < changePath(changes[j])
+	})
+
+	if renames {
+		d := &treeDiffer{repo: s.repo, changes: changes}
+		if err := d.detectRenames(nil, &DiffOptions{DetectRenames: true}); err != nil {
+			return err
+		}
+		changes = d.changes
+	}
+	for _, c := range changes {
+		s.entry(changePath(c)).Staged = c
+	}
+	return nil
+}
+
+// unstaged compares the index with the work tree
+func (s *statusScan) unstaged() error {
+	for _, e := range s.idx.Entries {
+		if e.Stage != 0 || e.SkipWorktree || e.AssumeValid {
+			continue
+		}
+		c, err := s.checkFile(e)
+		if err != nil {
+			return err
+		}
+		if c != nil {
+			s.entry(e.Path).Unstaged = c
+		}
+	}
+	return nil
+}
+
+// checkFile compares an index entry with the file in the work tree,
+// updating the entry's stat data if only that has changed
+func (s *statusScan) checkFile(e *IndexEntry) (*Change, error) {
+	full := filepath.Join(s.dir, filepath.FromSlash(e.Path))
+	old := indexNode(e)
+	deleted := &Change{Type: Deleted, OldPath: e.Path, Old: old}
+
+	fi, err := os.Lstat(full)
+	if err != nil {
+		if os.IsNotExist(err) || isNotDir(err) {
+			return deleted, nil
+		}
+		return nil, err
+	}
+	mode := worktreeMode(fi)
+	if e.IntentToAdd {
+		return &Change{Type: Added, NewPath: e.Path, New: &Node{Name: old.Name, Perm: mode}}, nil
+	}
+	if old.IsSubmodule() {
+		// we don't look inside submodules
+		if fi.IsDir() {
+			return nil, nil
+		}
+		return deleted, nil
+	}
+	if fi.IsDir() {
+		return deleted, nil
+	}
+	if mode&modeTypeMask != e.Mode&modeTypeMask {
+		return &Change{
+			Type:    TypeChanged,
+			OldPath: e.Path,
+			NewPath: e.Path,
+			Old:     old,
+			New:     &Node{Name: old.Name, Perm: mode},
+		}, nil
+	}
+
+	sd := statData(fi)
+	if mode == e.Mode && !statChanged(&e.StatData, &sd) && !s.racy(e) {
+		return nil, nil
+	}
+	data, err := readWorktreeFile(full, fi)
+	if err != nil {
+		return nil, err
+	}
+	p := HashObject(ObjBlob, data)
+	if p == e.Ptr && mode == e.Mode {
+		e.StatData = sd
+		s.refreshed = true
+		return nil, nil
+	}
+	return &Change{
+		Type:    Modified,
+		OldPath: e.Path,
+		NewPath: e.Path,
+		Old:     old,
+		New:     &Node{Name: old.Name, Perm: mode, Ref: p},
+	}, nil
+}
+
+// racy is true if a file could have been modified after the index
+// was written without its timestamp showing it
+func (s *statusScan) racy(e *IndexEntry) bool {
+	return !s.idx.mtime.IsZero() && !e.MTime.Before(s.idx.mtime)
+}
+
+// statChanged compares the stat data from the index with a file's.
+// Like git, nanoseconds and change times are only compared if the
+// index has them
+func statChanged(a, b *StatData) bool {
+	if a.Size != b.Size || a.MTime.Unix() != b.MTime.Unix() {
+		return true
+	}
+	if a.MTime.Nanosecond() != 0 && a.MTime.Nanosecond() != b.MTime.Nanosecond() {
+		return true
+	}
+	if !a.CTime.IsZero() && !b.CTime.IsZero() && !a.CTime.Equal(b.CTime) {
+		return true
+	}
+	if a.Ino != 0 && b.Ino != 0 && a.Ino != b.Ino {
+		return true
+	}
+	return false
+}
+
+func isNotDir(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == syscall.ENOTDIR
+	}
+	return false
+}
+
+// worktreeMode returns the mode git would record for a file
+func worktreeMode(fi os.FileInfo) uint {
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		return ModeSymLink
+	case fi.IsDir():
+		return ModeDir
+	case fi.Mode()&0111 != 0:
+		return ModeExecutable
+	default:
+		return ModeFile
+	}
+}
+
+// readWorktreeFile returns what git would store for a file: its
+// contents, or for a symlink, its target
+func readWorktreeFile(full string, fi os.FileInfo) ([]byte, error) {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(full)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(filepath.ToSlash(target)), nil
+	}
+	return ioutil.ReadFile(full)
+}
+
+// walkUntracked finds the untracked files in a directory.  A
+// directory with nothing tracked in it is reported as a whole (with
+// a trailing '/'), as long as there is something in it that isn't
+// ignored
+func (s *statusScan) walkUntracked(rel string, ignored bool) error {
+	full := filepath.Join(s.dir, filepath.FromSlash(rel))
+	if err := s.ignore.AddFile(rel, filepath.Join(full, ".gitignore")); err != nil {
+		return err
+	}
+	lst, err := ioutil.ReadDir(full)
+	if err != nil {
+		return err
+	}
+	for _, fi := range lst {
+		if fi.Name() == ".git" {
+			continue
+		}
+		p := path.Join(rel, fi.Name())
+		if fi.IsDir() {
+			skip := ignored || s.ignore.Match(p, true)
+			if s.dirs[p] {
+				// anything untracked in an ignored directory
+				// is ignored, even if there are tracked files
+				if err := s.walkUntracked(p, skip); err != nil {
+					return err
+				}
+				continue
+			}
+			if s.tracked[p] || skip {
+				continue
+			}
+			found, err := s.anyUntracked(p)
+			if err != nil {
+				return err
+			}
+			if found {
+				s.untracked = append(s.untracked, p+"/")
+			}
+			continue
+		}
+		if s.tracked[p] || ignored || s.ignore.Match(p, false) {
+			continue
+		}
+		s.untracked = append(s.untracked, p)
+	}
+	return nil
+}
+
+// anyUntracked returns true if a directory with nothing tracked in it
+// has anything that isn't ignored.  Another repository counts
+func (s *statusScan) anyUntracked(rel string) (bool, error) {
+	full := filepath.Join(s.dir, filepath.FromSlash(rel))
+	if err := s.ignore.AddFile(rel, filepath.Join(full, ".gitignore")); err != nil {
+		return false, err
+	}
+	lst, err := ioutil.ReadDir(full)
+	if err != nil {
+		return false, err
+	}
+	for _, fi := range lst {
+		if fi.Name() == ".git" {
+			return true, nil
+		}
+		p := path.Join(rel, fi.Name())
+		if s.ignore.Match(p, fi.IsDir()) {
+			continue
+		}
+		if !fi.IsDir() {
+			return true, nil
+		}
+		found, err := s.anyUntracked(p)
+		if found || err != nil {
+			return found, err
+		}
+	}
+	return false, nil
+}
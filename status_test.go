@@ -0,0 +1,158 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	dir := t.TempDir()
+	initRepo(t, dir)
+	writeFile(t, dir, ".gitignore", "*.log\nbuild/\n")
+	writeFile(t, dir, "dir/.gitignore", "!keep.log\n")
+	writeFile(t, dir, "a.txt", "a\n")
+	writeFile(t, dir, "b.txt", "b\n")
+	writeFile(t, dir, "dir/c.txt", "c\n")
+	writeFile(t, dir, "dir/d.txt", "d\n")
+	writeFile(t, dir, "exec.sh", "#!/bin/sh\n")
+	writeFile(t, dir, "old.txt", "a file that will be renamed\n")
+	writeFile(t, dir, "touched.txt", "same\n")
+	writeFile(t, dir, "conflict.txt", "base\n")
+	os.Symlink("a.txt", filepath.Join(dir, "link"))
+	gitCmd(t, dir, "", "add", ".")
+	gitCmd(t, dir, "", "commit", "-q", "-m", "base")
+
+	writeFile(t, dir, "a.txt", "staged\n")
+	gitCmd(t, dir, "", "add", "a.txt")
+	writeFile(t, dir, "a.txt", "and then unstaged\n")
+	writeFile(t, dir, "b.txt", "unstaged\n")
+	os.Remove(filepath.Join(dir, "dir/c.txt"))
+	gitCmd(t, dir, "", "rm", "-q", "dir/d.txt")
+	os.Chmod(filepath.Join(dir, "exec.sh"), 0755)
+	os.Remove(filepath.Join(dir, "link"))
+	writeFile(t, dir, "link", "now a file\n")
+	gitCmd(t, dir, "", "mv", "old.txt", "new.txt")
+	writeFile(t, dir, "added.txt", "added\n")
+	gitCmd(t, dir, "", "add", "added.txt")
+	writeFile(t, dir, "later.txt", "later\n")
+	gitCmd(t, dir, "", "add", "-N", "later.txt")
+	var stages []string
+	for i, body := range []string{"base\n", "ours\n", "theirs\n"} {
+		p := strings.TrimSpace(gitCmd(t, dir, body, "hash-object", "-w", "--stdin"))
+		stages = append(stages, "100644 "+p+" "+strconv.Itoa(i+1)+"\tconflict.txt\n")
+	}
+	gitCmd(t, dir, "0 0000000000000000000000000000000000000000\tconflict.txt\n"+
+		strings.Join(stages, ""), "update-index", "--index-info")
+
+	writeFile(t, dir, "top.txt", "untracked\n")
+	writeFile(t, dir, "junk/deeper/x", "untracked\n")
+	writeFile(t, dir, "onlyignored/x.log", "ignored\n")
+	writeFile(t, dir, "build/out", "ignored\n")
+	writeFile(t, dir, "debug.log", "ignored\n")
+	writeFile(t, dir, "dir/keep.log", "not ignored\n")
+	writeFile(t, dir, "dir/other.log", "ignored\n")
+
+	// the same content, but the stat data no longer matches
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "touched.txt"), past, past)
+
+	g, err := Open(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		flags []string
+		opts  *StatusOptions
+	}{
+		{[]string{"-c", "status.renames=false", "status", "--porcelain"}, nil},
+		{[]string{"status", "--porcelain"}, &StatusOptions{DetectRenames: true}},
+		{[]string{"-c", "status.renames=false", "status", "--porcelain", "-uno"}, &StatusOptions{NoUntracked: true}},
+	}
+	for _, c := range cases {
+		st, err := g.Status(dir, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := gitCmd(t, dir, "", c.flags...)
+		if st.String() != expect {
+			t.Errorf("git %v:\n--- got ---\n%s--- expected ---\n%s", c.flags, st, expect)
+		}
+	}
+
+	// refreshing records the new stat data, so the file is not
+	// rehashed next time
+	_, err = g.Status(dir, &StatusOptions{Refresh: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := g.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(filepath.Join(dir, "touched.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd := statData(fi)
+	if e := idx.Entry("touched.txt"); e == nil || statChanged(&e.StatData, &sd) {
+		t.Errorf("expected touched.txt to be refreshed")
+	}
+}
+
+func TestIgnoreMatcher(t *testing.T) {
+	m := NewIgnoreMatcher()
+	m.AddPatterns("", []byte(strings.Join([]string{
+		"# a comment",
+		"*.o",
+		"!keep.o",
+		"/rooted",
+		"build/",
+		"doc/**/*.html",
+		"**/cache",
+		"out/**",
+		"\\#hash",
+		"trailing   ",
+		"[!a]x",
+	}, "\n")))
+	m.AddPatterns("sub", []byte("local\n!*.o\n"))
+
+	cases := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.o", false, true},
+		{"deep/down/a.o", false, true},
+		{"keep.o", false, false},
+		{"rooted", false, true},
+		{"x/rooted", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"x/build", true, true},
+		{"doc/a.html", false, true},
+		{"doc/x/y/a.html", false, true},
+		{"src/doc/a.html", false, false},
+		{"cache", true, true},
+		{"a/b/cache", false, true},
+		{"out", true, false},
+		{"out/x", false, true},
+		{"#hash", false, true},
+		{"trailing", false, true},
+		{"bx", false, true},
+		{"ax", false, false},
+		{"sub/local", false, true},
+		{"local", false, false},
+		{"sub/a.o", false, false},
+		{"# a comment", false, false},
+	}
+	for _, c := range cases {
+		if got := m.Match(c.path, c.isDir); got != c.ignored {
+			t.Errorf("%q (dir %t): expected %t", c.path, c.isDir, c.ignored)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package git
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrNoRef = errors.New("no such ref")
+var ErrRefLoop = errors.New("symbolic ref loop")
+
+// git gives up after following this many symbolic refs
+const maxSymRefDepth = 5
+
+// A RawRef is the stored value of a ref: either an object name, or
+// (for a symbolic ref) the name of another ref in Target
+type RawRef struct {
+	Name   string
+	Ptr    Ptr
+	Target string
+}
+
+// optional interface, for stores that can read refs (including
+// symbolic refs like HEAD) by their full name.  ReadRef returns
+// ErrNoRef if the store does not have the ref
+type RefReader interface {
+	ReadRef(name string) (*RawRef, error)
+}
+
+// A ResolvedRef is the result of following a ref through any
+// symbolic refs to an object name
+type ResolvedRef struct {
+	Name   string   // the name that was resolved
+	Target string   // the ref it ends up at; the same as Name if not symbolic
+	Chain  []string // every ref visited, from Name to Target
+	Ptr    Ptr
+	Unborn bool // Target does not exist yet, as in a new repository
+}
+
+// Detached returns true if the ref is not symbolic.  This is the
+// usual sense of "detached" when the ref is HEAD
+func (r *ResolvedRef) Detached() bool {
+	return r.Target == r.Name
+}
+
+// Branch returns the short name of the branch the ref refers to, or
+// "" if it does not end up at a branch
+func (r *ResolvedRef) Branch() string {
+	if strings.HasPrefix(r.Target, "refs/heads/") {
+		return r.Target[len("refs/heads/"):]
+	}
+	return ""
+}
+
+// resolveRef follows symbolic refs, using the given function to
+// read each one
+func resolveRef(read func(string) (*RawRef, error), name string) (*ResolvedRef, error) {
+	res := &ResolvedRef{Name: name}
+	at := name
+	for i := 0; i <= maxSymRefDepth; i++ {
+		res.Chain = append(res.Chain, at)
+		res.Target = at
+		r, err := read(at)
+		if err == ErrNoRef && i > 0 {
+			// a symref to a ref that does not exist yet
+			res.Unborn = true
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if r.Target == "" {
+			res.Ptr = r.Ptr
+			return res, nil
+		}
+		at = r.Target
+	}
+	return nil, ErrRefLoop
+}
+
+// lookupRef reads a ref from the first store that has it
+func (g *Git) lookupRef(name string) (*RawRef, error) {
+	if !validRefName(name) {
+		return nil, ErrInvalidRef
+	}
+	t, short, typed := splitRefName(name)
+	for _, store := range g.storeList() {
+		if rr, ok := store.(RefReader); ok {
+			r, err := rr.ReadRef(name)
+			if err == nil {
+				return r, nil
+			}
+			if err != ErrNoRef {
+				return nil, err
+			}
+			continue
+		}
+		// stores that only know about named refs can't have
+		// symbolic refs, but may know about branches and tags
+		if typed {
+			if nr := store.GetNamed(t, short); nr != nil {
+				return &RawRef{Name: name, Ptr: nr.Ptr}, nil
+			}
+		}
+	}
+	return nil, ErrNoRef
+}
+
+// splitRefName turns a name like "refs/heads/main" into the
+// corresponding RefType and short name
+func splitRefName(name string) (RefType, string, bool) {
+	for _, t := range []RefType{Head, Tag, Remote} {
+		prefix := "refs/" + t.String() + "/"
+		if strings.HasPrefix(name, prefix) {
+			return t, name[len(prefix):], true
+		}
+	}
+	return Head, "", false
+}
+
+// ResolveRef follows a ref, given its full name such as "HEAD" or
+// "refs/heads/main", through any symbolic refs to an object name
+func (g *Git) ResolveRef(name string) (*ResolvedRef, error) {
+	return resolveRef(g.lookupRef, name)
+}
+
+// Head resolves HEAD.  If HEAD is detached, the result's Detached()
+// is true; if it names a branch with no commits yet, Unborn is true
+func (g *Git) Head() (*ResolvedRef, error) {
+	return g.ResolveRef("HEAD")
+}
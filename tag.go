@@ -0,0 +1,108 @@
+package git
+
+import (
+	"errors"
+)
+
+// An AnnotatedTag is a tag object, as created by "git tag -a".  (The
+// name Tag is already taken by the RefType for lightweight tags.)
+type AnnotatedTag struct {
+	name       Ptr
+	raw        []byte
+	repo       *Git
+	Object     Ptr
+	ObjectType ObjType
+	Tag        string
+	Tagger     *Stamp
+	Message    string
+}
+
+func (t *AnnotatedTag) Type() ObjType {
+	return ObjTag
+}
+
+func (t *AnnotatedTag) Payload() ([]byte, error) {
+	return t.raw, nil
+}
+
+func (t *AnnotatedTag) Load() (GitObject, error) {
+	return t, nil
+}
+
+func (t *AnnotatedTag) Name() *Ptr {
+	return &t.name
+}
+
+// Peel follows the tag (and any tags it points to) until reaching
+// something that is not a tag, usually a commit
+func (t *AnnotatedTag) Peel() (GitObject, error) {
+	return t.repo.Peel(&t.Object)
+}
+
+var ErrBadTag = errors.New("malformed tag object")
+var ErrMissingObject = errors.New("object not found")
+var ErrTagLoop = errors.New("tag chain too deep")
+
+// maximum number of tags we will follow when peeling
+const maxPeelDepth = 100
+
+func (g *Git) loadTag(name *Ptr, buf []byte) (*AnnotatedTag, error) {
+	t := &AnnotatedTag{
+		name: *name,
+		repo: g,
+		raw:  buf,
+	}
+	hdrs, msg, err := parseHeaders(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	haveObject := false
+	for _, h := range hdrs {
+		switch h.Key {
+		case "object":
+			p, ok := ParsePtr(h.Value)
+			if !ok {
+				return nil, ErrBadTag
+			}
+			t.Object = p
+			haveObject = true
+		case "type":
+			ot, ok := typeFromString[h.Value]
+			if !ok {
+				return nil, ErrBadTag
+			}
+			t.ObjectType = ot
+		case "tag":
+			t.Tag = h.Value
+		case "tagger":
+			s, err := parseStamp([]byte(h.Value))
+			if err != nil {
+				return nil, err
+			}
+			t.Tagger = s
+		}
+	}
+	if !haveObject || t.ObjectType == ObjNone {
+		return nil, ErrBadTag
+	}
+	t.Message = string(msg)
+	return t, nil
+}
+
+// Peel loads the given object, following annotated tags until
+// reaching an object which is not a tag
+func (g *Git) Peel(p *Ptr) (GitObject, error) {
+	for i := 0; i < maxPeelDepth; i++ {
+		o, err := g.load(p)
+		if err != nil {
+			return nil, err
+		}
+		t, ok := o.(*AnnotatedTag)
+		if !ok {
+			return o, nil
+		}
+		p = &t.Object
+	}
+	return nil, ErrTagLoop
+}
@@ -0,0 +1,117 @@
+package git
+
+import (
+	"fmt"
+	"testing"
+)
+
+// memStore is a trivial in-memory Store used by the tests
+type memStore struct {
+	repo *Git
+	objs map[Ptr]*memObject
+}
+
+type memObject struct {
+	store   *memStore
+	name    Ptr
+	t       ObjType
+	payload []byte
+}
+
+func newMemStore(g *Git) *memStore {
+	m := &memStore{repo: g, objs: make(map[Ptr]*memObject)}
+	g.AddStore(m)
+	return m
+}
+
+func (m *memStore) add(t ObjType, payload string) Ptr {
+	p := HashObject(t, []byte(payload))
+	m.objs[p] = &memObject{store: m, name: p, t: t, payload: []byte(payload)}
+	return p
+}
+
+func (m *memStore) GetNamed(RefType, string) *NamedRef {
+	return nil
+}
+
+func (m *memStore) Get(p *Ptr) GitObject {
+	if o, ok := m.objs[*p]; ok {
+		return o
+	}
+	return nil
+}
+
+func (m *memStore) EnumerateTo(to chan<- Ptr) {
+	for p := range m.objs {
+		to <- p
+	}
+}
+
+func (mo *memObject) Name() *Ptr {
+	return &mo.name
+}
+
+func (mo *memObject) Type() ObjType {
+	return mo.t
+}
+
+func (mo *memObject) Payload() ([]byte, error) {
+	return []byte(fmt.Sprintf("%s %d\x00%s", mo.t, len(mo.payload), mo.payload)), nil
+}
+
+func (mo *memObject) Load() (GitObject, error) {
+	return mo.store.repo.Interpret(&mo.name, mo.t, mo.payload)
+}
+
+func TestAnnotatedTag(t *testing.T) {
+	g := New()
+	m := newMemStore(g)
+
+	tree := m.add(ObjTree, "")
+	commit := m.add(ObjCommit, fmt.Sprintf("tree %s\n"+
+		"author A U Thor <author@example.com> 1500000000 -0500\n"+
+		"committer A U Thor <author@example.com> 1500000000 -0500\n"+
+		"\n"+
+		"initial\n", &tree))
+	inner := m.add(ObjTag, fmt.Sprintf("object %s\n"+
+		"type commit\n"+
+		"tag v1.0\n"+
+		"tagger T Agger <tagger@example.com> 1500000100 +0100\n"+
+		"\n"+
+		"release 1.0\n", &commit))
+	outer := m.add(ObjTag, fmt.Sprintf("object %s\n"+
+		"type tag\n"+
+		"tag v1.0-signed\n"+
+		"tagger T Agger <tagger@example.com> 1500000200 +0100\n"+
+		"\n"+
+		"wrapped\n", &inner))
+
+	o, err := g.Get(&outer).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, ok := o.(*AnnotatedTag)
+	if !ok {
+		t.Fatalf("expected *AnnotatedTag, got %T", o)
+	}
+	if tag.ObjectType != ObjTag || !tag.Object.Equals(&inner) {
+		t.Fatalf("bad target %s %s", tag.ObjectType, &tag.Object)
+	}
+	if tag.Tag != "v1.0-signed" {
+		t.Fatalf("bad tag name %q", tag.Tag)
+	}
+	if tag.Tagger == nil || tag.Tagger.Email != "tagger@example.com" {
+		t.Fatalf("bad tagger %v", tag.Tagger)
+	}
+	if tag.Message != "wrapped\n" {
+		t.Fatalf("bad message %q", tag.Message)
+	}
+
+	peeled, err := tag.Peel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peeled.Type() != ObjCommit || !peeled.Name().Equals(&commit) {
+		t.Fatalf("peeled to %s %s", peeled.Type(), peeled.Name())
+	}
+}
@@ -2,7 +2,9 @@ package git
 
 import (
 	"bytes"
+	"errors"
 	"path"
+	"sort"
 	//"fmt"
 	"strconv"
 	"strings"
@@ -16,12 +18,21 @@ type Node struct {
 
 const SymLinkFlag = 020000
 
+// the object type bits of a mode
+const modeTypeMask = 0170000
+
 func (n *Node) IsSymLink() bool {
-	return n.Perm&SymLinkFlag != 0
+	return n.Perm&modeTypeMask == ModeSymLink
 }
 
 func (n *Node) IsDir() bool {
-	return n.Perm&040000 != 0
+	return n.Perm&modeTypeMask == ModeDir
+}
+
+// IsSubmodule returns true if the entry is a gitlink, in which case
+// its Ref is a commit in some other repository
+func (n *Node) IsSubmodule() bool {
+	return n.Perm&modeTypeMask == ModeSubmodule
 }
 
 type Tree struct {
@@ -170,3 +181,90 @@ func (g *Git) loadTree(name *Ptr, buf []byte) (*Tree, error) {
 	}
 	return t, nil
 }
+
+var ErrBadTreeEntry = errors.New("invalid tree entry")
+
+// canonical modes, as written by git
+const (
+	ModeFile       = 0100644
+	ModeExecutable = 0100755
+	ModeSymLink    = 0120000
+	ModeDir        = 040000
+	ModeSubmodule  = 0160000
+)
+
+// treeLess orders tree entries the way git does, which is by name
+// except that directories sort as if their name ended with '/'
+func treeLess(a, b *Node) bool {
+	an, bn := a.Name, b.Name
+	if a.IsDir() {
+		an += "/"
+	}
+	if b.IsDir() {
+		bn += "/"
+	}
+	return an < bn
+}
+
+// EncodeTree produces the payload of a tree object containing the
+// given entries.  The entries do not need to be in any particular
+// order, but their names have to be unique and their modes canonical
+func EncodeTree(nodes []*Node) ([]byte, error) {
+	// a file and a directory of the same name don't sort next to
+	// each other, so look for duplicates before sorting
+	seen := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		if seen[n.Name] {
+			return nil, ErrBadTreeEntry
+		}
+		seen[n.Name] = true
+		switch n.Perm {
+		case ModeFile, ModeExecutable, ModeSymLink, ModeDir, ModeSubmodule:
+		default:
+			return nil, ErrBadTreeEntry
+		}
+	}
+
+	sorted := make([]*Node, len(nodes))
+	copy(sorted, nodes)
+	sort.Slice(sorted, func(i, j int) bool {
+		return treeLess(sorted[i], sorted[j])
+	})
+
+	var buf bytes.Buffer
+	for _, n := range sorted {
+		if n.Name == "" || n.Name == "." || n.Name == ".." ||
+			strings.ContainsAny(n.Name, "/\x00") {
+			return nil, ErrBadTreeEntry
+		}
+		buf.WriteString(strconv.FormatUint(uint64(n.Perm), 8))
+		buf.WriteByte(' ')
+		buf.WriteString(n.Name)
+		buf.WriteByte(0)
+		buf.Write(n.Ref.hash[:])
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteTree stores a new tree object with the given entries
+func (g *Git) WriteTree(nodes []*Node) (*Tree, error) {
+	buf, err := EncodeTree(nodes)
+	if err != nil {
+		return nil, err
+	}
+	p, err := g.Put(ObjTree, buf)
+	if err != nil {
+		return nil, err
+	}
+	return g.loadTree(&p, buf)
+}
+
+// Nodes returns the tree's entries, in the order they appear in
+// the tree
+func (t *Tree) Nodes() []*Node {
+	lst := make([]*Node, len(t.list))
+	for i, name := range t.list {
+		lst[i] = t.contents[name]
+	}
+	return lst
+}
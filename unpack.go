@@ -0,0 +1,244 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+var ErrMissingDeltaBase = errors.New("delta base not found")
+
+// packStream reads a pack as a stream, keeping track of the offset
+// and the checksum of what has been read (along with the CRC32 of
+// the current entry, for the index).  It is an io.ByteReader so that
+// zlib does not read past the end of each object
+type packStream struct {
+	r   *bufio.Reader
+	h   hash.Hash
+	crc uint32
+	off int64
+}
+
+func newPackStream(r io.Reader) *packStream {
+	return &packStream{r: bufio.NewReaderSize(r, 65536), h: sha1.New()}
+}
+
+func (ps *packStream) Read(buf []byte) (int, error) {
+	n, err := ps.r.Read(buf)
+	ps.h.Write(buf[:n])
+	ps.crc = crc32.Update(ps.crc, crc32.IEEETable, buf[:n])
+	ps.off += int64(n)
+	return n, err
+}
+
+func (ps *packStream) ReadByte() (byte, error) {
+	b, err := ps.r.ReadByte()
+	if err == nil {
+		ps.h.Write([]byte{b})
+		ps.crc = crc32.Update(ps.crc, crc32.IEEETable, []byte{b})
+		ps.off++
+	}
+	return b, err
+}
+
+// header reads the pack header, returning the number of objects
+func (ps *packStream) header() (uint32, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(ps, hdr[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(hdr[0:]) != GitPackSignature {
+		return 0, ErrNotAPack
+	}
+	if v := binary.BigEndian.Uint32(hdr[4:]); v != 2 && v != 3 {
+		return 0, ErrNotAPack
+	}
+	return binary.BigEndian.Uint32(hdr[8:]), nil
+}
+
+// packEntry is an object as it appears in a pack
+type packEntry struct {
+	offset     int64
+	typ        ObjType
+	data       []byte // inflated, which for a delta is the delta
+	baseOffset int64  // for ObjOffsetDelta
+	baseName   Ptr    // for ObjRefDelta
+	crc        uint32 // of the entry as it is in the pack
+}
+
+// entry reads the next object
+func (ps *packStream) entry() (*packEntry, error) {
+	e := &packEntry{offset: ps.off}
+	ps.crc = 0
+	b, err := ps.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	e.typ = ObjType(b >> 4 & 7)
+	size := int64(b & 0x0f)
+	for shift := uint(4); b&0x80 != 0; shift += 7 {
+		if b, err = ps.ReadByte(); err != nil {
+			return nil, err
+		}
+		size |= int64(b&0x7f) << shift
+	}
+
+	switch e.typ {
+	case ObjCommit, ObjTree, ObjBlob, ObjTag:
+	case ObjOffsetDelta:
+		if b, err = ps.ReadByte(); err != nil {
+			return nil, err
+		}
+		rel := int64(b & 0x7f)
+		for b&0x80 != 0 {
+			if b, err = ps.ReadByte(); err != nil {
+				return nil, err
+			}
+			rel = (rel+1)<<7 | int64(b&0x7f)
+		}
+		if rel <= 0 || rel > e.offset {
+			return nil, ErrBadBaseOffset
+		}
+		e.baseOffset = e.offset - rel
+	case ObjRefDelta:
+		if _, err := io.ReadFull(ps, e.baseName.hash[:]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnknownObjectType
+	}
+
+	z, err := zlib.NewReader(ps)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if size < 1<<24 {
+		// don't trust a huge size before seeing the data
+		buf.Grow(int(size))
+	}
+	if _, err := io.Copy(&buf, z); err != nil {
+		return nil, err
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) != size {
+		return nil, ErrCorrupt
+	}
+	e.data = buf.Bytes()
+	e.crc = ps.crc
+	return e, nil
+}
+
+// trailer checks the checksum at the end of the pack, returning it
+func (ps *packStream) trailer() (Ptr, error) {
+	var sum, trailer Ptr
+	copy(sum.hash[:], ps.h.Sum(nil))
+	if _, err := io.ReadFull(ps.r, trailer.hash[:]); err != nil {
+		return Ptr{}, err
+	}
+	if sum != trailer {
+		return Ptr{}, ErrPackChecksum
+	}
+	return trailer, nil
+}
+
+// UnpackObjects reads a pack stream and writes each object in it
+// into the repository (as "git unpack-objects" does), returning how
+// many there were.  Deltas may be against objects the repository
+// already has, as in a thin pack
+func (g *Git) UnpackObjects(r io.Reader) (int, error) {
+	ps := newPackStream(r)
+	count, err := ps.header()
+	if err != nil {
+		return 0, err
+	}
+
+	// what we have written so far, by offset, for OFS_DELTA bases
+	done := make(map[int64]Ptr, count)
+	// deltas whose bases we don't have yet
+	var waiting []*packEntry
+
+	// apply tries to store an object, returning false if it is a
+	// delta whose base we don't have (yet)
+	apply := func(e *packEntry) (bool, error) {
+		var base Ptr
+		switch e.typ {
+		case ObjOffsetDelta:
+			p, ok := done[e.baseOffset]
+			if !ok {
+				return false, nil
+			}
+			base = p
+		case ObjRefDelta:
+			if g.Get(&e.baseName) == nil {
+				return false, nil
+			}
+			base = e.baseName
+		default:
+			p, err := g.Put(e.typ, e.data)
+			if err != nil {
+				return false, err
+			}
+			done[e.offset] = p
+			return true, nil
+		}
+		data, typ, err := g.rawObject(&base)
+		if err != nil {
+			return false, err
+		}
+		data, _, err = patchDelta(typ, data, e.data)
+		if err != nil {
+			return false, err
+		}
+		p, err := g.Put(typ, data)
+		if err != nil {
+			return false, err
+		}
+		done[e.offset] = p
+		return true, nil
+	}
+
+	for i := uint32(0); i < count; i++ {
+		e, err := ps.entry()
+		if err != nil {
+			return 0, err
+		}
+		ok, err := apply(e)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			waiting = append(waiting, e)
+		}
+	}
+	if _, err := ps.trailer(); err != nil {
+		return 0, err
+	}
+
+	// a delta can come before its base, which may itself be waiting
+	for len(waiting) > 0 {
+		var still []*packEntry
+		for _, e := range waiting {
+			ok, err := apply(e)
+			if err != nil {
+				return 0, err
+			}
+			if !ok {
+				still = append(still, e)
+			}
+		}
+		if len(still) == len(waiting) {
+			return 0, ErrMissingDeltaBase
+		}
+		waiting = still
+	}
+	return int(count), nil
+}
@@ -11,7 +11,8 @@ import (
 )
 
 type gitFS struct {
-	root *Tree
+	root  *Tree
+	times *modTimes // nil if we don't know the commit
 }
 
 func (fs *gitFS) String() string {
@@ -49,6 +50,7 @@ type nodeFileInfo struct {
 	repo   *Git
 	n      *Node
 	target GitObject
+	mtime  time.Time
 }
 
 func (nfi *nodeFileInfo) String() string {
@@ -67,11 +69,15 @@ func (nfi *nodeFileInfo) Name() string {
 
 // IsDir implements os.FileInfo
 func (nfi *nodeFileInfo) IsDir() bool {
-	return nfi.n.IsDir()
+	return nfi.n.IsDir() || nfi.n.IsSubmodule()
 }
 
 // Size implements os.FileInfo
 func (nfi *nodeFileInfo) Size() int64 {
+	if nfi.n.IsSubmodule() {
+		// the commit is in another repository
+		return 0
+	}
 	if nfi.target == nil {
 		o, err := nfi.repo.Get(&nfi.n.Ref).Load()
 		if err != nil {
@@ -94,7 +100,7 @@ func (nfi *nodeFileInfo) Size() int64 {
 // Mode implements os.FileInfo
 func (nfi *nodeFileInfo) Mode() os.FileMode {
 	mode := nfi.n.Perm & 0777
-	if nfi.n.IsDir() {
+	if nfi.IsDir() {
 		mode |= uint(os.ModeDir)
 	}
 	if nfi.n.IsSymLink() {
@@ -105,10 +111,7 @@ func (nfi *nodeFileInfo) Mode() os.FileMode {
 
 // ModTime implements os.FileInfo
 func (nfi *nodeFileInfo) ModTime() time.Time {
-	// TODO, ideally we would return the timestamp of the first
-	// commit that introduces this blob (since blobs are immutable,
-	// we know it is not modified after that!)
-	return time.Now()
+	return nfi.mtime
 }
 
 // Sys implements os.FileInfo
@@ -116,22 +119,24 @@ func (nfi *nodeFileInfo) Sys() interface{} {
 	return nfi.n
 }
 
-func (fs *gitFS) walk(posn string, follow bool) (*Node, error) {
+// walk finds the node for a path, and the path it ended up at after
+// following any symlinks
+func (fs *gitFS) walk(posn string, follow bool) (*Node, string, error) {
 	for {
 		n := fs.root.Walk(posn)
 		if n == nil {
-			return nil, ErrNoEntry
+			return nil, "", ErrNoEntry
 		}
 		//log.Info("%s perm %o", posn, n.Perm)
 		if !n.IsSymLink() || !follow {
 			//log.Info("IsSymLink=%t follow=%t", n.IsSymLink(), follow)
-			return n, nil
+			return n, posn, nil
 		}
 		// it's a symbol link and we're in follow mode... keep looking
 		x := fs.root.repo.Get(&n.Ref)
 		obj, err := x.Load()
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		if blob, ok := obj.(*Blob); ok {
 			log.Info("Following from %q -> %q", posn, blob.Value())
@@ -139,20 +144,30 @@ func (fs *gitFS) walk(posn string, follow bool) (*Node, error) {
 			log.Info("current posn %q", posn)
 		} else {
 			// symlink value is not a blob?
-			return nil, ErrCorrupt
+			return nil, "", ErrCorrupt
 		}
 	}
 }
 
+// info describes the node at a path
+func (fs *gitFS) info(n *Node, posn string) *nodeFileInfo {
+	mtime := time.Now()
+	if fs.times != nil {
+		mtime = fs.times.get(posn)
+	}
+	return &nodeFileInfo{
+		repo:  fs.root.repo,
+		n:     n,
+		mtime: mtime,
+	}
+}
+
 func (fs *gitFS) stat(path string, follow bool) (os.FileInfo, error) {
-	n, err := fs.walk(path, follow)
+	n, posn, err := fs.walk(path, follow)
 	if err != nil {
 		return nil, err
 	}
-	return &nodeFileInfo{
-		repo: fs.root.repo,
-		n:    n,
-	}, nil
+	return fs.info(n, posn), nil
 }
 
 func (fs *gitFS) Lstat(path string) (os.FileInfo, error) {
@@ -163,16 +178,18 @@ func (fs *gitFS) Stat(path string) (os.FileInfo, error) {
 	return fs.stat(path, true)
 }
 
-func (fs *gitFS) dirtree(path string) (*Tree, error) {
+// dirtree finds the tree for a directory, and the path it ended up
+// at after following any symlinks
+func (fs *gitFS) dirtree(path string) (*Tree, string, error) {
 	if path == "" || path == "." {
-		return fs.root, nil
+		return fs.root, path, nil
 	}
-	n, err := fs.walk(path, true)
+	n, posn, err := fs.walk(path, true)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	if !n.IsDir() {
-		return nil, ErrNotDir
+		return nil, "", ErrNotDir
 	}
 
 	o := fs.root.repo.Get(&n.Ref)
@@ -184,15 +201,15 @@ func (fs *gitFS) dirtree(path string) (*Tree, error) {
 		panic(err)
 	}
 	if t, ok := o.(*Tree); ok {
-		return t, nil
+		return t, posn, nil
 	}
 	// WTF?  We already know its a directory; this repository
 	// is corrupted!
-	return nil, ErrCorrupt
+	return nil, "", ErrCorrupt
 }
 
-func (fs *gitFS) ReadDir(path string) ([]os.FileInfo, error) {
-	t, err := fs.dirtree(path)
+func (fs *gitFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	t, dir, err := fs.dirtree(dir)
 	if err != nil {
 		return nil, err
 	}
@@ -200,11 +217,7 @@ func (fs *gitFS) ReadDir(path string) ([]os.FileInfo, error) {
 	num := len(t.contents)
 	fi := make([]os.FileInfo, 0, num)
 	for _, v := range t.contents {
-		nfi := &nodeFileInfo{
-			repo: fs.root.repo,
-			n:    v,
-		}
-		fi = append(fi, nfi)
+		fi = append(fi, fs.info(v, path.Join(dir, v.Name)))
 	}
 	return fi, nil
 }
@@ -213,5 +226,5 @@ func (t *Tree) VFS() vfs.FileSystem {
 	if t == nil {
 		panic("null")
 	}
-	return &gitFS{t}
+	return &gitFS{root: t}
 }